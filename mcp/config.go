@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// upstreamConfig is one target MCP server in a proxy config file.
+type upstreamConfig struct {
+	Name string `yaml:"name"`
+	// URL defaults to the ${NAME}_HOST environment variable.
+	URL string `yaml:"url"`
+	// Prefix is put in front of the server's tool, prompt and resource names.
+	// It defaults to "<name>_" when several servers are proxied and to
+	// nothing otherwise; set it to "" explicitly to expose names unchanged.
+	Prefix *string `yaml:"prefix"`
+}
+
+// proxyConfig is the file named by -config, in YAML or JSON.
+type proxyConfig struct {
+	Servers []upstreamConfig `yaml:"servers"`
+}
+
+// loadUpstreams builds the proxy clients for the comma-separated -name list
+// and the servers of the -config file.
+func loadUpstreams(names, configFile string) ([]*HTTPProxyClient, error) {
+	var servers []upstreamConfig
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			servers = append(servers, upstreamConfig{Name: name})
+		}
+	}
+	if configFile != "" {
+		data, err := os.ReadFile(configFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config: %w", err)
+		}
+		var cfg proxyConfig
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return nil, fmt.Errorf("failed to parse config %s: %w", configFile, err)
+		}
+		servers = append(servers, cfg.Servers...)
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("-name or -config is required")
+	}
+
+	seen := map[string]bool{}
+	var upstreams []*HTTPProxyClient
+	for _, s := range servers {
+		if s.Name == "" {
+			return nil, fmt.Errorf("config server without a name")
+		}
+		if seen[s.Name] {
+			return nil, fmt.Errorf("server %s is listed twice", s.Name)
+		}
+		seen[s.Name] = true
+
+		url := s.URL
+		if url == "" {
+			hostEnvVar := strings.ToUpper(s.Name) + "_HOST"
+			if url = os.Getenv(hostEnvVar); url == "" {
+				return nil, fmt.Errorf("environment variable %s is not set", hostEnvVar)
+			}
+		}
+		prefix := ""
+		if s.Prefix != nil {
+			prefix = *s.Prefix
+		} else if len(servers) > 1 {
+			prefix = s.Name + "_"
+		}
+		upstreams = append(upstreams, &HTTPProxyClient{name: s.Name, prefix: prefix, targetHost: url})
+	}
+	return upstreams, nil
+}
@@ -1,91 +1,117 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
-	"os"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/mark3labs/mcp-go/server"
 )
 
 func main() {
-	var name string
-	flag.StringVar(&name, "name", "", "Name of the MCP server to proxy to (required)")
+	var names, configFile string
+	var pollInterval time.Duration
+	var maxPages int
+	flag.StringVar(&names, "name", "", "Comma-separated names of the MCP servers to proxy to")
+	flag.StringVar(&configFile, "config", "", "YAML or JSON file listing the MCP servers to proxy to")
+	flag.DurationVar(&pollInterval, "poll", 0, "Also refresh the servers' tools, resources and prompts at this interval (0 disables)")
+	flag.IntVar(&maxPages, "max-pages", 100, "Most pages of each list to read from a server")
 	flag.Parse()
 
-	if name == "" {
-		log.Fatal("Error: -name argument is required")
+	upstreams, err := loadUpstreams(names, configFile)
+	if err != nil {
+		log.Fatalf("Error: %v", err)
+	}
+	if maxPages < 1 {
+		log.Fatal("Error: -max-pages must be at least 1")
+	}
+
+	// Initialize connections to the target servers and discover their
+	// capabilities. A server that cannot be reached is left out unless it is
+	// the only one.
+	var ready []*HTTPProxyClient
+	for _, h := range upstreams {
+		log.Printf("Starting MCP proxy for %s, proxying to %s", h.name, h.targetHost)
+		if err := h.Initialize(context.Background()); err != nil {
+			if len(upstreams) == 1 {
+				log.Fatalf("Failed to initialize proxy client: %v", err)
+			}
+			log.Printf("Warning: Failed to initialize %s, leaving it out: %v", h.name, err)
+			continue
+		}
+		ready = append(ready, h)
 	}
-
-	// Look up the host from environment variable
-	hostEnvVar := strings.ToUpper(name) + "_HOST"
-	targetHost := os.Getenv(hostEnvVar)
-	if targetHost == "" {
-		log.Fatalf("Error: environment variable %s is not set", hostEnvVar)
+	if len(ready) == 0 {
+		log.Fatal("Error: none of the target servers could be initialized")
 	}
 
-	log.Printf("Starting MCP proxy server for %s, proxying to %s", name, targetHost)
-
-	// Create HTTP proxy client
-	proxyClient := &HTTPProxyClient{targetHost: targetHost}
-
-	// Initialize connection to target server and discover capabilities
-	if err := proxyClient.Initialize(context.Background()); err != nil {
-		log.Fatalf("Failed to initialize proxy client: %v", err)
+	// Create the MCP server with the capabilities of the origin servers and
+	// register their features on it
+	proxy := NewProxy(ready, pollInterval, maxPages)
+	if err := proxy.Register(context.Background()); err != nil {
+		proxy.Close(context.Background())
+		log.Fatalf("Error: %v", err)
 	}
 
-	// Create the MCP server with capabilities matching the origin server
-	mcpServer := proxyClient.CreateMCPServerWithCapabilities()
+	// Follow changes to the origin servers' features while serving
+	watchCtx, stopWatching := context.WithCancel(context.Background())
+	proxy.Watch(watchCtx)
 
-	// Only discover and register features that the origin server supports
-	if proxyClient.capabilities.Tools != nil {
-		if err := proxyClient.RegisterToolsOnServer(context.Background(), mcpServer); err != nil {
-			log.Printf("Warning: Failed to register tools: %v", err)
-		}
-	} else {
-		log.Printf("Origin server does not support tools - skipping tool discovery")
-	}
+	// Run the stdio server
+	serveErr := proxy.ServeStdio()
+	stopWatching()
 
-	if proxyClient.capabilities.Resources != nil {
-		if err := proxyClient.RegisterResourcesOnServer(context.Background(), mcpServer); err != nil {
-			log.Printf("Warning: Failed to register resources: %v", err)
-		}
-	} else {
-		log.Printf("Origin server does not support resources - skipping resource discovery")
-	}
-
-	if proxyClient.capabilities.Prompts != nil {
-		if err := proxyClient.RegisterPromptsOnServer(context.Background(), mcpServer); err != nil {
-			log.Printf("Warning: Failed to register prompts: %v", err)
-		}
-	} else {
-		log.Printf("Origin server does not support prompts - skipping prompt discovery")
-	}
+	// End the sessions with the target servers
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	proxy.Close(ctx)
 
-	// Create and run the stdio server
-	if err := server.ServeStdio(mcpServer); err != nil {
-		log.Fatalf("Server error: %v", err)
+	if serveErr != nil {
+		log.Fatalf("Server error: %v", serveErr)
 	}
 }
 
-// HTTPProxyClient handles HTTP requests to the target MCP server
+// shutdownTimeout bounds ending the session with the target server on exit
+const shutdownTimeout = 5 * time.Second
+
+// HTTPProxyClient handles HTTP requests to the target MCP server over the
+// Streamable HTTP transport
 type HTTPProxyClient struct {
-	targetHost   string
-	client       *http.Client
-	capabilities mcp.ServerCapabilities
+	name       string
+	prefix     string // put in front of the target's tool, prompt and resource names
+	targetHost string
+	client     *http.Client
+	nextID     atomic.Int64
+
+	// onNotification receives the notifications the target sends
+	onNotification func(method string, params json.RawMessage)
+
+	// initMu serializes re-initializing after the session expired
+	initMu sync.Mutex
+
+	mu              sync.Mutex
+	sessionID       string                 // issued by the target on initialize, if any
+	protocolVersion string                 // negotiated on initialize
+	capabilities    mcp.ServerCapabilities // announced on initialize
+	subscriptions   map[string]bool        // resource URIs, renewed with each session
 }
 
-// Initialize sets up the HTTP client and tests connectivity to target server
+// Initialize sets up the HTTP client and starts a session with the target
+// server, discovering its capabilities
 func (h *HTTPProxyClient) Initialize(ctx context.Context) error {
-	h.client = &http.Client{}
+	if h.client == nil {
+		h.client = &http.Client{}
+	}
+	h.mu.Lock()
+	h.sessionID, h.protocolVersion = "", ""
+	h.mu.Unlock()
 	log.Printf("Initializing proxy connection to %s", h.targetHost)
 
 	// Test connection with an initialize request
@@ -114,87 +140,36 @@ func (h *HTTPProxyClient) Initialize(ctx context.Context) error {
 	}
 
 	// Store the server capabilities for later use
+	h.mu.Lock()
 	h.capabilities = initResult.Capabilities
-	log.Printf("Discovered server capabilities: tools=%v, resources=%v, prompts=%v", 
-		h.capabilities.Tools != nil, h.capabilities.Resources != nil, h.capabilities.Prompts != nil)
-
-	log.Printf("Successfully initialized proxy to %s", h.targetHost)
-	return nil
-}
-
-// RegisterToolsOnServer discovers tools from target server and registers them
-func (h *HTTPProxyClient) RegisterToolsOnServer(ctx context.Context, mcpServer *server.MCPServer) error {
-	log.Printf("Discovering tools from %s", h.targetHost)
-
-	result, err := h.proxyRequest(ctx, "tools/list", mcp.PaginatedParams{})
-	if err != nil {
-		return fmt.Errorf("failed to list tools: %w", err)
-	}
-
-	var listResult mcp.ListToolsResult
-	if err := json.Unmarshal(result, &listResult); err != nil {
-		return fmt.Errorf("failed to unmarshal tools list: %w", err)
-	}
+	h.protocolVersion = initResult.ProtocolVersion
+	h.mu.Unlock()
 
-	for _, tool := range listResult.Tools {
-		toolName := tool.Name
-		mcpServer.AddTool(tool, h.createToolHandler(toolName))
-		log.Printf("Registered tool: %s", toolName)
+	// Complete the handshake so the target starts serving requests
+	if err := h.notify(ctx, "notifications/initialized", nil); err != nil {
+		return fmt.Errorf("failed to send initialized notification: %w", err)
 	}
+	h.resubscribe(ctx)
+	log.Printf("Discovered server capabilities: tools=%v, resources=%v, prompts=%v",
+		initResult.Capabilities.Tools != nil, initResult.Capabilities.Resources != nil, initResult.Capabilities.Prompts != nil)
 
+	log.Printf("Successfully initialized proxy to %s", h.targetHost)
 	return nil
 }
 
-// RegisterResourcesOnServer discovers resources from target server and registers them
-func (h *HTTPProxyClient) RegisterResourcesOnServer(ctx context.Context, mcpServer *server.MCPServer) error {
-	log.Printf("Discovering resources from %s", h.targetHost)
-
-	result, err := h.proxyRequest(ctx, "resources/list", mcp.PaginatedParams{})
-	if err != nil {
-		return fmt.Errorf("failed to list resources: %w", err)
-	}
-
-	var listResult mcp.ListResourcesResult
-	if err := json.Unmarshal(result, &listResult); err != nil {
-		return fmt.Errorf("failed to unmarshal resources list: %w", err)
-	}
-
-	for _, resource := range listResult.Resources {
-		resourceURI := resource.URI
-		mcpServer.AddResource(resource, h.createResourceHandler(resourceURI))
-		log.Printf("Registered resource: %s", resourceURI)
-	}
-
-	return nil
+// serverCapabilities returns the capabilities of the target's current session
+func (h *HTTPProxyClient) serverCapabilities() mcp.ServerCapabilities {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.capabilities
 }
 
-// RegisterPromptsOnServer discovers prompts from target server and registers them
-func (h *HTTPProxyClient) RegisterPromptsOnServer(ctx context.Context, mcpServer *server.MCPServer) error {
-	log.Printf("Discovering prompts from %s", h.targetHost)
-
-	result, err := h.proxyRequest(ctx, "prompts/list", mcp.PaginatedParams{})
-	if err != nil {
-		return fmt.Errorf("failed to list prompts: %w", err)
-	}
-
-	var listResult mcp.ListPromptsResult
-	if err := json.Unmarshal(result, &listResult); err != nil {
-		return fmt.Errorf("failed to unmarshal prompts list: %w", err)
-	}
-
-	for _, prompt := range listResult.Prompts {
-		promptName := prompt.Name
-		mcpServer.AddPrompt(prompt, h.createPromptHandler(promptName))
-		log.Printf("Registered prompt: %s", promptName)
-	}
-
-	return nil
-}
-
-// createToolHandler creates a handler that proxies tool calls
+// createToolHandler creates a handler that proxies calls of the target's tool
+// toolName, whatever name it is exposed under
 func (h *HTTPProxyClient) createToolHandler(toolName string) server.ToolHandlerFunc {
 	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 		log.Printf("Proxying call_tool request for tool '%s' to %s", toolName, h.targetHost)
+		request.Params.Name = toolName
 
 		result, err := h.proxyRequest(ctx, "tools/call", request.Params)
 		if err != nil {
@@ -214,127 +189,57 @@ func (h *HTTPProxyClient) createToolHandler(toolName string) server.ToolHandlerF
 func (h *HTTPProxyClient) createResourceHandler(resourceURI string) server.ResourceHandlerFunc {
 	return func(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
 		log.Printf("Proxying read_resource request for URI '%s' to %s", resourceURI, h.targetHost)
+		return h.readResource(ctx, request.Params)
+	}
+}
 
-		result, err := h.proxyRequest(ctx, "resources/read", request.Params)
-		if err != nil {
-			return nil, err
-		}
+// createResourceTemplateHandler creates a handler that proxies reads of the
+// resources matching the target's uriTemplate
+func (h *HTTPProxyClient) createResourceTemplateHandler(uriTemplate string) server.ResourceTemplateHandlerFunc {
+	return func(ctx context.Context, request mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+		log.Printf("Proxying read_resource request for URI '%s' (template '%s') to %s", request.Params.URI, uriTemplate, h.targetHost)
+		// the variables mcp-go matched are meant for local handlers; the
+		// target matches the URI itself
+		request.Params.Arguments = nil
+		return h.readResource(ctx, request.Params)
+	}
+}
 
-		var readResult mcp.ReadResourceResult
-		if err := json.Unmarshal(result, &readResult); err != nil {
-			return nil, fmt.Errorf("failed to unmarshal read_resource result: %w", err)
-		}
+// readResource reads a resource from the target server
+func (h *HTTPProxyClient) readResource(ctx context.Context, params mcp.ReadResourceParams) ([]mcp.ResourceContents, error) {
+	result, err := h.proxyRequest(ctx, "resources/read", params)
+	if err != nil {
+		return nil, err
+	}
 
-		return readResult.Contents, nil
+	// contents are an interface, which only mcp-go's parser can decode
+	raw := json.RawMessage(result)
+	readResult, err := mcp.ParseReadResourceResult(&raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal read_resource result: %w", err)
 	}
+
+	return readResult.Contents, nil
 }
 
-// createPromptHandler creates a handler that proxies prompt requests
+// createPromptHandler creates a handler that proxies requests for the
+// target's prompt promptName, whatever name it is exposed under
 func (h *HTTPProxyClient) createPromptHandler(promptName string) server.PromptHandlerFunc {
 	return func(ctx context.Context, request mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
 		log.Printf("Proxying get_prompt request for prompt '%s' to %s", promptName, h.targetHost)
+		request.Params.Name = promptName
 
 		result, err := h.proxyRequest(ctx, "prompts/get", request.Params)
 		if err != nil {
 			return nil, err
 		}
 
-		var getResult mcp.GetPromptResult
-		if err := json.Unmarshal(result, &getResult); err != nil {
+		raw := json.RawMessage(result)
+		getResult, err := mcp.ParseGetPromptResult(&raw)
+		if err != nil {
 			return nil, fmt.Errorf("failed to unmarshal get_prompt result: %w", err)
 		}
 
-		return &getResult, nil
-	}
-}
-
-// proxyRequest makes an HTTP request to the target MCP server
-func (h *HTTPProxyClient) proxyRequest(ctx context.Context, method string, params any) ([]byte, error) {
-	if h.client == nil {
-		return nil, fmt.Errorf("HTTP client not initialized")
-	}
-
-	// Create JSON-RPC request
-	requestBody := map[string]any{
-		"jsonrpc": "2.0",
-		"id":      1,
-		"method":  method,
-		"params":  params,
-	}
-
-	jsonData, err := json.Marshal(requestBody)
-	if err != nil {
-		return nil, fmt.Errorf("failed to marshal request: %w", err)
-	}
-
-	// Make HTTP request
-	httpReq, err := http.NewRequestWithContext(ctx, "POST", h.targetHost, bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
-	}
-
-	httpReq.Header.Set("Content-Type", "application/json")
-
-	resp, err := h.client.Do(httpReq)
-	if err != nil {
-		return nil, fmt.Errorf("failed to make HTTP request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
+		return getResult, nil
 	}
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTP request failed with status %d: %s", resp.StatusCode, string(body))
-	}
-
-	// Parse JSON-RPC response
-	var jsonRPCResp struct {
-		JSONRPC string          `json:"jsonrpc"`
-		ID      any             `json:"id"`
-		Result  json.RawMessage `json:"result,omitempty"`
-		Error   *struct {
-			Code    int    `json:"code"`
-			Message string `json:"message"`
-			Data    any    `json:"data,omitempty"`
-		} `json:"error,omitempty"`
-	}
-
-	if err := json.Unmarshal(body, &jsonRPCResp); err != nil {
-		return nil, fmt.Errorf("failed to unmarshal JSON-RPC response: %w", err)
-	}
-
-	if jsonRPCResp.Error != nil {
-		return nil, fmt.Errorf("JSON-RPC error %d: %s", jsonRPCResp.Error.Code, jsonRPCResp.Error.Message)
-	}
-
-	return jsonRPCResp.Result, nil
 }
-
-// CreateMCPServerWithCapabilities creates an MCP server with capabilities matching the origin server
-func (h *HTTPProxyClient) CreateMCPServerWithCapabilities() *server.MCPServer {
-	var options []server.ServerOption
-
-	// Add capabilities based on what the origin server supports
-	if h.capabilities.Tools != nil {
-		options = append(options, server.WithToolCapabilities(h.capabilities.Tools.ListChanged))
-	}
-
-	if h.capabilities.Resources != nil {
-		options = append(options, server.WithResourceCapabilities(
-			h.capabilities.Resources.Subscribe, h.capabilities.Resources.ListChanged))
-	}
-
-	if h.capabilities.Prompts != nil {
-		options = append(options, server.WithPromptCapabilities(h.capabilities.Prompts.ListChanged))
-	}
-
-	if h.capabilities.Logging != nil {
-		options = append(options, server.WithLogging())
-	}
-
-	return server.NewMCPServer("mcp-proxy", "1.0.0", options...)
-}
-
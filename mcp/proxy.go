@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// refreshTimeout bounds re-listing one kind of feature of an upstream.
+const refreshTimeout = 30 * time.Second
+
+// errFeatureTaken means an upstream lists a name or URI another upstream
+// already provides. Only the first is served; the proxy refuses to start with
+// such a collision, and one that appears later is logged.
+var errFeatureTaken = errors.New("already provided by another server")
+
+// Proxy merges the tools, resources and prompts of one or more target servers
+// into a single MCP server and routes each request to the target it came from.
+// The merged lists are kept up to date as targets report changes to theirs.
+type Proxy struct {
+	server       *server.MCPServer
+	upstreams    []*HTTPProxyClient
+	pollInterval time.Duration
+	maxPages     int // of each list to read from an upstream
+
+	mu        sync.Mutex
+	tools     map[string]owned // by exposed name
+	resources map[string]owned // by URI
+	templates map[string]owned // by URI template
+	prompts   map[string]owned // by exposed name
+
+	// refreshMu keeps refreshes from applying lists out of order
+	refreshMu sync.Mutex
+}
+
+// owned is a feature registered for an upstream, as it was registered.
+type owned struct {
+	upstream *HTTPProxyClient
+	def      any
+}
+
+// NewProxy creates a proxy whose MCP server has the capabilities that any of
+// the initialized upstreams support. Its lists can change when an upstream
+// reports changes or, with a pollInterval, when polling finds them. At most
+// maxPages pages of each list are read from an upstream.
+func NewProxy(upstreams []*HTTPProxyClient, pollInterval time.Duration, maxPages int) *Proxy {
+	var tools, resources, prompts, logging bool
+	var toolsChanged, subscribe, resourcesChanged, promptsChanged bool
+	for _, h := range upstreams {
+		capabilities := h.serverCapabilities()
+		if c := capabilities.Tools; c != nil {
+			tools, toolsChanged = true, toolsChanged || c.ListChanged
+		}
+		if c := capabilities.Resources; c != nil {
+			resources = true
+			subscribe, resourcesChanged = subscribe || c.Subscribe, resourcesChanged || c.ListChanged
+		}
+		if c := capabilities.Prompts; c != nil {
+			prompts, promptsChanged = true, promptsChanged || c.ListChanged
+		}
+		if capabilities.Logging != nil {
+			logging = true
+		}
+	}
+
+	if pollInterval > 0 {
+		toolsChanged, resourcesChanged, promptsChanged = true, true, true
+	}
+
+	var options []server.ServerOption
+	if tools {
+		options = append(options, server.WithToolCapabilities(toolsChanged))
+	}
+	if resources {
+		options = append(options, server.WithResourceCapabilities(subscribe, resourcesChanged))
+	}
+	if prompts {
+		options = append(options, server.WithPromptCapabilities(promptsChanged))
+	}
+	if logging {
+		options = append(options, server.WithLogging())
+	}
+
+	p := &Proxy{
+		server:       server.NewMCPServer("mcp-proxy", "1.0.0", options...),
+		upstreams:    upstreams,
+		pollInterval: pollInterval,
+		maxPages:     maxPages,
+		tools:        map[string]owned{},
+		resources:    map[string]owned{},
+		templates:    map[string]owned{},
+		prompts:      map[string]owned{},
+	}
+	for _, h := range upstreams {
+		h.onNotification = func(method string, params json.RawMessage) {
+			p.handleNotification(h, method, params)
+		}
+	}
+	return p
+}
+
+// Register discovers and registers the features each upstream supports. An
+// upstream that cannot be listed is logged and skipped, but features that
+// collide across upstreams are returned as an error.
+func (p *Proxy) Register(ctx context.Context) error {
+	var taken []error
+	register := func(h *HTTPProxyClient, kind string, register func(context.Context, *HTTPProxyClient) error) {
+		err := register(ctx, h)
+		if errors.Is(err, errFeatureTaken) {
+			taken = append(taken, fmt.Errorf("%s of %s: %w", kind, h.name, err))
+		} else if err != nil {
+			log.Printf("Warning: Failed to register %s of %s: %v", kind, h.name, err)
+		}
+	}
+	for _, h := range p.upstreams {
+		capabilities := h.serverCapabilities()
+		if capabilities.Tools != nil {
+			register(h, "tools", p.RegisterTools)
+		} else {
+			log.Printf("Origin server %s does not support tools - skipping tool discovery", h.name)
+		}
+
+		if capabilities.Resources != nil {
+			register(h, "resources", p.RegisterResources)
+		} else {
+			log.Printf("Origin server %s does not support resources - skipping resource discovery", h.name)
+		}
+
+		if capabilities.Prompts != nil {
+			register(h, "prompts", p.RegisterPrompts)
+		} else {
+			log.Printf("Origin server %s does not support prompts - skipping prompt discovery", h.name)
+		}
+	}
+	return errors.Join(taken...)
+}
+
+// update records the features h lists now, keyed by exposed name or URI, in
+// owners, and returns the keys that are new or changed and the keys h no
+// longer lists. Keys another upstream already owns are skipped and reported
+// as an errFeatureTaken error.
+func (p *Proxy) update(owners map[string]owned, h *HTTPProxyClient, listed map[string]any) (changed, removed []string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var taken []string
+	for key, def := range listed {
+		o, ok := owners[key]
+		if ok && o.upstream != h {
+			taken = append(taken, fmt.Sprintf("%s (by %s)", key, o.upstream.name))
+			continue
+		}
+		if ok && sameJSON(o.def, def) {
+			continue
+		}
+		owners[key] = owned{upstream: h, def: def}
+		changed = append(changed, key)
+	}
+	for key, o := range owners {
+		if _, ok := listed[key]; !ok && o.upstream == h {
+			delete(owners, key)
+			removed = append(removed, key)
+		}
+	}
+	sort.Strings(changed)
+	sort.Strings(removed)
+	if len(taken) > 0 {
+		sort.Strings(taken)
+		err = fmt.Errorf("%w: %s", errFeatureTaken, strings.Join(taken, ", "))
+	}
+	return changed, removed, err
+}
+
+// sameJSON reports whether a and b encode to the same JSON. Definitions are
+// compared this way since parsed URI templates carry caches.
+func sameJSON(a, b any) bool {
+	x, errX := json.Marshal(a)
+	y, errY := json.Marshal(b)
+	return errX == nil && errY == nil && bytes.Equal(x, y)
+}
+
+// RegisterTools discovers tools from the target server and brings the ones
+// registered under its prefix up to date
+func (p *Proxy) RegisterTools(ctx context.Context, h *HTTPProxyClient) error {
+	log.Printf("Discovering tools from %s", h.targetHost)
+
+	listed := map[string]any{}
+	err := h.listAll(ctx, "tools/list", p.maxPages, func(result []byte) (mcp.Cursor, error) {
+		var listResult mcp.ListToolsResult
+		if err := json.Unmarshal(result, &listResult); err != nil {
+			return "", fmt.Errorf("failed to unmarshal tools list: %w", err)
+		}
+		for _, tool := range listResult.Tools {
+			tool.Name = h.prefix + tool.Name
+			listed[tool.Name] = tool
+		}
+		return listResult.NextCursor, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list tools: %w", err)
+	}
+	changed, removed, taken := p.update(p.tools, h, listed)
+
+	var tools []server.ServerTool
+	for _, name := range changed {
+		toolName := strings.TrimPrefix(name, h.prefix)
+		tools = append(tools, server.ServerTool{Tool: listed[name].(mcp.Tool), Handler: h.createToolHandler(toolName)})
+		log.Printf("Registered tool: %s", name)
+	}
+	if len(tools) > 0 {
+		p.server.AddTools(tools...)
+	}
+	if len(removed) > 0 {
+		p.server.DeleteTools(removed...)
+		log.Printf("Removed tools: %s", strings.Join(removed, ", "))
+	}
+
+	return taken
+}
+
+// RegisterResources discovers resources and resource templates from the
+// target server and brings the ones registered for it up to date. URIs are
+// left as they are, so only the display name is prefixed, and a URI another
+// upstream provides already is not served for this one.
+func (p *Proxy) RegisterResources(ctx context.Context, h *HTTPProxyClient) error {
+	log.Printf("Discovering resources from %s", h.targetHost)
+
+	listed := map[string]any{}
+	err := h.listAll(ctx, "resources/list", p.maxPages, func(result []byte) (mcp.Cursor, error) {
+		var listResult mcp.ListResourcesResult
+		if err := json.Unmarshal(result, &listResult); err != nil {
+			return "", fmt.Errorf("failed to unmarshal resources list: %w", err)
+		}
+		for _, resource := range listResult.Resources {
+			resource.Name = h.prefix + resource.Name
+			listed[resource.URI] = resource
+		}
+		return listResult.NextCursor, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list resources: %w", err)
+	}
+	changed, removed, taken := p.update(p.resources, h, listed)
+
+	var resources []server.ServerResource
+	for _, uri := range changed {
+		resources = append(resources, server.ServerResource{Resource: listed[uri].(mcp.Resource), Handler: h.createResourceHandler(uri)})
+		log.Printf("Registered resource: %s", uri)
+	}
+	if len(resources) > 0 {
+		p.server.AddResources(resources...)
+	}
+	for _, uri := range removed {
+		p.server.RemoveResource(uri)
+		log.Printf("Removed resource: %s", uri)
+	}
+
+	// Not every server implements templates, so failing to list them is no
+	// reason to give up on its resources
+	if err := p.registerResourceTemplates(ctx, h); errors.Is(err, errFeatureTaken) {
+		return errors.Join(taken, fmt.Errorf("resource templates: %w", err))
+	} else if err != nil {
+		log.Printf("Warning: Failed to register resource templates of %s: %v", h.name, err)
+	}
+
+	return taken
+}
+
+// registerResourceTemplates discovers resource templates from the target
+// server and brings the ones registered for it up to date
+func (p *Proxy) registerResourceTemplates(ctx context.Context, h *HTTPProxyClient) error {
+	listed := map[string]any{}
+	err := h.listAll(ctx, "resources/templates/list", p.maxPages, func(result []byte) (mcp.Cursor, error) {
+		var listResult mcp.ListResourceTemplatesResult
+		if err := json.Unmarshal(result, &listResult); err != nil {
+			return "", fmt.Errorf("failed to unmarshal resource templates list: %w", err)
+		}
+		for _, template := range listResult.ResourceTemplates {
+			if template.URITemplate == nil {
+				continue
+			}
+			template.Name = h.prefix + template.Name
+			listed[template.URITemplate.Raw()] = template
+		}
+		return listResult.NextCursor, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list resource templates: %w", err)
+	}
+	changed, removed, taken := p.update(p.templates, h, listed)
+	if len(changed) == 0 && len(removed) == 0 {
+		return taken
+	}
+
+	// templates cannot be removed one by one, so all of them are set anew
+	p.mu.Lock()
+	var templates []server.ServerResourceTemplate
+	for uriTemplate, o := range p.templates {
+		templates = append(templates, server.ServerResourceTemplate{
+			Template: o.def.(mcp.ResourceTemplate),
+			Handler:  o.upstream.createResourceTemplateHandler(uriTemplate),
+		})
+	}
+	p.mu.Unlock()
+	p.server.SetResourceTemplates(templates...)
+
+	for _, uriTemplate := range changed {
+		log.Printf("Registered resource template: %s", uriTemplate)
+	}
+	if len(removed) > 0 {
+		log.Printf("Removed resource templates: %s", strings.Join(removed, ", "))
+	}
+	return taken
+}
+
+// resourceOwner returns the upstream that provides the resource at uri,
+// directly or through a template, or nil if none does.
+func (p *Proxy) resourceOwner(uri string) *HTTPProxyClient {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if o, ok := p.resources[uri]; ok {
+		return o.upstream
+	}
+	for _, o := range p.templates {
+		if o.def.(mcp.ResourceTemplate).URITemplate.Regexp().MatchString(uri) {
+			return o.upstream
+		}
+	}
+	return nil
+}
+
+// RegisterPrompts discovers prompts from the target server and brings the
+// ones registered under its prefix up to date
+func (p *Proxy) RegisterPrompts(ctx context.Context, h *HTTPProxyClient) error {
+	log.Printf("Discovering prompts from %s", h.targetHost)
+
+	listed := map[string]any{}
+	err := h.listAll(ctx, "prompts/list", p.maxPages, func(result []byte) (mcp.Cursor, error) {
+		var listResult mcp.ListPromptsResult
+		if err := json.Unmarshal(result, &listResult); err != nil {
+			return "", fmt.Errorf("failed to unmarshal prompts list: %w", err)
+		}
+		for _, prompt := range listResult.Prompts {
+			prompt.Name = h.prefix + prompt.Name
+			listed[prompt.Name] = prompt
+		}
+		return listResult.NextCursor, nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list prompts: %w", err)
+	}
+	changed, removed, taken := p.update(p.prompts, h, listed)
+
+	var prompts []server.ServerPrompt
+	for _, name := range changed {
+		promptName := strings.TrimPrefix(name, h.prefix)
+		prompts = append(prompts, server.ServerPrompt{Prompt: listed[name].(mcp.Prompt), Handler: h.createPromptHandler(promptName)})
+		log.Printf("Registered prompt: %s", name)
+	}
+	if len(prompts) > 0 {
+		p.server.AddPrompts(prompts...)
+	}
+	if len(removed) > 0 {
+		p.server.DeletePrompts(removed...)
+		log.Printf("Removed prompts: %s", strings.Join(removed, ", "))
+	}
+
+	return taken
+}
+
+// Watch keeps the registered features up to date until ctx is done: it
+// listens for the notifications of upstreams that send list_changed or
+// resource updates and, with a poll interval, refreshes every upstream's
+// lists on each tick.
+func (p *Proxy) Watch(ctx context.Context) {
+	for _, h := range p.upstreams {
+		c := h.serverCapabilities()
+		if (c.Tools != nil && c.Tools.ListChanged) || (c.Resources != nil && (c.Resources.ListChanged || c.Resources.Subscribe)) ||
+			(c.Prompts != nil && c.Prompts.ListChanged) {
+			go h.listen(ctx)
+		}
+	}
+	if p.pollInterval <= 0 {
+		return
+	}
+
+	// capabilities are read once, as re-initializing an upstream rewrites them
+	type poll struct {
+		upstream                  *HTTPProxyClient
+		tools, resources, prompts bool
+	}
+	var polls []poll
+	for _, h := range p.upstreams {
+		c := h.serverCapabilities()
+		polls = append(polls, poll{h, c.Tools != nil, c.Resources != nil, c.Prompts != nil})
+	}
+	go func() {
+		ticker := time.NewTicker(p.pollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			for _, poll := range polls {
+				if poll.tools {
+					p.refresh(ctx, poll.upstream, "tools", p.RegisterTools)
+				}
+				if poll.resources {
+					p.refresh(ctx, poll.upstream, "resources", p.RegisterResources)
+				}
+				if poll.prompts {
+					p.refresh(ctx, poll.upstream, "prompts", p.RegisterPrompts)
+				}
+			}
+		}
+	}()
+}
+
+// handleNotification acts on a notification from upstream h.
+func (p *Proxy) handleNotification(h *HTTPProxyClient, method string, params json.RawMessage) {
+	ctx := context.Background()
+	switch method {
+	case mcp.MethodNotificationToolsListChanged:
+		go p.refresh(ctx, h, "tools", p.RegisterTools)
+	case mcp.MethodNotificationResourcesListChanged:
+		go p.refresh(ctx, h, "resources", p.RegisterResources)
+	case mcp.MethodNotificationPromptsListChanged:
+		go p.refresh(ctx, h, "prompts", p.RegisterPrompts)
+	case mcp.MethodNotificationResourceUpdated:
+		var updated map[string]any
+		if err := json.Unmarshal(params, &updated); err != nil {
+			log.Printf("Ignoring malformed %s from %s: %v", method, h.targetHost, err)
+			return
+		}
+		p.server.SendNotificationToAllClients(method, updated)
+	default:
+		log.Printf("Ignoring %s from %s", method, h.targetHost)
+	}
+}
+
+// refresh re-registers one kind of feature of upstream h.
+func (p *Proxy) refresh(ctx context.Context, h *HTTPProxyClient, kind string, register func(context.Context, *HTTPProxyClient) error) {
+	ctx, cancel := context.WithTimeout(ctx, refreshTimeout)
+	defer cancel()
+	p.refreshMu.Lock()
+	defer p.refreshMu.Unlock()
+	if err := register(ctx, h); err != nil {
+		log.Printf("Warning: Failed to refresh %s of %s: %v", kind, h.name, err)
+	}
+}
+
+// Close ends the session with every target server.
+func (p *Proxy) Close(ctx context.Context) {
+	for _, h := range p.upstreams {
+		if err := h.Close(ctx); err != nil {
+			log.Printf("Warning: Failed to close session with %s: %v", h.targetHost, err)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// resourceTarget is a fake target listing resources at uris.
+func resourceTarget(uris ...string) *fakeTarget {
+	return &fakeTarget{
+		capabilities: mcp.ServerCapabilities{Resources: &struct {
+			Subscribe   bool `json:"subscribe,omitempty"`
+			ListChanged bool `json:"listChanged,omitempty"`
+		}{}},
+		result: func(method string, _ json.RawMessage) any {
+			if method != "resources/list" {
+				return struct{}{}
+			}
+			var result mcp.ListResourcesResult
+			for _, uri := range uris {
+				result.Resources = append(result.Resources, mcp.NewResource(uri, uri))
+			}
+			return result
+		},
+	}
+}
+
+func TestRegisterResourceCollisions(t *testing.T) {
+	tests := []struct {
+		name      string
+		first     []string
+		second    []string
+		wantTaken bool
+		wantOwner map[string]string
+	}{
+		{
+			name:      "distinct uris",
+			first:     []string{"file:///a"},
+			second:    []string{"file:///b"},
+			wantOwner: map[string]string{"file:///a": "first", "file:///b": "second"},
+		},
+		{
+			name:      "colliding uri",
+			first:     []string{"file:///a", "file:///shared"},
+			second:    []string{"file:///shared", "file:///b"},
+			wantTaken: true,
+			wantOwner: map[string]string{"file:///a": "first", "file:///shared": "first", "file:///b": "second"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			first := startFakeTarget(t, resourceTarget(tt.first...))
+			first.name = "first"
+			second := startFakeTarget(t, resourceTarget(tt.second...))
+			second.name = "second"
+			for _, h := range []*HTTPProxyClient{first, second} {
+				if err := h.Initialize(ctx); err != nil {
+					t.Fatalf("Initialize(%s) error = %v", h.name, err)
+				}
+			}
+
+			p := NewProxy([]*HTTPProxyClient{first, second}, 0, 10)
+			err := p.Register(ctx)
+			if got := errors.Is(err, errFeatureTaken); got != tt.wantTaken {
+				t.Errorf("Register() error = %v, want collision %v", err, tt.wantTaken)
+			}
+			for uri, want := range tt.wantOwner {
+				if h := p.resourceOwner(uri); h == nil || h.name != want {
+					t.Errorf("owner of %q = %v, want %s", uri, h, want)
+				}
+			}
+		})
+	}
+}
+
+func TestProxyUpdate(t *testing.T) {
+	a, b := &HTTPProxyClient{name: "a"}, &HTTPProxyClient{name: "b"}
+	p := &Proxy{}
+	owners := map[string]owned{}
+
+	changed, removed, err := p.update(owners, a, map[string]any{"echo": "v1", "sum": "v1"})
+	if err != nil || len(changed) != 2 || len(removed) != 0 {
+		t.Fatalf("first update() = %v, %v, %v, want both keys new", changed, removed, err)
+	}
+
+	// an unchanged definition is not reported again
+	changed, removed, err = p.update(owners, a, map[string]any{"echo": "v2", "sum": "v1", "time": "v1"})
+	if err != nil || !slices.Equal(changed, []string{"echo", "time"}) || len(removed) != 0 {
+		t.Errorf("update() = %v, %v, %v, want echo and time changed", changed, removed, err)
+	}
+
+	// b neither takes nor removes what a owns
+	changed, removed, err = p.update(owners, b, map[string]any{"sum": "other", "weather": "v1"})
+	if !errors.Is(err, errFeatureTaken) || !slices.Equal(changed, []string{"weather"}) || len(removed) != 0 {
+		t.Errorf("update() of b = %v, %v, %v, want weather added and sum taken", changed, removed, err)
+	}
+	if owners["sum"].upstream != a || owners["sum"].def != "v1" {
+		t.Errorf("sum = %+v, want a's definition kept", owners["sum"])
+	}
+
+	changed, removed, err = p.update(owners, a, map[string]any{"echo": "v2"})
+	if err != nil || len(changed) != 0 || !slices.Equal(removed, []string{"sum", "time"}) {
+		t.Errorf("update() = %v, %v, %v, want sum and time removed", changed, removed, err)
+	}
+	if _, ok := owners["weather"]; !ok {
+		t.Error("a's update removed b's weather")
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// ServeStdio runs the proxy's MCP server over stdin and stdout until stdin is
+// closed or a SIGINT or SIGTERM arrives. mcp-go does not implement resource
+// subscriptions, so subscribe and unsubscribe requests are taken off stdin
+// and answered here.
+func (p *Proxy) ServeStdio() error {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+
+	stdout := &syncWriter{w: os.Stdout}
+	stdin := p.interceptSubscriptions(ctx, os.Stdin, stdout)
+	return server.NewStdioServer(p.server).Listen(ctx, stdin, stdout)
+}
+
+// syncWriter serializes writes so messages written from several goroutines
+// do not interleave.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *syncWriter) Write(b []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(b)
+}
+
+// interceptSubscriptions reads the client's messages from in, answers
+// resources/subscribe and resources/unsubscribe requests on out, and returns
+// a reader of every other message.
+func (p *Proxy) interceptSubscriptions(ctx context.Context, in io.Reader, out io.Writer) io.Reader {
+	pr, pw := io.Pipe()
+	go func() {
+		reader := bufio.NewReader(in)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if len(line) > 0 {
+				var msg rpcMessage
+				if json.Unmarshal(line, &msg) == nil && msg.ID != nil &&
+					(msg.Method == "resources/subscribe" || msg.Method == "resources/unsubscribe") {
+					go p.answerSubscription(ctx, msg, out)
+				} else if _, err := pw.Write(line); err != nil {
+					return
+				}
+			}
+			if err == io.EOF {
+				pw.Close()
+				return
+			}
+			if err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+	}()
+	return pr
+}
+
+// answerSubscription forwards a subscribe or unsubscribe request to the
+// upstream that provides the resource and writes the reply to out.
+func (p *Proxy) answerSubscription(ctx context.Context, msg rpcMessage, out io.Writer) {
+	reply := rpcMessage{JSONRPC: mcp.JSONRPC_VERSION, ID: msg.ID}
+	fail := func(code int, message string) {
+		reply.Error = &struct {
+			Code    int    `json:"code"`
+			Message string `json:"message"`
+			Data    any    `json:"data,omitempty"`
+		}{Code: code, Message: message}
+	}
+
+	var params mcp.SubscribeParams
+	if err := json.Unmarshal(msg.Params, &params); err != nil || params.URI == "" {
+		fail(mcp.INVALID_PARAMS, "uri is required")
+	} else if h := p.resourceOwner(params.URI); h == nil {
+		fail(mcp.RESOURCE_NOT_FOUND, fmt.Sprintf("resource %s not found", params.URI))
+	} else if err := h.subscribe(ctx, msg.Method, params.URI); err != nil {
+		log.Printf("Warning: Failed to forward %s for %s to %s: %v", msg.Method, params.URI, h.targetHost, err)
+		fail(mcp.INTERNAL_ERROR, err.Error())
+	} else {
+		reply.Result = json.RawMessage("{}")
+	}
+
+	data, err := json.Marshal(reply)
+	if err != nil {
+		log.Printf("Warning: Failed to marshal %s response: %v", msg.Method, err)
+		return
+	}
+	if _, err := out.Write(append(data, '\n')); err != nil {
+		log.Printf("Warning: Failed to write %s response: %v", msg.Method, err)
+	}
+}
+
+// subscribe forwards resources/subscribe or resources/unsubscribe for uri to
+// the target server and remembers the subscription for later sessions.
+func (h *HTTPProxyClient) subscribe(ctx context.Context, method, uri string) error {
+	if c := h.serverCapabilities(); c.Resources == nil || !c.Resources.Subscribe {
+		return fmt.Errorf("%s does not support resource subscriptions", h.name)
+	}
+
+	if _, err := h.proxyRequest(ctx, method, mcp.SubscribeParams{URI: uri}); err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if method == "resources/unsubscribe" {
+		delete(h.subscriptions, uri)
+	} else {
+		if h.subscriptions == nil {
+			h.subscriptions = map[string]bool{}
+		}
+		h.subscriptions[uri] = true
+	}
+	return nil
+}
+
+// resubscribe renews the subscriptions of an earlier session, which the
+// target forgot along with it.
+func (h *HTTPProxyClient) resubscribe(ctx context.Context) {
+	h.mu.Lock()
+	var uris []string
+	for uri := range h.subscriptions {
+		uris = append(uris, uri)
+	}
+	h.mu.Unlock()
+
+	for _, uri := range uris {
+		if _, err := h.request(ctx, "resources/subscribe", mcp.SubscribeParams{URI: uri}); err != nil {
+			log.Printf("Warning: Failed to renew subscription to %s on %s: %v", uri, h.targetHost, err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// subscribableTarget lists one resource and one template and accepts
+// subscriptions to anything.
+func subscribableTarget() *fakeTarget {
+	return &fakeTarget{
+		capabilities: mcp.ServerCapabilities{Resources: &struct {
+			Subscribe   bool `json:"subscribe,omitempty"`
+			ListChanged bool `json:"listChanged,omitempty"`
+		}{Subscribe: true}},
+		result: func(method string, _ json.RawMessage) any {
+			switch method {
+			case "resources/list":
+				return mcp.ListResourcesResult{Resources: []mcp.Resource{mcp.NewResource("file:///readme", "readme")}}
+			case "resources/templates/list":
+				return mcp.ListResourceTemplatesResult{ResourceTemplates: []mcp.ResourceTemplate{
+					mcp.NewResourceTemplate("file:///logs/{name}", "logs"),
+				}}
+			}
+			return struct{}{}
+		},
+	}
+}
+
+func TestInterceptSubscriptions(t *testing.T) {
+	ctx := context.Background()
+	f := subscribableTarget()
+	h := startFakeTarget(t, f)
+	if err := h.Initialize(ctx); err != nil {
+		t.Fatalf("Initialize() error = %v", err)
+	}
+	p := NewProxy([]*HTTPProxyClient{h}, 0, 10)
+	if err := p.Register(ctx); err != nil {
+		t.Fatalf("Register() error = %v", err)
+	}
+
+	in := strings.Join([]string{
+		`{"jsonrpc":"2.0","id":1,"method":"resources/subscribe","params":{"uri":"file:///readme"}}`,
+		`{"jsonrpc":"2.0","id":2,"method":"ping"}`,
+		`{"jsonrpc":"2.0","id":3,"method":"resources/subscribe","params":{"uri":"file:///logs/today"}}`,
+		`{"jsonrpc":"2.0","id":4,"method":"resources/subscribe","params":{"uri":"file:///elsewhere"}}`,
+		`{"jsonrpc":"2.0","id":5,"method":"resources/unsubscribe","params":{}}`,
+	}, "\n") + "\n"
+	replies, out := io.Pipe()
+	passed, err := io.ReadAll(p.interceptSubscriptions(ctx, strings.NewReader(in), out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"jsonrpc":"2.0","id":2,"method":"ping"}` + "\n"; string(passed) != want {
+		t.Errorf("passed on %q, want only the ping", passed)
+	}
+
+	// replies come in whichever order the upstream answers
+	codes := map[string]int{}
+	scanner := bufio.NewScanner(replies)
+	for range 4 {
+		if !scanner.Scan() {
+			t.Fatalf("reply missing: %v", scanner.Err())
+		}
+		var reply rpcMessage
+		if err := json.Unmarshal(scanner.Bytes(), &reply); err != nil {
+			t.Fatal(err)
+		}
+		code := 0
+		if reply.Error != nil {
+			code = reply.Error.Code
+		}
+		codes[string(reply.ID)] = code
+	}
+	want := map[string]int{"1": 0, "3": 0, "4": mcp.RESOURCE_NOT_FOUND, "5": mcp.INVALID_PARAMS}
+	for id, code := range want {
+		if codes[id] != code {
+			t.Errorf("reply to %s has error code %d, want %d", id, codes[id], code)
+		}
+	}
+
+	// a new session renews both subscriptions
+	f.expire()
+	f.mu.Lock()
+	f.requests = nil
+	f.mu.Unlock()
+	if err := h.Initialize(ctx); err != nil {
+		t.Fatalf("Initialize() error = %v", err)
+	}
+	renewed := map[string]bool{}
+	for _, msg := range f.requests {
+		var params mcp.SubscribeParams
+		if msg.Method == "resources/subscribe" && json.Unmarshal(msg.Params, &params) == nil {
+			renewed[params.URI] = true
+		}
+	}
+	if len(renewed) != 2 || !renewed["file:///readme"] || !renewed["file:///logs/today"] {
+		t.Errorf("renewed subscriptions %v, want readme and today's log", renewed)
+	}
+}
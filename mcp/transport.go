@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// Headers of the MCP Streamable HTTP transport.
+const (
+	sessionIDHeader       = "Mcp-Session-Id"
+	protocolVersionHeader = "MCP-Protocol-Version"
+)
+
+// maxSSELineBytes caps a single line of an SSE response.
+const maxSSELineBytes = 10 << 20
+
+// Backoff between attempts to reopen a target's notification stream.
+const (
+	minStreamBackoff = time.Second
+	maxStreamBackoff = 30 * time.Second
+)
+
+// errSessionExpired means the target no longer knows the proxy's session.
+var errSessionExpired = errors.New("MCP session expired")
+
+// errNoStream means the target does not offer a stream of its own messages.
+var errNoStream = errors.New("target offers no notification stream")
+
+// rpcMessage is any JSON-RPC message: a request or notification (Method set)
+// or a response (Result or Error set).
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Data    any    `json:"data,omitempty"`
+	} `json:"error,omitempty"`
+}
+
+// proxyRequest sends a JSON-RPC request to the target MCP server and returns
+// its result. The target may answer with a JSON body or an SSE stream; messages
+// it sends on the stream before the response are handed to
+// handleServerMessage. A session the target has forgotten is re-initialized
+// once and the request retried.
+func (h *HTTPProxyClient) proxyRequest(ctx context.Context, method string, params any) ([]byte, error) {
+	result, err := h.request(ctx, method, params)
+	if errors.Is(err, errSessionExpired) && method != "initialize" {
+		if err := h.reinitialize(ctx); err != nil {
+			return nil, err
+		}
+		result, err = h.request(ctx, method, params)
+	}
+	return result, err
+}
+
+// reinitialize starts a new session after the current one expired. Requests
+// and the notification stream can all find the session expired at once; only
+// the first re-initializes, and the others wait for it and use its session.
+// expireSession clears the session id, so one that is set again belongs to a
+// session started since.
+func (h *HTTPProxyClient) reinitialize(ctx context.Context) error {
+	h.initMu.Lock()
+	defer h.initMu.Unlock()
+	h.mu.Lock()
+	renewed := h.sessionID != ""
+	h.mu.Unlock()
+	if renewed {
+		return nil
+	}
+	log.Printf("Session with %s expired, re-initializing", h.targetHost)
+	return h.Initialize(ctx)
+}
+
+func (h *HTTPProxyClient) request(ctx context.Context, method string, params any) ([]byte, error) {
+	id := strconv.FormatInt(h.nextID.Add(1), 10)
+	resp, err := h.post(ctx, map[string]any{
+		"jsonrpc": "2.0",
+		"id":      json.RawMessage(id),
+		"method":  method,
+		"params":  params,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if method == "initialize" {
+		h.mu.Lock()
+		h.sessionID = resp.Header.Get(sessionIDHeader)
+		h.mu.Unlock()
+	}
+
+	var reply *rpcMessage
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType == "text/event-stream" {
+		err = readSSE(resp.Body, func(data []byte) bool {
+			var msg rpcMessage
+			if err := json.Unmarshal(data, &msg); err != nil {
+				log.Printf("Ignoring malformed message from %s: %v", h.targetHost, err)
+				return false
+			}
+			if msg.Method == "" && string(msg.ID) == id {
+				reply = &msg
+				return true
+			}
+			h.handleServerMessage(msg)
+			return false
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to read SSE response: %w", err)
+		}
+		if reply == nil {
+			return nil, fmt.Errorf("SSE stream for %s ended without a response", method)
+		}
+	} else {
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read response body: %w", err)
+		}
+		reply = &rpcMessage{}
+		if err := json.Unmarshal(body, reply); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal JSON-RPC response: %w", err)
+		}
+	}
+
+	if reply.Error != nil {
+		return nil, fmt.Errorf("JSON-RPC error %d: %s", reply.Error.Code, reply.Error.Message)
+	}
+	return reply.Result, nil
+}
+
+// listAll requests the pages of a list method in turn, handing each result to
+// add, which returns the cursor of the next page. Targets with more than
+// maxPages pages are cut short, keeping the pages read so far.
+func (h *HTTPProxyClient) listAll(ctx context.Context, method string, maxPages int, add func(result []byte) (mcp.Cursor, error)) error {
+	var cursor mcp.Cursor
+	for page := 1; ; page++ {
+		result, err := h.proxyRequest(ctx, method, mcp.PaginatedParams{Cursor: cursor})
+		if err != nil {
+			return err
+		}
+		if cursor, err = add(result); err != nil {
+			return err
+		}
+		if cursor == "" {
+			return nil
+		}
+		if page == maxPages {
+			log.Printf("Warning: %s of %s has more than %d pages - ignoring the rest", method, h.targetHost, maxPages)
+			return nil
+		}
+	}
+}
+
+// notify sends a JSON-RPC notification, which the target acknowledges with
+// 202 Accepted.
+func (h *HTTPProxyClient) notify(ctx context.Context, method string, params any) error {
+	msg := map[string]any{"jsonrpc": "2.0", "method": method}
+	if params != nil {
+		msg["params"] = params
+	}
+	resp, err := h.post(ctx, msg)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// post sends one JSON-RPC message with the session headers and returns the
+// response if its status is a success.
+func (h *HTTPProxyClient) post(ctx context.Context, msg any) (*http.Response, error) {
+	if h.client == nil {
+		return nil, fmt.Errorf("HTTP client not initialized")
+	}
+	jsonData, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request: %w", err)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", h.targetHost, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("Accept", "application/json, text/event-stream")
+	sessionID := h.setSessionHeaders(httpReq)
+
+	resp, err := h.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to make HTTP request: %w", err)
+	}
+	if resp.StatusCode == http.StatusNotFound && sessionID != "" {
+		resp.Body.Close()
+		h.expireSession(sessionID)
+		return nil, errSessionExpired
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		return nil, fmt.Errorf("HTTP request failed with status %d: %s", resp.StatusCode, string(body))
+	}
+	return resp, nil
+}
+
+// setSessionHeaders adds the session id and negotiated protocol version, once
+// known, to req and returns the session id.
+func (h *HTTPProxyClient) setSessionHeaders(req *http.Request) string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sessionID != "" {
+		req.Header.Set(sessionIDHeader, h.sessionID)
+	}
+	if h.protocolVersion != "" {
+		req.Header.Set(protocolVersionHeader, h.protocolVersion)
+	}
+	return h.sessionID
+}
+
+// expireSession forgets sessionID, unless a new session replaced it already.
+func (h *HTTPProxyClient) expireSession(sessionID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sessionID == sessionID {
+		h.sessionID = ""
+	}
+}
+
+// handleServerMessage deals with a request or notification the target sent
+// on a response or notification stream. Notifications go to onNotification.
+func (h *HTTPProxyClient) handleServerMessage(msg rpcMessage) {
+	if msg.Method == "" {
+		return
+	}
+	if msg.ID == nil && h.onNotification != nil {
+		h.onNotification(msg.Method, msg.Params)
+		return
+	}
+	log.Printf("Ignoring %s from %s", msg.Method, h.targetHost)
+}
+
+// listen reads the stream of messages the target sends outside of any
+// request, reopening it whenever it drops, until ctx is done.
+func (h *HTTPProxyClient) listen(ctx context.Context) {
+	backoff := minStreamBackoff
+	for {
+		err := h.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		switch {
+		case errors.Is(err, errNoStream):
+			log.Printf("%s offers no notification stream", h.targetHost)
+			return
+		case errors.Is(err, errSessionExpired):
+			if err := h.reinitialize(ctx); err != nil {
+				log.Printf("Warning: Failed to re-initialize %s: %v", h.targetHost, err)
+				break
+			}
+			continue
+		case err != nil:
+			log.Printf("Warning: Notification stream from %s failed: %v", h.targetHost, err)
+		default:
+			backoff = minStreamBackoff
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxStreamBackoff)
+	}
+}
+
+// stream opens the target's notification stream with a GET and hands every
+// message on it to handleServerMessage until it ends.
+func (h *HTTPProxyClient) stream(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", h.targetHost, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	sessionID := h.setSessionHeaders(req)
+
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to make HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+	switch {
+	case resp.StatusCode == http.StatusMethodNotAllowed:
+		return errNoStream
+	case resp.StatusCode == http.StatusNotFound && sessionID != "":
+		h.expireSession(sessionID)
+		return errSessionExpired
+	case resp.StatusCode < 200 || resp.StatusCode >= 300:
+		return fmt.Errorf("HTTP request failed with status %d", resp.StatusCode)
+	}
+
+	return readSSE(resp.Body, func(data []byte) bool {
+		var msg rpcMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Printf("Ignoring malformed message from %s: %v", h.targetHost, err)
+			return false
+		}
+		h.handleServerMessage(msg)
+		return false
+	})
+}
+
+// Close ends the session with the target server, if it issued one. Servers
+// that do not let clients end sessions answer 405, which is fine.
+func (h *HTTPProxyClient) Close(ctx context.Context) error {
+	h.mu.Lock()
+	sessionID := h.sessionID
+	h.sessionID = ""
+	h.mu.Unlock()
+	if sessionID == "" || h.client == nil {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "DELETE", h.targetHost, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create HTTP request: %w", err)
+	}
+	req.Header.Set(sessionIDHeader, sessionID)
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to end session: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusMethodNotAllowed && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("ending session failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// readSSE calls handle with the data of each event in an SSE stream until
+// handle reports it is done or the stream ends.
+func readSSE(r io.Reader, handle func(data []byte) bool) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxSSELineBytes)
+	var event string
+	var data bytes.Buffer
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			if data.Len() > 0 && (event == "" || event == "message") && handle(data.Bytes()) {
+				return nil
+			}
+			event = ""
+			data.Reset()
+			continue
+		}
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+		switch field {
+		case "event":
+			event = value
+		case "data":
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if data.Len() > 0 && (event == "" || event == "message") {
+		handle(data.Bytes())
+	}
+	return nil
+}
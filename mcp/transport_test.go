@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// fakeTarget is a Streamable HTTP MCP server that issues a new session on
+// every initialize and answers other requests with result(method, params).
+type fakeTarget struct {
+	capabilities mcp.ServerCapabilities
+
+	mu          sync.Mutex
+	session     string
+	initializes int
+	requests    []rpcMessage
+	result      func(method string, params json.RawMessage) any
+}
+
+// startFakeTarget serves f and returns an uninitialized client for it.
+func startFakeTarget(t *testing.T, f *fakeTarget) *HTTPProxyClient {
+	t.Helper()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return &HTTPProxyClient{targetHost: srv.URL}
+}
+
+func (f *fakeTarget) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var msg rpcMessage
+	if err := json.NewDecoder(r.Body).Decode(&msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	f.mu.Lock()
+	var result any
+	switch {
+	case msg.Method == "initialize":
+		f.initializes++
+		f.session = fmt.Sprintf("session-%d", f.initializes)
+		w.Header().Set(sessionIDHeader, f.session)
+		result = mcp.InitializeResult{ProtocolVersion: mcp.LATEST_PROTOCOL_VERSION, Capabilities: f.capabilities}
+	case r.Header.Get(sessionIDHeader) != f.session:
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+		return
+	case msg.ID == nil:
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusAccepted)
+		return
+	default:
+		f.requests = append(f.requests, msg)
+		if f.result != nil {
+			result = f.result(msg.Method, msg.Params)
+		} else {
+			result = struct{}{}
+		}
+	}
+	f.mu.Unlock()
+
+	data, _ := json.Marshal(result)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rpcMessage{JSONRPC: mcp.JSONRPC_VERSION, ID: msg.ID, Result: data})
+}
+
+// expire makes the target forget its current session.
+func (f *fakeTarget) expire() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.session = ""
+}
+
+func TestProxyRequestReinitializesOnce(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests int
+	}{
+		{"single request", 1},
+		{"concurrent requests", 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeTarget{}
+			h := startFakeTarget(t, f)
+			ctx := context.Background()
+			if err := h.Initialize(ctx); err != nil {
+				t.Fatalf("Initialize() error = %v", err)
+			}
+			f.expire()
+
+			var wg sync.WaitGroup
+			errs := make(chan error, tt.requests)
+			for range tt.requests {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					_, err := h.proxyRequest(ctx, "ping", nil)
+					errs <- err
+				}()
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Errorf("proxyRequest() error = %v", err)
+				}
+			}
+			if f.initializes != 2 {
+				t.Errorf("target was initialized %d times, want 2", f.initializes)
+			}
+			if got := h.setSessionHeaders(httptest.NewRequest("GET", "/", nil)); got != "session-2" {
+				t.Errorf("session id = %q, want session-2", got)
+			}
+		})
+	}
+}
+
+// pagedTools answers tools/list with one tool per page and a cursor naming
+// the next page, for a target holding pages pages.
+func pagedTools(pages int) func(method string, params json.RawMessage) any {
+	return func(method string, params json.RawMessage) any {
+		var p mcp.PaginatedParams
+		_ = json.Unmarshal(params, &p)
+		page := 0
+		if p.Cursor != "" {
+			page, _ = strconv.Atoi(strings.TrimPrefix(string(p.Cursor), "page-"))
+		}
+		result := mcp.ListToolsResult{Tools: []mcp.Tool{{Name: fmt.Sprintf("tool-%d", page)}}}
+		if page+1 < pages {
+			result.NextCursor = mcp.Cursor(fmt.Sprintf("page-%d", page+1))
+		}
+		return result
+	}
+}
+
+func TestListAll(t *testing.T) {
+	tests := []struct {
+		name         string
+		pages        int
+		maxPages     int
+		failOn       string
+		wantTools    []string
+		wantRequests int
+		wantErr      bool
+	}{
+		{name: "single page", pages: 1, maxPages: 10, wantTools: []string{"tool-0"}, wantRequests: 1},
+		{name: "follows cursors", pages: 3, maxPages: 10,
+			wantTools: []string{"tool-0", "tool-1", "tool-2"}, wantRequests: 3},
+		{name: "last page at the cap", pages: 3, maxPages: 3,
+			wantTools: []string{"tool-0", "tool-1", "tool-2"}, wantRequests: 3},
+		{name: "stops at the cap", pages: 5, maxPages: 2, wantTools: []string{"tool-0", "tool-1"}, wantRequests: 2},
+		{name: "add error stops paging", pages: 3, maxPages: 10, failOn: "tool-1",
+			wantTools: []string{"tool-0"}, wantRequests: 2, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeTarget{result: pagedTools(tt.pages)}
+			h := startFakeTarget(t, f)
+			ctx := context.Background()
+			if err := h.Initialize(ctx); err != nil {
+				t.Fatalf("Initialize() error = %v", err)
+			}
+
+			var tools []string
+			err := h.listAll(ctx, "tools/list", tt.maxPages, func(result []byte) (mcp.Cursor, error) {
+				var list mcp.ListToolsResult
+				if err := json.Unmarshal(result, &list); err != nil {
+					return "", err
+				}
+				for _, tool := range list.Tools {
+					if tool.Name == tt.failOn {
+						return "", fmt.Errorf("bad tool %s", tool.Name)
+					}
+					tools = append(tools, tool.Name)
+				}
+				return list.NextCursor, nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("listAll() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(tools, tt.wantTools) {
+				t.Errorf("listAll() added %v, want %v", tools, tt.wantTools)
+			}
+			if len(f.requests) != tt.wantRequests {
+				t.Errorf("target got %d requests, want %d", len(f.requests), tt.wantRequests)
+			}
+		})
+	}
+}
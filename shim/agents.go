@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AgentProfile configures one agent persona served by the shim. Profiles are
+// loaded from AGENTS_DIR, one <name>.yaml, <name>.yml or <name>.json file per
+// agent, and selected with Request.Agent.
+type AgentProfile struct {
+	Name         string                    `yaml:"-"`
+	Description  string                    `yaml:"description"`
+	SystemPrompt string                    `yaml:"system_prompt"`
+	Model        string                    `yaml:"model"`
+	Tools        *toolLimit                `yaml:"tools"`
+	MCPServers   map[string]map[string]any `yaml:"mcp_servers"`
+	Env          map[string]string         `yaml:"env"`
+	Budget       agentBudget               `yaml:"budget"`
+}
+
+// agentBudget bounds a single run of an agent and, with a usage ledger, what
+// all of its runs together may spend.
+type agentBudget struct {
+	MaxTurns       int `yaml:"max_turns"`
+	TimeoutSeconds int `yaml:"timeout_seconds"`
+	costLimit      `yaml:",inline"`
+}
+
+// agentProfiles holds the profiles loaded at startup, keyed by name.
+var agentProfiles map[string]*AgentProfile
+
+// loadAgentProfiles reads every profile in AGENTS_DIR. JSON profiles are
+// parsed by the YAML decoder, which accepts them as-is.
+func loadAgentProfiles() (map[string]*AgentProfile, error) {
+	dir := os.Getenv("AGENTS_DIR")
+	if dir == "" {
+		return nil, nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read agents dir: %w", err)
+	}
+
+	profiles := map[string]*AgentProfile{}
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".yaml" && ext != ".yml" && ext != ".json") {
+			continue
+		}
+		name := strings.TrimSuffix(entry.Name(), ext)
+		if !promptIDPattern.MatchString(name) {
+			return nil, fmt.Errorf("agent profile %s: name may only contain letters, digits, '-' and '_'", entry.Name())
+		}
+		if _, ok := profiles[name]; ok {
+			return nil, fmt.Errorf("agent profile %s is defined more than once", name)
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read agent profile %s: %w", entry.Name(), err)
+		}
+		var p AgentProfile
+		if err := yaml.Unmarshal(data, &p); err != nil {
+			return nil, fmt.Errorf("failed to parse agent profile %s: %w", entry.Name(), err)
+		}
+		if p.Tools != nil {
+			if err := p.Tools.checkDeny(); err != nil {
+				return nil, fmt.Errorf("agent profile %s: %w", entry.Name(), err)
+			}
+		}
+		p.Name = name
+		profiles[name] = &p
+	}
+	return profiles, nil
+}
+
+// agentName is the agent r asks for, or the deployment's default agent.
+func (r Request) agentName() string {
+	if r.Agent != nil {
+		return *r.Agent
+	}
+	if name := os.Getenv("AGENT_NAME"); name != "" {
+		return name
+	}
+	return defaultAgent
+}
+
+// selectAgent resolves r's agent profile. Without profiles, or when the
+// default agent has none, the deployment's environment configures the run as
+// before; naming any other unknown agent is an error.
+func selectAgent(r *Request) error {
+	name := r.agentName()
+	if p, ok := agentProfiles[name]; ok {
+		r.profile = p
+		return nil
+	}
+	if r.Agent != nil && *r.Agent != os.Getenv("AGENT_NAME") && *r.Agent != defaultAgent {
+		return &codedError{Code: ErrBadRequest, Message: fmt.Sprintf("unknown agent %q", name)}
+	}
+	return nil
+}
+
+// mcpConfig merges the agent's MCP servers with the shim's own permission
+// server into the JSON accepted by --mcp-config, or "" if there are none.
+func mcpConfig(r Request) string {
+	servers := map[string]any{}
+	if r.profile != nil {
+		for name, server := range r.profile.MCPServers {
+			servers[name] = server
+		}
+	}
+	if server := permissionServerConfig(r); server != nil {
+		servers[permissionServerName] = server
+	}
+	if len(servers) == 0 {
+		return ""
+	}
+	config, _ := json.Marshal(map[string]any{"mcpServers": servers})
+	return string(config)
+}
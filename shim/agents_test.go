@@ -0,0 +1,130 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeProfiles(t *testing.T, files map[string]string) {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("AGENTS_DIR", dir)
+}
+
+func TestLoadAgentProfiles(t *testing.T) {
+	writeProfiles(t, map[string]string{
+		"gardener.yaml": "model: claude-sonnet-4\nbudget:\n  max_turns: 5\n  timeout_seconds: 60\n",
+		"pirate.json":   `{"system_prompt": "Arr.", "tools": {"tools": ["Read"]}}`,
+		"notes.txt":     "ignored",
+	})
+	profiles, err := loadAgentProfiles()
+	if err != nil {
+		t.Fatalf("loadAgentProfiles() error = %v", err)
+	}
+	if len(profiles) != 2 {
+		t.Fatalf("loaded %d profiles, want 2", len(profiles))
+	}
+	if p := profiles["gardener"]; p.Name != "gardener" || p.Budget.MaxTurns != 5 || p.Budget.TimeoutSeconds != 60 {
+		t.Errorf("gardener = %+v", p)
+	}
+	if p := profiles["pirate"]; p.SystemPrompt != "Arr." || p.Tools == nil {
+		t.Errorf("pirate = %+v", p)
+	}
+}
+
+func TestLoadAgentProfilesErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+	}{
+		{"duplicate name", map[string]string{"a.yaml": "", "a.json": "{}"}, "more than once"},
+		{"bad name", map[string]string{"a b.yaml": ""}, "name may only contain"},
+		{"bad yaml", map[string]string{"a.yaml": "budget: [1"}, "failed to parse"},
+		{"non-MCP deny glob", map[string]string{"a.yaml": "tools:\n  deny: [\"Bash*\"]\n"}, "agent profile a.yaml"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeProfiles(t, tt.files)
+			if _, err := loadAgentProfiles(); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadAgentProfiles() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSelectAgent(t *testing.T) {
+	agentProfiles = map[string]*AgentProfile{"gardener": {Name: "gardener"}}
+	t.Cleanup(func() { agentProfiles = nil })
+	t.Setenv("AGENT_NAME", "")
+
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		name        string
+		agent       *string
+		wantProfile string
+		wantErr     bool
+	}{
+		{"default without a profile", nil, "", false},
+		{"named profile", str("gardener"), "gardener", false},
+		{"unknown agent", str("pirate"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := Request{Agent: tt.agent}
+			err := selectAgent(&r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("selectAgent() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var got string
+			if r.profile != nil {
+				got = r.profile.Name
+			}
+			if got != tt.wantProfile {
+				t.Errorf("profile = %q, want %q", got, tt.wantProfile)
+			}
+		})
+	}
+
+	// AGENT_NAME picks the profile for requests that name no agent
+	t.Setenv("AGENT_NAME", "gardener")
+	r := Request{}
+	if err := selectAgent(&r); err != nil || r.profile == nil {
+		t.Errorf("selectAgent() with AGENT_NAME = %v, %v", r.profile, err)
+	}
+}
+
+func TestApplyOverridesProfileBudget(t *testing.T) {
+	profile := &AgentProfile{Budget: agentBudget{MaxTurns: 5, TimeoutSeconds: 60}}
+	n := func(n int) *int { return &n }
+	tests := []struct {
+		name    string
+		req     Request
+		wantErr bool
+	}{
+		{"within budget", Request{MaxTurns: n(5), TimeoutSeconds: n(60)}, false},
+		{"turns above budget", Request{MaxTurns: n(6)}, true},
+		{"timeout above budget", Request{TimeoutSeconds: n(61)}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.req
+			r.profile = profile
+			err := applyOverrides(&r)
+			var coded *codedError
+			if tt.wantErr && (!errors.As(err, &coded) || coded.Code != ErrForbidden) {
+				t.Errorf("applyOverrides() error = %v, want %s", err, ErrForbidden)
+			} else if !tt.wantErr && err != nil {
+				t.Errorf("applyOverrides() error = %v", err)
+			}
+		})
+	}
+}
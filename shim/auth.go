@@ -0,0 +1,277 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSignatureSkew is how far an HMAC-signed request's timestamp may be from
+// the shim's clock before it is rejected as a possible replay.
+const maxSignatureSkew = 5 * time.Minute
+
+// errNoCredentials is returned by an Authenticator when the request carries
+// none of the credentials it understands, so the next one can be tried.
+var errNoCredentials = errors.New("no credentials")
+
+// Identity is a verified caller. It replaces any client-supplied Request.User.
+type Identity struct {
+	User   string   `json:"user"`
+	Tenant string   `json:"tenant,omitempty"`
+	Roles  []string `json:"roles,omitempty"`
+	Method string   `json:"auth_method"`
+	// KeyID names the API or signing key used, for per-key rate limits.
+	KeyID string `json:"-"`
+}
+
+// authRequest is the part of a request its credentials are checked against.
+type authRequest struct {
+	Method  string
+	Path    string
+	Query   url.Values
+	Headers http.Header
+	Body    []byte
+}
+
+// newAuthRequest describes an HTTP request whose body has been read.
+func newAuthRequest(r *http.Request, body []byte) authRequest {
+	return authRequest{Method: r.Method, Path: r.URL.Path, Query: r.URL.Query(), Headers: r.Header, Body: body}
+}
+
+// Authenticator verifies the credentials presented with a request.
+type Authenticator interface {
+	Authenticate(r authRequest) (*Identity, error)
+}
+
+// authChain tries each authenticator in turn until one recognizes the
+// request's credentials.
+type authChain []Authenticator
+
+func (c authChain) Authenticate(r authRequest) (*Identity, error) {
+	for _, a := range c {
+		id, err := a.Authenticate(r)
+		if errors.Is(err, errNoCredentials) {
+			continue
+		}
+		return id, err
+	}
+	return nil, errors.New("missing credentials")
+}
+
+// authenticator is the configured authenticator, or nil if authentication
+// is disabled.
+var authenticator Authenticator
+
+// loadAuthenticator builds the authenticator chain from the AUTH_* environment
+// variables. It returns nil if none are set.
+func loadAuthenticator() (Authenticator, error) {
+	var chain authChain
+	if path := os.Getenv("AUTH_API_KEYS_FILE"); path != "" {
+		a, err := loadAPIKeyAuth(path)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, a)
+	}
+	if path := os.Getenv("AUTH_HMAC_KEYS_FILE"); path != "" {
+		a, err := loadHMACAuth(path)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, a)
+	}
+	if path := os.Getenv("AUTH_JWKS_FILE"); path != "" {
+		a, err := loadJWTAuth(path, os.Getenv("AUTH_JWT_ISSUER"), os.Getenv("AUTH_JWT_AUDIENCE"))
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, a)
+	}
+	if len(chain) == 0 {
+		return nil, nil
+	}
+	return chain, nil
+}
+
+// authenticateRequest verifies the caller and decodes body into a Request
+// whose User is the verified identity. With authentication disabled the
+// client-supplied User is kept as is.
+func authenticateRequest(r authRequest) (Request, error) {
+	id, err := authenticateCaller(r)
+	if err != nil {
+		return Request{}, err
+	}
+
+	var req Request
+	if err := json.Unmarshal(r.Body, &req); err != nil {
+		return Request{}, &codedError{Code: ErrBadRequest, Message: fmt.Sprintf("invalid json: %v", err)}
+	}
+	if id != nil {
+		user, err := json.Marshal(id)
+		if err != nil {
+			return Request{}, err
+		}
+		req.User = user
+		req.identity = id
+	}
+	return req, nil
+}
+
+// authenticateCaller verifies the caller's credentials. It returns a nil
+// identity when authentication is disabled.
+func authenticateCaller(r authRequest) (*Identity, error) {
+	if authenticator == nil {
+		return nil, nil
+	}
+	id, err := authenticator.Authenticate(r)
+	if err != nil {
+		return nil, &codedError{Code: ErrUnauthorized, Message: err.Error()}
+	}
+	return id, nil
+}
+
+// keyEntry is one entry of an API key or HMAC key file.
+type keyEntry struct {
+	KeyID  string   `json:"key_id"`
+	SHA256 string   `json:"sha256"`
+	Secret string   `json:"secret"`
+	User   string   `json:"user"`
+	Tenant string   `json:"tenant"`
+	Roles  []string `json:"roles"`
+}
+
+func (e keyEntry) identity(method string) *Identity {
+	return &Identity{User: e.User, Tenant: e.Tenant, Roles: e.Roles, Method: method, KeyID: e.KeyID}
+}
+
+func loadKeyFile(path string) ([]keyEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file: %w", err)
+	}
+	var entries []keyEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse key file %s: %w", path, err)
+	}
+	for _, e := range entries {
+		if e.User == "" {
+			return nil, fmt.Errorf("key file %s: every entry needs a user", path)
+		}
+	}
+	return entries, nil
+}
+
+// apiKeyAuth accepts an X-API-Key header whose SHA-256 matches a key file
+// entry, so the file never holds usable keys.
+type apiKeyAuth map[string]keyEntry
+
+func loadAPIKeyAuth(path string) (apiKeyAuth, error) {
+	entries, err := loadKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := apiKeyAuth{}
+	for _, e := range entries {
+		if _, err := hex.DecodeString(e.SHA256); err != nil || len(e.SHA256) != sha256.Size*2 {
+			return nil, fmt.Errorf("key file %s: invalid sha256 for user %s", path, e.User)
+		}
+		keys[strings.ToLower(e.SHA256)] = e
+	}
+	return keys, nil
+}
+
+func (a apiKeyAuth) Authenticate(r authRequest) (*Identity, error) {
+	key := r.Headers.Get("X-API-Key")
+	if key == "" {
+		return nil, errNoCredentials
+	}
+	sum := sha256.Sum256([]byte(key))
+	e, ok := a[hex.EncodeToString(sum[:])]
+	if !ok {
+		return nil, errors.New("invalid api key")
+	}
+	id := e.identity("api_key")
+	if id.KeyID == "" {
+		// the hash is no secret and stays stable while the key does
+		id.KeyID = "sha256:" + e.SHA256[:12]
+	}
+	return id, nil
+}
+
+// hmacAuth accepts requests signed with a shared secret:
+//
+//	X-Key-Id:    key_id from the key file
+//	X-Timestamp: unix seconds
+//	X-Signature: hex HMAC-SHA256 of the string signHMAC describes
+type hmacAuth map[string]keyEntry
+
+func loadHMACAuth(path string) (hmacAuth, error) {
+	entries, err := loadKeyFile(path)
+	if err != nil {
+		return nil, err
+	}
+	keys := hmacAuth{}
+	for _, e := range entries {
+		if e.KeyID == "" || e.Secret == "" {
+			return nil, fmt.Errorf("key file %s: entry for user %s needs key_id and secret", path, e.User)
+		}
+		keys[e.KeyID] = e
+	}
+	return keys, nil
+}
+
+func (a hmacAuth) Authenticate(r authRequest) (*Identity, error) {
+	keyID, sig := r.Headers.Get("X-Key-Id"), r.Headers.Get("X-Signature")
+	if keyID == "" || sig == "" {
+		return nil, errNoCredentials
+	}
+	e, ok := a[keyID]
+	if !ok {
+		return nil, errors.New("unknown signing key")
+	}
+	ts := r.Headers.Get("X-Timestamp")
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid X-Timestamp")
+	}
+	if skew := time.Since(time.Unix(secs, 0)); skew > maxSignatureSkew || skew < -maxSignatureSkew {
+		return nil, errors.New("signature timestamp outside allowed window")
+	}
+	want := signHMAC([]byte(e.Secret), ts, r.Method, r.Path, r.Query, r.Body)
+	if !hmac.Equal([]byte(want), []byte(strings.ToLower(sig))) {
+		return nil, errors.New("invalid signature")
+	}
+	return e.identity("hmac"), nil
+}
+
+// signHMAC returns the hex HMAC-SHA256 of the timestamp, method, path and
+// query, each followed by a newline, and the body. The path is the one the
+// client sent, stage prefix included, and the query is sorted by key and
+// URL-encoded with every value of a repeated key, so a signature holds for
+// exactly one call.
+func signHMAC(secret []byte, timestamp, method, path string, query url.Values, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	for _, part := range []string{timestamp, method, path, query.Encode()} {
+		mac.Write([]byte(part))
+		mac.Write([]byte("\n"))
+	}
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signRequest signs an outgoing webhook request like an HMAC-authenticated
+// shim request, setting X-Timestamp and X-Signature.
+func signRequest(req *http.Request, secret string, body []byte) {
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("X-Timestamp", ts)
+	req.Header.Set("X-Signature", signHMAC([]byte(secret), ts, req.Method, req.URL.Path, req.URL.Query(), body))
+}
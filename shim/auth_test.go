@@ -0,0 +1,310 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIKeyAuth(t *testing.T) {
+	sum := sha256.Sum256([]byte("s3cret-key"))
+	hash := hex.EncodeToString(sum[:])
+	a := apiKeyAuth{hash: {SHA256: hash, User: "alice", Tenant: "acme"}}
+
+	tests := []struct {
+		name      string
+		key       string
+		wantUser  string
+		wantErr   string
+		noCreds   bool
+		wantKeyID string
+	}{
+		{name: "valid key", key: "s3cret-key", wantUser: "alice", wantKeyID: "sha256:" + hash[:12]},
+		{name: "wrong key", key: "s3cret-kez", wantErr: "invalid api key"},
+		{name: "missing key", noCreds: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{}
+			if tt.key != "" {
+				headers.Set("X-API-Key", tt.key)
+			}
+			id, err := a.Authenticate(authRequest{Method: "POST", Path: "/", Headers: headers})
+			checkAuthResult(t, id, err, tt.wantUser, tt.wantErr, tt.noCreds)
+			if id != nil && id.KeyID != tt.wantKeyID {
+				t.Errorf("KeyID = %q, want %q", id.KeyID, tt.wantKeyID)
+			}
+		})
+	}
+}
+
+func TestHMACAuth(t *testing.T) {
+	const secret = "shared-secret"
+	a := hmacAuth{"k1": {KeyID: "k1", Secret: secret, User: "svc", Roles: []string{"ops"}}}
+	signed := authRequest{
+		Method: "POST",
+		Path:   "/sessions/abc",
+		Query:  url.Values{"limit": {"10"}, "cursor": {"x"}},
+		Body:   []byte(`{"prompt":"hi"}`),
+	}
+
+	tests := []struct {
+		name     string
+		keyID    string
+		skew     time.Duration
+		tamper   func(r *authRequest)
+		sig      string
+		wantUser string
+		wantErr  string
+		noCreds  bool
+	}{
+		{name: "valid signature", keyID: "k1", wantUser: "svc"},
+		{name: "query reordered", keyID: "k1", wantUser: "svc", tamper: func(r *authRequest) {
+			r.Query = url.Values{"cursor": {"x"}, "limit": {"10"}}
+		}},
+		{name: "uppercase signature", keyID: "k1", wantUser: "svc", sig: "upper"},
+		{name: "small clock skew", keyID: "k1", skew: -maxSignatureSkew + time.Minute, wantUser: "svc"},
+		{name: "different method", keyID: "k1", wantErr: "invalid signature", tamper: func(r *authRequest) {
+			r.Method = "DELETE"
+		}},
+		{name: "different path", keyID: "k1", wantErr: "invalid signature", tamper: func(r *authRequest) {
+			r.Path = "/sessions/def"
+		}},
+		{name: "different query", keyID: "k1", wantErr: "invalid signature", tamper: func(r *authRequest) {
+			r.Query = url.Values{"limit": {"1000"}, "cursor": {"x"}}
+		}},
+		{name: "different body", keyID: "k1", wantErr: "invalid signature", tamper: func(r *authRequest) {
+			r.Body = []byte(`{"prompt":"bye"}`)
+		}},
+		{name: "stale timestamp", keyID: "k1", skew: -maxSignatureSkew - time.Minute, wantErr: "outside allowed window"},
+		{name: "future timestamp", keyID: "k1", skew: maxSignatureSkew + time.Minute, wantErr: "outside allowed window"},
+		{name: "unknown key", keyID: "k2", wantErr: "unknown signing key"},
+		{name: "garbage signature", keyID: "k1", sig: "00", wantErr: "invalid signature"},
+		{name: "missing signature", keyID: "k1", sig: "none", noCreds: true},
+		{name: "missing key id", noCreds: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := signed
+			ts := strconv.FormatInt(time.Now().Add(tt.skew).Unix(), 10)
+			sig := signHMAC([]byte(secret), ts, r.Method, r.Path, r.Query, r.Body)
+			switch tt.sig {
+			case "upper":
+				sig = strings.ToUpper(sig)
+			case "none":
+				sig = ""
+			case "":
+			default:
+				sig = tt.sig
+			}
+			if tt.tamper != nil {
+				tt.tamper(&r)
+			}
+			r.Headers = http.Header{}
+			if tt.keyID != "" {
+				r.Headers.Set("X-Key-Id", tt.keyID)
+			}
+			r.Headers.Set("X-Timestamp", ts)
+			if sig != "" {
+				r.Headers.Set("X-Signature", sig)
+			}
+			id, err := a.Authenticate(r)
+			checkAuthResult(t, id, err, tt.wantUser, tt.wantErr, tt.noCreds)
+		})
+	}
+}
+
+// A client signs the URL it called. Behind API Gateway that includes the stage,
+// which a REST API event leaves out of its path, and repeated query names,
+// which queryStringParameters collapses.
+func TestLambdaEventSignature(t *testing.T) {
+	const secret = "shared-secret"
+	a := hmacAuth{"k1": {KeyID: "k1", Secret: secret, User: "svc"}}
+	body := `{"prompt":"hi"}`
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	sig := signHMAC([]byte(secret), ts, "POST", "/prod/v1/run", url.Values{"a": {"1", "2"}}, []byte(body))
+	headers := map[string]string{"X-Key-Id": "k1", "X-Timestamp": ts, "X-Signature": sig}
+
+	events := map[string]httpEvent{
+		"rest api": {
+			HTTPMethod:      "POST",
+			Path:            "/v1/run",
+			MultiValueQuery: map[string][]string{"a": {"1", "2"}},
+			RequestContext:  json.RawMessage(`{"stage":"prod","path":"/prod/v1/run"}`),
+		},
+		"http api": {
+			RawPath:        "/prod/v1/run",
+			RawQuery:       "a=1&a=2",
+			RequestContext: json.RawMessage(`{"stage":"prod","http":{"method":"POST"}}`),
+		},
+	}
+	for name, ev := range events {
+		ev.Headers, ev.Body = headers, body
+		if _, err := a.Authenticate(ev.authRequest([]byte(body))); err != nil {
+			t.Errorf("%s: Authenticate() error = %v", name, err)
+		}
+
+		// the same call with one of the repeated values dropped is another call
+		r := ev.authRequest([]byte(body))
+		r.Query = url.Values{"a": {"2"}}
+		if _, err := a.Authenticate(r); err == nil {
+			t.Errorf("%s: Authenticate() accepted a signature for a different query", name)
+		}
+	}
+}
+
+func TestJWTAuth(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &jwtAuth{keys: map[string]crypto.PublicKey{"k1": &key.PublicKey}, issuer: "https://issuer", audience: "shim"}
+	now := time.Now().Unix()
+	valid := map[string]any{"sub": "alice", "iss": "https://issuer", "aud": []string{"shim"}, "exp": now + 60, "tenant": "acme"}
+
+	tests := []struct {
+		name     string
+		header   map[string]any
+		claims   func(c map[string]any)
+		token    string
+		wantUser string
+		wantErr  string
+		noCreds  bool
+	}{
+		{name: "valid token", wantUser: "alice"},
+		{name: "string audience", wantUser: "alice", claims: func(c map[string]any) { c["aud"] = "shim" }},
+		{name: "expired", wantErr: "token expired", claims: func(c map[string]any) { c["exp"] = now - 3600 }},
+		{name: "no exp", wantErr: "no exp claim", claims: func(c map[string]any) { delete(c, "exp") }},
+		{name: "not yet valid", wantErr: "not yet valid", claims: func(c map[string]any) { c["nbf"] = now + 3600 }},
+		{name: "wrong issuer", wantErr: "issuer not accepted", claims: func(c map[string]any) { c["iss"] = "https://other" }},
+		{name: "wrong audience", wantErr: "audience not accepted", claims: func(c map[string]any) { c["aud"] = "other" }},
+		{name: "no sub", wantErr: "no sub claim", claims: func(c map[string]any) { delete(c, "sub") }},
+		{name: "unknown kid", wantErr: "unknown signing key", header: map[string]any{"alg": "ES256", "kid": "k2"}},
+		{name: "alg none", wantErr: "unsupported alg", header: map[string]any{"alg": "none", "kid": "k1"}},
+		{name: "alg HS256", wantErr: "does not match EC key", header: map[string]any{"alg": "HS256", "kid": "k1"}},
+		{name: "tampered claims", wantErr: "invalid token signature", token: "tamper"},
+		{name: "malformed", wantErr: "malformed token", token: "a.b"},
+		{name: "no bearer token", noCreds: true, token: "none"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := tt.header
+			if header == nil {
+				header = map[string]any{"alg": "ES256", "kid": "k1"}
+			}
+			claims := maps.Clone(valid)
+			if tt.claims != nil {
+				tt.claims(claims)
+			}
+			token := signES256(t, key, header, claims)
+			switch tt.token {
+			case "tamper":
+				parts := strings.Split(token, ".")
+				claims["sub"] = "mallory"
+				parts[1] = encodeSegment(t, claims)
+				token = strings.Join(parts, ".")
+			case "none":
+				token = ""
+			case "":
+			default:
+				token = tt.token
+			}
+			headers := http.Header{}
+			if token != "" {
+				headers.Set("Authorization", "Bearer "+token)
+			}
+			id, err := a.Authenticate(authRequest{Method: "POST", Path: "/", Headers: headers})
+			checkAuthResult(t, id, err, tt.wantUser, tt.wantErr, tt.noCreds)
+		})
+	}
+}
+
+func TestAuthChain(t *testing.T) {
+	sum := sha256.Sum256([]byte("s3cret-key"))
+	hash := hex.EncodeToString(sum[:])
+	chain := authChain{
+		hmacAuth{"k1": {KeyID: "k1", Secret: "shared-secret", User: "svc"}},
+		apiKeyAuth{hash: {SHA256: hash, User: "alice"}},
+	}
+
+	tests := []struct {
+		name     string
+		headers  map[string]string
+		wantUser string
+		wantErr  string
+	}{
+		{name: "falls through to api key", headers: map[string]string{"X-API-Key": "s3cret-key"}, wantUser: "alice"},
+		{name: "stops at a failed signature", headers: map[string]string{
+			"X-Key-Id": "k1", "X-Signature": "00", "X-Timestamp": "0", "X-API-Key": "s3cret-key",
+		}, wantErr: "outside allowed window"},
+		{name: "invalid api key", headers: map[string]string{"X-API-Key": "nope"}, wantErr: "invalid api key"},
+		{name: "no credentials", wantErr: "missing credentials"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			headers := http.Header{}
+			for k, v := range tt.headers {
+				headers.Set(k, v)
+			}
+			id, err := chain.Authenticate(authRequest{Method: "POST", Path: "/", Headers: headers})
+			checkAuthResult(t, id, err, tt.wantUser, tt.wantErr, false)
+		})
+	}
+}
+
+// checkAuthResult compares an Authenticate result with the wanted user, error
+// substring, or errNoCredentials.
+func checkAuthResult(t *testing.T, id *Identity, err error, wantUser, wantErr string, noCreds bool) {
+	t.Helper()
+	switch {
+	case noCreds:
+		if !errors.Is(err, errNoCredentials) {
+			t.Errorf("Authenticate() error = %v, want errNoCredentials", err)
+		}
+	case wantErr != "":
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("Authenticate() error = %v, want %q", err, wantErr)
+		}
+	case err != nil:
+		t.Errorf("Authenticate() error = %v", err)
+	case id == nil || id.User != wantUser:
+		t.Errorf("Authenticate() = %+v, want user %q", id, wantUser)
+	}
+}
+
+// signES256 returns a compact JWT over header and claims signed with key.
+func signES256(t *testing.T, key *ecdsa.PrivateKey, header, claims map[string]any) string {
+	t.Helper()
+	signed := encodeSegment(t, header) + "." + encodeSegment(t, claims)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func encodeSegment(t *testing.T, v any) string {
+	t.Helper()
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
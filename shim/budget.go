@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// costLimit caps spending in US dollars per UTC day and per calendar month.
+// Zero means no cap.
+type costLimit struct {
+	DailyUSD   float64 `yaml:"daily_usd"`
+	MonthlyUSD float64 `yaml:"monthly_usd"`
+}
+
+// tighter combines two limits, keeping the lower of each cap that is set.
+func (l costLimit) tighter(o costLimit) costLimit {
+	pick := func(a, b float64) float64 {
+		if a == 0 || (b != 0 && b < a) {
+			return b
+		}
+		return a
+	}
+	return costLimit{DailyUSD: pick(l.DailyUSD, o.DailyUSD), MonthlyUSD: pick(l.MonthlyUSD, o.MonthlyUSD)}
+}
+
+// BudgetPolicy is the operator's spending caps. A request must be within the
+// caps of its user (their entry, else the default entry), of its tenant and
+// of its agent, whose profile budget applies as well. Spending is what the
+// usage ledger has recorded from the CLI's reported cost.
+type BudgetPolicy struct {
+	Users   map[string]costLimit `yaml:"users"`
+	Tenants map[string]costLimit `yaml:"tenants"`
+	Agents  map[string]costLimit `yaml:"agents"`
+	Default *costLimit           `yaml:"default"`
+}
+
+// budgetPolicy is the policy loaded from BUDGETS_FILE, or nil if unset.
+var budgetPolicy *BudgetPolicy
+
+// loadBudgetPolicy reads the YAML policy named by BUDGETS_FILE. Budgets are
+// enforced from the ledger, so one must be configured.
+func loadBudgetPolicy() (*BudgetPolicy, error) {
+	file := os.Getenv("BUDGETS_FILE")
+	if file == "" {
+		return nil, nil
+	}
+	if usageLedger == nil {
+		return nil, errors.New("BUDGETS_FILE requires USAGE_LEDGER")
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read budgets: %w", err)
+	}
+	var p BudgetPolicy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse budgets %s: %w", file, err)
+	}
+	return &p, nil
+}
+
+// budgetScope is one set of runs whose spending is capped together.
+type budgetScope struct {
+	kind   string // user, tenant or agent
+	name   string
+	filter usageFilter
+	limit  costLimit
+}
+
+// budgetScopes returns the capped scopes r's cost counts towards.
+func budgetScopes(r Request) []budgetScope {
+	var scopes []budgetScope
+	add := func(s budgetScope) {
+		if s.limit != (costLimit{}) {
+			scopes = append(scopes, s)
+		}
+	}
+	p := budgetPolicy
+	if p == nil {
+		p = &BudgetPolicy{}
+	}
+
+	if id := r.identity; id != nil {
+		user := budgetScope{kind: "user", name: id.User, filter: usageFilter{User: &id.User, Tenant: &id.Tenant}}
+		if l, ok := p.Users[id.User]; ok {
+			user.limit = l
+		} else if p.Default != nil {
+			user.limit = *p.Default
+		}
+		add(user)
+		if id.Tenant != "" {
+			add(budgetScope{kind: "tenant", name: id.Tenant, filter: usageFilter{Tenant: &id.Tenant}, limit: p.Tenants[id.Tenant]})
+		}
+	}
+
+	agent := r.agentName()
+	limit := p.Agents[agent]
+	if r.profile != nil {
+		limit = limit.tighter(r.profile.Budget.costLimit)
+	}
+	add(budgetScope{kind: "agent", name: agent, filter: usageFilter{Agent: &agent}, limit: limit})
+	return scopes
+}
+
+// budgetStatus is how much of one cap has been spent.
+type budgetStatus struct {
+	Scope        string  `json:"scope"`
+	Name         string  `json:"name"`
+	Period       string  `json:"period"`
+	LimitUSD     float64 `json:"limit_usd"`
+	SpentUSD     float64 `json:"spent_usd"`
+	RemainingUSD float64 `json:"remaining_usd"`
+}
+
+// budgetStatuses reports every cap that applies to r, along with the average
+// cost of a turn this month in the first of its scopes that has any.
+func budgetStatuses(ctx context.Context, r Request) ([]budgetStatus, float64, error) {
+	if usageLedger == nil {
+		return nil, 0, nil
+	}
+	now := time.Now().UTC()
+	today, monthStart := now.Format(dayFormat), now.Format("2006-01")+"-01"
+
+	var statuses []budgetStatus
+	var perTurn float64
+	for _, s := range budgetScopes(r) {
+		rows, err := usageLedger.Query(ctx, s.filter, monthStart, today)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to read %s budget: %w", s.kind, err)
+		}
+		var month, day UsageTotals
+		for _, row := range rows {
+			month.add(row.UsageTotals)
+			if row.Day == today {
+				day.add(row.UsageTotals)
+			}
+		}
+		for _, period := range []struct {
+			name  string
+			limit float64
+			spent float64
+		}{{"daily", s.limit.DailyUSD, day.CostUSD}, {"monthly", s.limit.MonthlyUSD, month.CostUSD}} {
+			if period.limit > 0 {
+				statuses = append(statuses, budgetStatus{
+					Scope:        s.kind,
+					Name:         s.name,
+					Period:       period.name,
+					LimitUSD:     period.limit,
+					SpentUSD:     period.spent,
+					RemainingUSD: max(0, period.limit-period.spent),
+				})
+			}
+		}
+		if perTurn == 0 && month.Turns > 0 {
+			perTurn = month.CostUSD / float64(month.Turns)
+		}
+	}
+	return statuses, perTurn, nil
+}
+
+// checkBudget refuses r once any of its caps has been spent, and otherwise
+// lowers its turn limit to what the smallest remaining budget affords at this
+// month's average cost per turn. A run can still overshoot by its last turn.
+func checkBudget(r *Request) error {
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	statuses, perTurn, err := budgetStatuses(ctx, *r)
+	if err != nil {
+		return err
+	}
+
+	remaining := math.Inf(1)
+	for _, s := range statuses {
+		if s.RemainingUSD <= 0 {
+			return &codedError{
+				Code:    ErrBudgetExceeded,
+				Message: fmt.Sprintf("%s %s has spent its %s budget of $%.2f", s.Scope, s.Name, s.Period, s.LimitUSD),
+			}
+		}
+		remaining = min(remaining, s.RemainingUSD)
+	}
+	if perTurn == 0 || math.IsInf(remaining, 1) {
+		return nil
+	}
+	affordable := max(1, int(remaining/perTurn))
+	if turns, ok := maxTurns(*r); !ok || affordable < turns {
+		log.Printf("budget: limiting run of %s to %d turns, $%.2f left", r.agentName(), affordable, remaining)
+		r.budgetTurns = affordable
+	}
+	return nil
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// withBudgets installs a file ledger holding rows, dated today, and policy.
+func withBudgets(t *testing.T, policy *BudgetPolicy, rows ...UsageRow) {
+	t.Helper()
+	ledger, err := newFileUsageLedger(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	today := time.Now().UTC().Format(dayFormat)
+	for _, row := range rows {
+		row.Day = today
+		if err := ledger.Record(context.Background(), row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	usageLedger, budgetPolicy = ledger, policy
+	t.Cleanup(func() { usageLedger, budgetPolicy = nil, nil })
+}
+
+func TestCheckBudget(t *testing.T) {
+	alice := &Identity{User: "alice", Tenant: "acme"}
+	spent := func(user string, cost float64, turns int) UsageRow {
+		return UsageRow{User: user, Tenant: "acme", Agent: defaultAgent, UsageTotals: UsageTotals{CostUSD: cost, Turns: turns, Runs: 1}}
+	}
+
+	t.Run("exceeded", func(t *testing.T) {
+		withBudgets(t, &BudgetPolicy{Default: &costLimit{DailyUSD: 5}}, spent("alice", 5, 10))
+		var coded *codedError
+		if err := checkBudget(&Request{identity: alice}); !errors.As(err, &coded) || coded.Code != ErrBudgetExceeded {
+			t.Errorf("checkBudget() error = %v, want %s", err, ErrBudgetExceeded)
+		}
+		// bob has a default budget of their own
+		if err := checkBudget(&Request{identity: &Identity{User: "bob", Tenant: "acme"}}); err != nil {
+			t.Errorf("checkBudget() for another user error = %v", err)
+		}
+	})
+
+	t.Run("tenant", func(t *testing.T) {
+		withBudgets(t, &BudgetPolicy{Tenants: map[string]costLimit{"acme": {MonthlyUSD: 3}}}, spent("bob", 3, 1))
+		if err := checkBudget(&Request{identity: alice}); err == nil {
+			t.Error("checkBudget() let alice spend from a tenant budget bob used up")
+		}
+	})
+
+	t.Run("turns", func(t *testing.T) {
+		// $1 a turn so far and $3 left affords 3 turns
+		withBudgets(t, &BudgetPolicy{Users: map[string]costLimit{"alice": {DailyUSD: 5}}}, spent("alice", 2, 2))
+		r := &Request{identity: alice}
+		if err := checkBudget(r); err != nil {
+			t.Fatalf("checkBudget() error = %v", err)
+		}
+		if turns, ok := maxTurns(*r); !ok || turns != 3 {
+			t.Errorf("maxTurns() after checkBudget = %d, %v, want 3", turns, ok)
+		}
+
+		// a lower limit of the request's own is kept
+		two := 2
+		r = &Request{identity: alice, MaxTurns: &two}
+		if err := checkBudget(r); err != nil || r.budgetTurns != 0 {
+			t.Errorf("checkBudget() = %v with budgetTurns %d, want the request's limit kept", err, r.budgetTurns)
+		}
+	})
+
+	t.Run("profile", func(t *testing.T) {
+		withBudgets(t, nil, spent("alice", 4, 4))
+		r := &Request{profile: &AgentProfile{Budget: agentBudget{costLimit: costLimit{DailyUSD: 4}}}}
+		if err := checkBudget(r); err == nil {
+			t.Error("checkBudget() ignored the agent profile's budget")
+		}
+	})
+}
+
+func TestMaxTurns(t *testing.T) {
+	defer func(turns int) { defaultMaxTurns = turns }(defaultMaxTurns)
+	defaultMaxTurns = 20
+	ten := 10
+	profile := &AgentProfile{Budget: agentBudget{MaxTurns: 15}}
+
+	tests := []struct {
+		name string
+		r    Request
+		want int
+	}{
+		{"default", Request{}, 20},
+		{"profile", Request{profile: profile}, 15},
+		{"request", Request{profile: profile, MaxTurns: &ten}, 10},
+		{"budget below request", Request{MaxTurns: &ten, budgetTurns: 4}, 4},
+		{"budget above request", Request{MaxTurns: &ten, budgetTurns: 40}, 10},
+	}
+	for _, tt := range tests {
+		if got, ok := maxTurns(tt.r); !ok || got != tt.want {
+			t.Errorf("%s: maxTurns() = %d, %v, want %d", tt.name, got, ok, tt.want)
+		}
+	}
+
+	defaultMaxTurns = 0
+	if got, ok := maxTurns(Request{budgetTurns: 3}); !ok || got != 3 {
+		t.Errorf("maxTurns() without other limits = %d, %v, want the budget's 3", got, ok)
+	}
+	if _, ok := maxTurns(Request{}); ok {
+		t.Error("maxTurns() set a limit where none is configured")
+	}
+}
+
+func TestCostLimitTighter(t *testing.T) {
+	got := costLimit{DailyUSD: 5, MonthlyUSD: 0}.tighter(costLimit{DailyUSD: 10, MonthlyUSD: 50})
+	if want := (costLimit{DailyUSD: 5, MonthlyUSD: 50}); got != want {
+		t.Errorf("tighter() = %+v, want %+v", got, want)
+	}
+}
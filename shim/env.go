@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+)
+
+// reservedEnv lists variables a request can never set, whatever the
+// operator's allowlist says: credentials, loader and runtime settings, the
+// shim's own configuration and the *_HOST targets read by the MCP proxy.
+// TestReservedEnvCoversConfig fails for any setting the shim reads that is
+// missing here.
+var reservedEnv = []string{
+	"ANTHROPIC_*",
+	"CLAUDE_*",
+	"AWS_*",
+	"AUTH_*",
+	"PERMISSION_*",
+	"SHIM_*",
+	"ENV_ALLOWLIST",
+	"ENV_DENYLIST",
+	"*_HOST",
+	"PATH",
+	"HOME",
+	"USER",
+	"SHELL",
+	"PWD",
+	"TMPDIR",
+	"LD_*",
+	"DYLD_*",
+	"NODE_*",
+	"LAMBDA",
+	"HTTP_ADDR",
+	"FS_SHIM",
+	"IS_SANDBOX",
+	"MODEL",
+	"MAX_TURNS",
+	"SYSTEM_PROMPT",
+	"TIMEOUT_SECONDS",
+	"TOOL_POLICY_FILE",
+	"AGENT_NAME",
+	"ALLOWED_MODELS",
+	"MAX_TURNS_LIMIT",
+	"SYSTEM_PROMPTS_DIR",
+	"AGENTS_DIR",
+	"SESSION_STORE",
+	"WORKSPACES_DIR",
+	"IDEMPOTENCY_*",
+	"CALLBACK_*",
+	"JOB_*",
+	"WORKER_CONCURRENCY",
+	"QUEUE_*",
+	"USAGE_LEDGER",
+	"BUDGETS_FILE",
+	"RATE_LIMIT*",
+}
+
+// envPolicy decides which Request.Env keys a caller may set.
+type envPolicy struct {
+	allow []string
+	deny  []string
+}
+
+// requestEnvPolicy is the operator's policy, loaded at startup. Its zero value
+// still enforces the reserved set.
+var requestEnvPolicy envPolicy
+
+// loadEnvPolicy reads comma-separated glob patterns from ENV_ALLOWLIST and
+// ENV_DENYLIST. An empty allowlist allows any key that is not denied.
+func loadEnvPolicy() (envPolicy, error) {
+	p := envPolicy{
+		allow: splitList(os.Getenv("ENV_ALLOWLIST")),
+		deny:  splitList(os.Getenv("ENV_DENYLIST")),
+	}
+	for _, pattern := range slices.Concat(p.allow, p.deny) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return envPolicy{}, fmt.Errorf("invalid env pattern %q: %w", pattern, err)
+		}
+	}
+	return p, nil
+}
+
+// disallowed returns the sorted keys of env that the policy rejects.
+func (p envPolicy) disallowed(env map[string]string) []string {
+	var keys []string
+	for k := range env {
+		if matchAny(reservedEnv, k) || matchAny(p.deny, k) || (len(p.allow) > 0 && !matchAny(p.allow, k)) {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+// matchAny reports whether name matches any of the glob patterns.
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// splitList splits a comma-separated setting, dropping empty entries.
+func splitList(s string) []string {
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
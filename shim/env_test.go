@@ -0,0 +1,87 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestReservedEnvCoversConfig fails when the shim reads a variable that a
+// request's env could override, so new settings cannot be forgotten in
+// reservedEnv.
+func TestReservedEnvCoversConfig(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			call, ok := n.(*ast.CallExpr)
+			if !ok || len(call.Args) == 0 {
+				return true
+			}
+			sel, ok := call.Fun.(*ast.SelectorExpr)
+			if !ok || (sel.Sel.Name != "Getenv" && sel.Sel.Name != "LookupEnv") {
+				return true
+			}
+			if pkg, ok := sel.X.(*ast.Ident); !ok || pkg.Name != "os" {
+				return true
+			}
+			lit, ok := call.Args[0].(*ast.BasicLit)
+			if !ok || lit.Kind != token.STRING {
+				return true
+			}
+			key, _ := strconv.Unquote(lit.Value)
+			if !matchAny(reservedEnv, key) {
+				t.Errorf("%s: %s is read by the shim but not in reservedEnv", fset.Position(lit.Pos()), key)
+			}
+			return true
+		})
+	}
+}
+
+func TestEnvPolicyDisallowed(t *testing.T) {
+	env := map[string]string{
+		"PROJECT":           "garden",
+		"PROJECT_REGION":    "eu",
+		"DEBUG":             "1",
+		"ANTHROPIC_API_KEY": "sk-...",
+		"GITHUB_HOST":       "ghe.example.com",
+		"PATH":              "/tmp",
+	}
+	tests := []struct {
+		name   string
+		policy envPolicy
+		want   []string
+	}{
+		{"reserved keys only", envPolicy{}, []string{"ANTHROPIC_API_KEY", "GITHUB_HOST", "PATH"}},
+		{"denylist", envPolicy{deny: []string{"DEBUG"}},
+			[]string{"ANTHROPIC_API_KEY", "DEBUG", "GITHUB_HOST", "PATH"}},
+		{"allowlist", envPolicy{allow: []string{"PROJECT*"}},
+			[]string{"ANTHROPIC_API_KEY", "DEBUG", "GITHUB_HOST", "PATH"}},
+		{"allowlist cannot reach reserved keys", envPolicy{allow: []string{"*"}},
+			[]string{"ANTHROPIC_API_KEY", "GITHUB_HOST", "PATH"}},
+		{"deny beats allow", envPolicy{allow: []string{"PROJECT*"}, deny: []string{"*_REGION"}},
+			[]string{"ANTHROPIC_API_KEY", "DEBUG", "GITHUB_HOST", "PATH", "PROJECT_REGION"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.disallowed(env); !slices.Equal(got, tt.want) {
+				t.Errorf("disallowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// defaultIdempotencyTTL is how long a result is replayed for a repeated key
+// when IDEMPOTENCY_TTL_SECONDS is unset.
+const defaultIdempotencyTTL = 24 * time.Hour
+
+// idempotencyRecord is what is stored for an idempotency key. Response is nil
+// while the first request with the key is still running; ExpiresAt is the end
+// of its lease, after which a retry may take over, or of the replay window
+// once Response is set.
+type idempotencyRecord struct {
+	Fingerprint string                          `json:"fingerprint"`
+	Response    *events.APIGatewayProxyResponse `json:"response,omitempty"`
+	ExpiresAt   time.Time                       `json:"expires_at"`
+}
+
+// IdempotencyStore remembers the outcome of requests by idempotency key.
+type IdempotencyStore interface {
+	// Begin claims key for a new run until leaseUntil and reports true, unless
+	// an unexpired record exists, which is returned instead.
+	Begin(ctx context.Context, key, fingerprint string, leaseUntil time.Time) (*idempotencyRecord, bool, error)
+	// Lookup returns the unexpired record for key, or nil if there is none.
+	Lookup(ctx context.Context, key string) (*idempotencyRecord, error)
+	// Complete stores the run's response for replay until expiresAt.
+	Complete(ctx context.Context, key string, resp events.APIGatewayProxyResponse, expiresAt time.Time) error
+	// Release forgets key so the request can be retried.
+	Release(ctx context.Context, key string) error
+}
+
+// idempotencyStore is the store configured by IDEMPOTENCY_STORE, or nil if
+// idempotency keys are not accepted.
+var idempotencyStore IdempotencyStore
+
+// loadIdempotencyStore opens the store named by IDEMPOTENCY_STORE, either
+// file:<dir> or sqlite:<file>.
+func loadIdempotencyStore() (IdempotencyStore, error) {
+	spec := os.Getenv("IDEMPOTENCY_STORE")
+	switch {
+	case spec == "":
+		return nil, nil
+	case strings.HasPrefix(spec, "file:"):
+		return newFileIdempotencyStore(strings.TrimPrefix(spec, "file:"))
+	case strings.HasPrefix(spec, "sqlite:"):
+		return newSQLiteIdempotencyStore(strings.TrimPrefix(spec, "sqlite:"))
+	default:
+		return nil, fmt.Errorf("unknown IDEMPOTENCY_STORE %q", spec)
+	}
+}
+
+// idempotencyTTL is how long results are replayed for a repeated key.
+var idempotencyTTL = defaultIdempotencyTTL
+
+// loadIdempotencyTTL reads IDEMPOTENCY_TTL_SECONDS.
+func loadIdempotencyTTL() (time.Duration, error) {
+	v := os.Getenv("IDEMPOTENCY_TTL_SECONDS")
+	if v == "" {
+		return defaultIdempotencyTTL, nil
+	}
+	secs, err := strconv.Atoi(v)
+	if err != nil || secs <= 0 {
+		return 0, fmt.Errorf("IDEMPOTENCY_TTL_SECONDS must be a positive number of seconds, got %q", v)
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
+// idempotencyKey scopes r's idempotency key to its caller, so two callers
+// choosing the same key never see each other's results.
+func idempotencyKey(r Request) string {
+	scope := string(r.User)
+	if r.identity != nil {
+		scope = r.identity.Tenant + "\x00" + r.identity.User
+	}
+	sum := sha256.Sum256([]byte(scope + "\x00" + *r.IdempotencyKey))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestFingerprint identifies what r asks for, so reusing a key for a
+// different request can be detected. It is taken before prepare applies any
+// operator policy to r.
+func requestFingerprint(r Request) string {
+	data, _ := json.Marshal(r)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// checkIdempotencyKey refuses idempotency keys when no store is configured,
+// so callers relying on them are not silently exposed to duplicate runs.
+func checkIdempotencyKey(r Request) error {
+	if r.IdempotencyKey != nil && idempotencyStore == nil {
+		return &codedError{Code: ErrForbidden, Message: "idempotency_key is not enabled"}
+	}
+	return nil
+}
+
+// checkIdempotentReplay looks up r's idempotency key before any limits are
+// applied, so a retry of a finished request is answered from the store
+// without spending a rate limit token, budget or worker. The stored response
+// is put in r.replay; a retry of a running or different request is refused.
+func checkIdempotentReplay(r *Request) error {
+	if r.IdempotencyKey == nil {
+		return nil
+	}
+	r.fingerprint = requestFingerprint(*r)
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	rec, err := idempotencyStore.Lookup(ctx, idempotencyKey(*r))
+	if err != nil {
+		return fmt.Errorf("failed to look up idempotency key: %w", err)
+	}
+	if rec == nil {
+		return nil
+	}
+	if err := rec.conflict(r.fingerprint); err != nil {
+		return err
+	}
+	resp := rec.replay()
+	r.replay = &resp
+	return nil
+}
+
+// conflict returns the error for a request with fingerprint that finds the
+// record in place, or nil if the record's response can be replayed to it.
+func (rec *idempotencyRecord) conflict(fingerprint string) error {
+	switch {
+	case rec.Fingerprint != fingerprint:
+		return &codedError{Code: ErrBadRequest, Message: "idempotency_key was already used for a different request"}
+	case rec.Response == nil:
+		return &codedError{Code: ErrInProgress, Message: "a request with this idempotency_key is still running"}
+	}
+	return nil
+}
+
+// replay returns the stored response marked with an Idempotent-Replayed
+// header.
+func (rec *idempotencyRecord) replay() events.APIGatewayProxyResponse {
+	resp := *rec.Response
+	resp.Headers = map[string]string{"Idempotent-Replayed": "true"}
+	for k, v := range rec.Response.Headers {
+		resp.Headers[k] = v
+	}
+	return resp
+}
+
+// runIdempotent runs r at most once per idempotency key within the replay
+// window. A repeated key gets the stored response, marked with an
+// Idempotent-Replayed header, or an in_progress error while the first request
+// is still running. ctx bounds the run and so the lease on the key.
+func runIdempotent(ctx context.Context, r Request, run func() events.APIGatewayProxyResponse) events.APIGatewayProxyResponse {
+	key := idempotencyKey(r)
+	leaseUntil := time.Now().Add(idempotencyTTL)
+	if deadline, ok := ctx.Deadline(); ok {
+		leaseUntil = deadline.Add(killGrace)
+	}
+
+	rec, claimed, err := idempotencyStore.Begin(ctx, key, r.fingerprint, leaseUntil)
+	if err != nil {
+		return errorResponseFrom(fmt.Errorf("failed to claim idempotency key: %w", err)).ProxyResponse()
+	}
+	// a retry can still get here if it raced the first request past
+	// checkIdempotentReplay
+	if !claimed {
+		if err := rec.conflict(r.fingerprint); err != nil {
+			return errorResponseFrom(err).ProxyResponse()
+		}
+		return rec.replay()
+	}
+
+	resp := run()
+
+	storeCtx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	// throttled runs did no work worth protecting and should be retried
+	if resp.StatusCode == ErrRateLimited.StatusCode() {
+		err = idempotencyStore.Release(storeCtx, key)
+	} else {
+		err = idempotencyStore.Complete(storeCtx, key, resp, time.Now().Add(idempotencyTTL))
+	}
+	if err != nil {
+		log.Printf("idempotency: failed to store result: %v", err)
+	}
+	return resp
+}
+
+// fileIdempotencyStore keeps one <key>.json record per key in a directory.
+type fileIdempotencyStore struct {
+	dir string
+}
+
+func newFileIdempotencyStore(dir string) (*fileIdempotencyStore, error) {
+	if dir == "" {
+		return nil, errors.New("file idempotency store requires a directory")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create idempotency dir: %w", err)
+	}
+	return &fileIdempotencyStore{dir: dir}, nil
+}
+
+func (s *fileIdempotencyStore) path(key string) string {
+	return filepath.Join(s.dir, key+".json")
+}
+
+func (s *fileIdempotencyStore) Begin(ctx context.Context, key, fingerprint string, leaseUntil time.Time) (*idempotencyRecord, bool, error) {
+	data, err := json.Marshal(idempotencyRecord{Fingerprint: fingerprint, ExpiresAt: leaseUntil})
+	if err != nil {
+		return nil, false, err
+	}
+	// a second attempt follows removing an expired record
+	for range 2 {
+		claimed, err := createFileExclusive(s.path(key), data)
+		if err != nil || claimed {
+			return nil, claimed, err
+		}
+		existing, err := os.ReadFile(s.path(key))
+		if os.IsNotExist(err) {
+			continue // released in the meantime
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		var rec idempotencyRecord
+		if err := json.Unmarshal(existing, &rec); err != nil {
+			return nil, false, fmt.Errorf("invalid idempotency record %s: %w", key, err)
+		}
+		if time.Now().Before(rec.ExpiresAt) {
+			return &rec, false, nil
+		}
+		if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+			return nil, false, err
+		}
+	}
+	return nil, false, fmt.Errorf("idempotency key %s is contended", key)
+}
+
+func (s *fileIdempotencyStore) Lookup(ctx context.Context, key string) (*idempotencyRecord, error) {
+	data, err := os.ReadFile(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rec idempotencyRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, fmt.Errorf("invalid idempotency record %s: %w", key, err)
+	}
+	if !time.Now().Before(rec.ExpiresAt) {
+		return nil, nil
+	}
+	return &rec, nil
+}
+
+func (s *fileIdempotencyStore) Complete(ctx context.Context, key string, resp events.APIGatewayProxyResponse, expiresAt time.Time) error {
+	existing, err := os.ReadFile(s.path(key))
+	if err != nil {
+		return err
+	}
+	var rec idempotencyRecord
+	if err := json.Unmarshal(existing, &rec); err != nil {
+		return fmt.Errorf("invalid idempotency record %s: %w", key, err)
+	}
+	rec.Response, rec.ExpiresAt = &resp, expiresAt
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path(key), data)
+}
+
+func (s *fileIdempotencyStore) Release(ctx context.Context, key string) error {
+	if err := os.Remove(s.path(key)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// sqliteIdempotencyStore keeps records in a SQLite table, which several
+// instances can share on one volume.
+type sqliteIdempotencyStore struct {
+	db *sql.DB
+}
+
+func newSQLiteIdempotencyStore(path string) (*sqliteIdempotencyStore, error) {
+	if path == "" {
+		return nil, errors.New("sqlite idempotency store requires a database path")
+	}
+	db, err := openSQLite(path, `CREATE TABLE IF NOT EXISTS idempotency (
+  key TEXT PRIMARY KEY,
+  fingerprint TEXT NOT NULL,
+  response TEXT,
+  expires_at INTEGER NOT NULL
+);`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create idempotency table: %w", err)
+	}
+	return &sqliteIdempotencyStore{db: db}, nil
+}
+
+func (s *sqliteIdempotencyStore) Begin(ctx context.Context, key, fingerprint string, leaseUntil time.Time) (*idempotencyRecord, bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+	// expired records are purged first, so the insert only succeeds for a
+	// free key
+	if _, err := tx.ExecContext(ctx, "DELETE FROM idempotency WHERE expires_at <= ?", time.Now().UnixMilli()); err != nil {
+		return nil, false, err
+	}
+	res, err := tx.ExecContext(ctx, "INSERT INTO idempotency (key, fingerprint, response, expires_at) VALUES (?, ?, NULL, ?) "+
+		"ON CONFLICT(key) DO NOTHING", key, fingerprint, leaseUntil.UnixMilli())
+	if err != nil {
+		return nil, false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return nil, false, err
+	}
+	if n > 0 {
+		if err := tx.Commit(); err != nil {
+			return nil, false, err
+		}
+		return nil, true, nil
+	}
+	rec, err := scanIdempotencyRecord(key, tx.QueryRowContext(ctx,
+		"SELECT fingerprint, response, expires_at FROM idempotency WHERE key = ?", key))
+	if err != nil {
+		return nil, false, err
+	}
+	return rec, false, tx.Commit()
+}
+
+func (s *sqliteIdempotencyStore) Lookup(ctx context.Context, key string) (*idempotencyRecord, error) {
+	rec, err := scanIdempotencyRecord(key, s.db.QueryRowContext(ctx,
+		"SELECT fingerprint, response, expires_at FROM idempotency WHERE key = ? AND expires_at > ?", key, time.Now().UnixMilli()))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	return rec, err
+}
+
+// scanIdempotencyRecord reads the fingerprint, response and expires_at
+// columns of key's row.
+func scanIdempotencyRecord(key string, row *sql.Row) (*idempotencyRecord, error) {
+	var rec idempotencyRecord
+	var response sql.NullString
+	var expiresAt int64
+	if err := row.Scan(&rec.Fingerprint, &response, &expiresAt); err != nil {
+		return nil, err
+	}
+	rec.ExpiresAt = time.UnixMilli(expiresAt)
+	if response.Valid {
+		if err := json.Unmarshal([]byte(response.String), &rec.Response); err != nil {
+			return nil, fmt.Errorf("invalid idempotency record %s: %w", key, err)
+		}
+	}
+	return &rec, nil
+}
+
+func (s *sqliteIdempotencyStore) Complete(ctx context.Context, key string, resp events.APIGatewayProxyResponse, expiresAt time.Time) error {
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.ExecContext(ctx, "UPDATE idempotency SET response = ?, expires_at = ? WHERE key = ?",
+		string(data), expiresAt.UnixMilli(), key)
+	return err
+}
+
+func (s *sqliteIdempotencyStore) Release(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM idempotency WHERE key = ?", key)
+	return err
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestIdempotencyStores(t *testing.T) {
+	tests := []struct {
+		name string
+		open func(t *testing.T) (IdempotencyStore, error)
+	}{
+		{"file", func(t *testing.T) (IdempotencyStore, error) {
+			return newFileIdempotencyStore(t.TempDir())
+		}},
+		{"sqlite", func(t *testing.T) (IdempotencyStore, error) {
+			return newSQLiteIdempotencyStore(filepath.Join(t.TempDir(), "idempotency.db"))
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := tt.open(t)
+			if err != nil {
+				t.Fatalf("failed to open store: %v", err)
+			}
+			ctx := context.Background()
+			lease := time.Now().Add(time.Minute)
+
+			if _, claimed, err := store.Begin(ctx, "k", "fp", lease); err != nil || !claimed {
+				t.Fatalf("first Begin() = %v, %v, want claimed", claimed, err)
+			}
+			rec, claimed, err := store.Begin(ctx, "k", "other", lease)
+			if err != nil || claimed || rec == nil || rec.Fingerprint != "fp" || rec.Response != nil {
+				t.Fatalf("second Begin() = %+v, %v, %v, want the running record", rec, claimed, err)
+			}
+
+			resp := events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Body: `{"result":"done"}`}
+			if err := store.Complete(ctx, "k", resp, time.Now().Add(time.Hour)); err != nil {
+				t.Fatalf("Complete() error = %v", err)
+			}
+			rec, err = store.Lookup(ctx, "k")
+			if err != nil || rec == nil || rec.Response == nil || rec.Response.Body != resp.Body {
+				t.Fatalf("Lookup() = %+v, %v, want the stored response", rec, err)
+			}
+
+			if err := store.Release(ctx, "k"); err != nil {
+				t.Fatalf("Release() error = %v", err)
+			}
+			if rec, err := store.Lookup(ctx, "k"); err != nil || rec != nil {
+				t.Errorf("Lookup() after Release = %+v, %v, want nil", rec, err)
+			}
+
+			// an expired lease is taken over
+			if _, claimed, err := store.Begin(ctx, "stale", "fp", time.Now().Add(-time.Second)); err != nil || !claimed {
+				t.Fatalf("Begin() = %v, %v, want claimed", claimed, err)
+			}
+			if rec, err := store.Lookup(ctx, "stale"); err != nil || rec != nil {
+				t.Errorf("Lookup() of an expired record = %+v, %v, want nil", rec, err)
+			}
+			if _, claimed, err := store.Begin(ctx, "stale", "fp", lease); err != nil || !claimed {
+				t.Errorf("Begin() over an expired record = %v, %v, want claimed", claimed, err)
+			}
+		})
+	}
+}
+
+func TestRunIdempotent(t *testing.T) {
+	store, err := newFileIdempotencyStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	idempotencyStore = store
+	t.Cleanup(func() { idempotencyStore = nil })
+
+	runs := 0
+	status := http.StatusOK
+	run := func() events.APIGatewayProxyResponse {
+		runs++
+		return events.APIGatewayProxyResponse{StatusCode: status, Body: `{"result":"done"}`}
+	}
+	// send runs r the way the handler does: replays are answered before the
+	// run is started
+	send := func(r Request) events.APIGatewayProxyResponse {
+		t.Helper()
+		if err := checkIdempotentReplay(&r); err != nil {
+			return errorResponseFrom(err).ProxyResponse()
+		}
+		if r.replay != nil {
+			return *r.replay
+		}
+		return runIdempotent(context.Background(), r, run)
+	}
+	key := "order-42"
+	req := Request{Prompt: json.RawMessage(`"ship it"`), IdempotencyKey: &key}
+
+	if resp := send(req); resp.StatusCode != http.StatusOK || runs != 1 {
+		t.Fatalf("first request = %d after %d runs", resp.StatusCode, runs)
+	}
+	resp := send(req)
+	if resp.StatusCode != http.StatusOK || resp.Headers["Idempotent-Replayed"] != "true" || runs != 1 {
+		t.Errorf("retry = %d %v after %d runs, want a replay", resp.StatusCode, resp.Headers, runs)
+	}
+
+	other := req
+	other.Prompt = json.RawMessage(`"ship something else"`)
+	if resp := send(other); resp.StatusCode != ErrBadRequest.StatusCode() || runs != 1 {
+		t.Errorf("reused key = %d after %d runs, want %d", resp.StatusCode, runs, ErrBadRequest.StatusCode())
+	}
+
+	// another caller's key of the same name is separate
+	mallory := req
+	mallory.identity = &Identity{User: "mallory"}
+	if resp := send(mallory); resp.Headers["Idempotent-Replayed"] != "" || runs != 2 {
+		t.Errorf("another caller's request = %v after %d runs, want a fresh run", resp.Headers, runs)
+	}
+
+	// a throttled run releases its key
+	throttled := "throttled"
+	req.IdempotencyKey = &throttled
+	status = ErrRateLimited.StatusCode()
+	send(req)
+	status = http.StatusOK
+	if resp := send(req); resp.StatusCode != http.StatusOK || runs != 4 {
+		t.Errorf("retry after rate_limited = %d after %d runs, want a fresh run", resp.StatusCode, runs)
+	}
+}
+
+func TestRunIdempotentInProgress(t *testing.T) {
+	store, err := newFileIdempotencyStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	idempotencyStore = store
+	t.Cleanup(func() { idempotencyStore = nil })
+
+	key := "slow"
+	r := Request{Prompt: json.RawMessage(`"wait"`), IdempotencyKey: &key}
+	r.fingerprint = requestFingerprint(r)
+	runIdempotent(context.Background(), r, func() events.APIGatewayProxyResponse {
+		retry := Request{Prompt: json.RawMessage(`"wait"`), IdempotencyKey: &key}
+		err := checkIdempotentReplay(&retry)
+		var coded *codedError
+		if !errors.As(err, &coded) || coded.Code != ErrInProgress {
+			t.Errorf("retry while running error = %v, want %s", err, ErrInProgress)
+		}
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusOK}
+	})
+}
+
+func TestLoadIdempotencyTTL(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", defaultIdempotencyTTL, false},
+		{"60", time.Minute, false},
+		{"0", 0, true},
+		{"a day", 0, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("IDEMPOTENCY_TTL_SECONDS", tt.value)
+		got, err := loadIdempotencyTTL()
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("loadIdempotencyTTL() with %q = %v, %v", tt.value, got, err)
+		}
+	}
+}
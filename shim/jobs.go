@@ -0,0 +1,412 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	mathrand "math/rand/v2"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// jobsPath is the root of the job API served by the HTTP server:
+//
+//	POST /v1/jobs        submit a Request, answered 202 with the queued Job
+//	GET  /v1/jobs/{id}   poll a Job's status and result
+const jobsPath = "/v1/jobs"
+
+const (
+	// defaultJobRetention is how long a finished job can still be polled
+	// when JOB_RETENTION_SECONDS is unset.
+	defaultJobRetention = time.Hour
+	// defaultCallbackAttempts is how often a callback is tried when
+	// CALLBACK_MAX_ATTEMPTS is unset.
+	defaultCallbackAttempts = 5
+	// callbackTimeout bounds a single callback attempt.
+	callbackTimeout = 30 * time.Second
+	// callbackBackoff is the wait before the first retry, doubled for each
+	// further retry up to callbackMaxBackoff.
+	callbackBackoff    = 2 * time.Second
+	callbackMaxBackoff = 2 * time.Minute
+)
+
+// JobStatus is where a job is in its lifecycle.
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+)
+
+// Callback delivery states reported on a Job.
+const (
+	callbackPending   = "pending"
+	callbackDelivered = "delivered"
+	callbackFailed    = "failed"
+)
+
+// Job is an agent run executed in the background. Result is the same envelope
+// a synchronous request would have returned.
+type Job struct {
+	ID             string     `json:"job_id"`
+	Status         JobStatus  `json:"status"`
+	CreatedAt      time.Time  `json:"created_at"`
+	StartedAt      *time.Time `json:"started_at,omitempty"`
+	FinishedAt     *time.Time `json:"finished_at,omitempty"`
+	Result         *Response  `json:"result,omitempty"`
+	CallbackStatus string     `json:"callback_status,omitempty"`
+
+	// owner is the caller that submitted the job, nil without authentication.
+	owner *Identity
+}
+
+// finish records the outcome of the job's run.
+func (j *Job) finish(resp events.APIGatewayProxyResponse) {
+	now := time.Now().UTC()
+	j.FinishedAt = &now
+	var result Response
+	if err := json.Unmarshal([]byte(resp.Body), &result); err != nil {
+		result = errorResponse(ErrCLICrashed, fmt.Sprintf("invalid response: %v", err))
+	}
+	j.Result = &result
+	j.Status = JobSucceeded
+	if result.IsError {
+		j.Status = JobFailed
+	}
+}
+
+// jobRunner runs submitted jobs in the background and keeps them in memory
+// for polling until they expire.
+type jobRunner struct {
+	mu   sync.Mutex
+	jobs map[string]*Job
+	wg   sync.WaitGroup
+	// ctx outlives the requests that submit jobs; it is cancelled only when
+	// the server gives up waiting for them at shutdown.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// jobs is the HTTP server's job runner.
+var jobs = newJobRunner()
+
+func newJobRunner() *jobRunner {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &jobRunner{jobs: map[string]*Job{}, ctx: ctx, cancel: cancel}
+}
+
+// submit queues a prepared request and returns a snapshot of its job. Jobs
+// wait for a worker in the same queue as synchronous requests, but without
+// its timeout; only a full queue refuses them. A replayed request finishes
+// without taking a place in the queue.
+func (jr *jobRunner) submit(r Request) (Job, error) {
+	id, err := newJobID()
+	if err != nil {
+		return Job{}, err
+	}
+	var t *ticket
+	if r.replay == nil {
+		if t, err = runPool.enqueue(); err != nil {
+			return Job{}, err
+		}
+	}
+	job := &Job{ID: id, Status: JobQueued, CreatedAt: time.Now().UTC(), owner: r.identity}
+	if r.CallbackURL != nil {
+		job.CallbackStatus = callbackPending
+	}
+
+	jr.mu.Lock()
+	jr.prune()
+	jr.jobs[id] = job
+	snapshot := *job
+	jr.mu.Unlock()
+
+	jr.wg.Add(1)
+	go func() {
+		defer jr.wg.Done()
+		jr.run(job, r, t)
+	}()
+	return snapshot, nil
+}
+
+func (jr *jobRunner) run(job *Job, r Request, t *ticket) {
+	var resp events.APIGatewayProxyResponse
+	if r.replay != nil {
+		resp = *r.replay
+	} else if err := runPool.wait(jr.ctx, t, 0); err != nil {
+		resp = errorResponseFrom(err).ProxyResponse()
+	} else {
+		jr.update(job, func(j *Job) {
+			now := time.Now().UTC()
+			j.Status, j.StartedAt = JobRunning, &now
+		})
+		resp = execute(jr.ctx, r)
+		runPool.release()
+	}
+	jr.update(job, func(j *Job) { j.finish(resp) })
+
+	if r.CallbackURL == nil {
+		return
+	}
+	payload := jr.snapshot(job)
+	payload.CallbackStatus = ""
+	status := callbackDelivered
+	if err := deliverCallback(jr.ctx, *r.CallbackURL, payload); err != nil {
+		log.Printf("jobs: callback for %s failed: %v", job.ID, err)
+		status = callbackFailed
+	}
+	jr.update(job, func(j *Job) { j.CallbackStatus = status })
+}
+
+func (jr *jobRunner) update(job *Job, f func(*Job)) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	f(job)
+}
+
+func (jr *jobRunner) snapshot(job *Job) Job {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	return *job
+}
+
+// get returns job id if caller may see it.
+func (jr *jobRunner) get(id string, caller *Identity) (Job, bool) {
+	jr.mu.Lock()
+	defer jr.mu.Unlock()
+	job, ok := jr.jobs[id]
+	if !ok || (caller != nil && (job.owner == nil || job.owner.User != caller.User || job.owner.Tenant != caller.Tenant)) {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// prune forgets jobs that finished longer ago than the retention period. The
+// caller must hold jr.mu.
+func (jr *jobRunner) prune() {
+	cutoff := time.Now().Add(-jobRetention)
+	for id, job := range jr.jobs {
+		if job.FinishedAt != nil && job.FinishedAt.Before(cutoff) && job.CallbackStatus != callbackPending {
+			delete(jr.jobs, id)
+		}
+	}
+}
+
+// shutdown waits for running jobs and their callbacks until ctx is done, then
+// stops whatever is left.
+func (jr *jobRunner) shutdown(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		jr.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		log.Printf("jobs: stopping unfinished jobs")
+		jr.cancel()
+		<-done
+	}
+}
+
+// jobRetention is how long finished jobs are kept for polling.
+var jobRetention = defaultJobRetention
+
+// loadJobRetention reads JOB_RETENTION_SECONDS.
+func loadJobRetention() (time.Duration, error) {
+	v := os.Getenv("JOB_RETENTION_SECONDS")
+	if v == "" {
+		return defaultJobRetention, nil
+	}
+	secs, err := strconv.Atoi(v)
+	if err != nil || secs <= 0 {
+		return 0, fmt.Errorf("JOB_RETENTION_SECONDS must be a positive number of seconds, got %q", v)
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
+// callbackAttempts is how often a callback is tried before giving up.
+var callbackAttempts = defaultCallbackAttempts
+
+// loadCallbackAttempts reads CALLBACK_MAX_ATTEMPTS.
+func loadCallbackAttempts() (int, error) {
+	v := os.Getenv("CALLBACK_MAX_ATTEMPTS")
+	if v == "" {
+		return defaultCallbackAttempts, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("CALLBACK_MAX_ATTEMPTS must be a positive number, got %q", v)
+	}
+	return n, nil
+}
+
+// newJobID returns a random job id. Jobs are not sessions, so their ids carry
+// a prefix that keeps them from being mistaken for one.
+func newJobID() (string, error) {
+	var b [12]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate job id: %w", err)
+	}
+	return "job_" + hex.EncodeToString(b[:]), nil
+}
+
+// handleSubmitJob authenticates and prepares a request like /v1/run, so a bad
+// request is still refused up front, then runs it in the background.
+func handleSubmitJob(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	if err != nil {
+		writeProxyResponse(w, errorResponse(ErrBadRequest, fmt.Sprintf("failed to read body: %v", err)).ProxyResponse())
+		return
+	}
+	req, err := authenticateRequest(newAuthRequest(r, body))
+	if err != nil {
+		writeProxyResponse(w, errorResponseFrom(err).ProxyResponse())
+		return
+	}
+	if req.Stream {
+		writeProxyResponse(w, errorResponse(ErrBadRequest, "jobs cannot stream; poll the job or use callback_url").ProxyResponse())
+		return
+	}
+	if err := prepare(&req); err != nil {
+		writeProxyResponse(w, prepareError(req, err))
+		return
+	}
+
+	job, err := jobs.submit(req)
+	if err != nil {
+		writeProxyResponse(w, withHeaders(runPool.rejection(err), rateLimitHeaders(req)))
+		return
+	}
+	w.Header().Set("Location", jobsPath+"/"+job.ID)
+	writeProxyResponse(w, withHeaders(jsonResponse(http.StatusAccepted, job), rateLimitHeaders(req)))
+}
+
+// handleGetJob serves a job's current state to the caller that submitted it.
+func handleGetJob(w http.ResponseWriter, r *http.Request) {
+	caller, err := authenticateCaller(newAuthRequest(r, nil))
+	if err != nil {
+		writeProxyResponse(w, errorResponseFrom(err).ProxyResponse())
+		return
+	}
+	id := r.PathValue("id")
+	job, ok := jobs.get(id, caller)
+	if !ok {
+		writeProxyResponse(w, errorResponse(ErrNotFound, fmt.Sprintf("job %s not found", id)).ProxyResponse())
+		return
+	}
+	writeProxyResponse(w, jsonResponse(http.StatusOK, job))
+}
+
+// callbackClient delivers callbacks. It does not follow redirects, which
+// could lead to a host outside CALLBACK_HOSTS.
+var callbackClient = &http.Client{CheckRedirect: noRedirects}
+
+// checkCallbackConfig refuses to enable callbacks without CALLBACK_SECRET, as
+// receivers could not tell the shim's callbacks from forged ones.
+func checkCallbackConfig() error {
+	if os.Getenv("CALLBACK_HOSTS") != "" && os.Getenv("CALLBACK_SECRET") == "" {
+		return fmt.Errorf("CALLBACK_HOSTS requires CALLBACK_SECRET")
+	}
+	return nil
+}
+
+// checkCallbackURL refuses a callback_url unless its host is in CALLBACK_HOSTS,
+// so the field cannot be used to make the shim call arbitrary hosts.
+func checkCallbackURL(r Request) error {
+	if r.CallbackURL == nil {
+		return nil
+	}
+	u, err := url.Parse(*r.CallbackURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return &codedError{Code: ErrBadRequest, Message: "callback_url must be an absolute http(s) url"}
+	}
+	if !matchAny(splitList(os.Getenv("CALLBACK_HOSTS")), u.Hostname()) {
+		return &codedError{Code: ErrForbidden, Message: fmt.Sprintf("callback host %q is not allowed", u.Hostname())}
+	}
+	return nil
+}
+
+// callbackJob describes a request run outside the job API, e.g. a Lambda
+// invoked asynchronously, so its callback has the same shape as a job's. The
+// job id is the Lambda request id when there is one.
+func callbackJob(ctx context.Context, started time.Time, resp events.APIGatewayProxyResponse) Job {
+	job := Job{CreatedAt: started.UTC(), StartedAt: &started}
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		job.ID = lc.AwsRequestID
+	} else if id, err := newJobID(); err == nil {
+		job.ID = id
+	}
+	job.finish(resp)
+	return job
+}
+
+// deliverCallback posts the finished job to url, retrying with exponential
+// backoff on network errors, 429 and 5xx responses. Requests are signed like
+// HMAC-authenticated shim requests with CALLBACK_SECRET, with a fresh
+// timestamp on every attempt.
+func deliverCallback(ctx context.Context, url string, job Job) error {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to marshal callback: %w", err)
+	}
+	backoff := callbackBackoff
+	for attempt := 1; ; attempt++ {
+		retry, err := postCallback(ctx, url, job.ID, body)
+		if err == nil {
+			return nil
+		}
+		if !retry || attempt == callbackAttempts {
+			return fmt.Errorf("attempt %d: %w", attempt, err)
+		}
+		// full jitter keeps many failed callbacks from retrying in lockstep
+		wait := backoff/2 + mathrand.N(backoff/2+1)
+		log.Printf("callback: attempt %d for job %s failed, retrying in %s: %v", attempt, job.ID, wait, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("attempt %d: %w", attempt, ctx.Err())
+		case <-time.After(wait):
+		}
+		backoff = min(backoff*2, callbackMaxBackoff)
+	}
+}
+
+// postCallback makes one callback attempt and reports whether a failure is
+// worth retrying.
+func postCallback(ctx context.Context, url, jobID string, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, callbackTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to create callback request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Job-Id", jobID)
+	signRequest(req, os.Getenv("CALLBACK_SECRET"), body)
+
+	resp, err := callbackClient.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("failed to call callback: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("callback returned status %d", resp.StatusCode)
+}
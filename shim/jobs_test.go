@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeliverCallback(t *testing.T) {
+	const secret = "callback-secret"
+	t.Setenv("CALLBACK_SECRET", secret)
+
+	var calls atomic.Int32
+	var got Job
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		want := signHMAC([]byte(secret), r.Header.Get("X-Timestamp"), r.Method, r.URL.Path, r.URL.Query(), body)
+		if r.Header.Get("X-Signature") != want {
+			t.Errorf("callback signature %q, want %q", r.Header.Get("X-Signature"), want)
+		}
+		if r.Header.Get("X-Job-Id") != "job_1" {
+			t.Errorf("X-Job-Id = %q, want job_1", r.Header.Get("X-Job-Id"))
+		}
+		switch r.URL.Query().Get("case") {
+		case "flaky":
+			// the first attempt fails and is retried
+			if calls.Add(1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		case "rejected":
+			calls.Add(1)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		case "redirect":
+			calls.Add(1)
+			http.Redirect(w, r, "/elsewhere", http.StatusTemporaryRedirect)
+			return
+		}
+		_ = json.Unmarshal(body, &got)
+	}))
+	defer receiver.Close()
+
+	job := Job{ID: "job_1", Status: JobSucceeded, Result: &Response{Result: "done"}}
+	ctx := context.Background()
+
+	if err := deliverCallback(ctx, receiver.URL+"/hook?case=flaky", job); err != nil {
+		t.Fatalf("deliverCallback() error = %v", err)
+	}
+	if calls.Load() != 2 || got.ID != "job_1" || got.Result == nil || got.Result.Result != "done" {
+		t.Errorf("after %d calls the receiver got %+v, want the job on the second", calls.Load(), got)
+	}
+
+	// client errors and redirects are final
+	for _, c := range []string{"rejected", "redirect"} {
+		calls.Store(0)
+		if err := deliverCallback(ctx, receiver.URL+"/hook?case="+c, job); err == nil {
+			t.Errorf("deliverCallback() to a %s callback succeeded", c)
+		}
+		if calls.Load() != 1 {
+			t.Errorf("%s callback was called %d times, want 1", c, calls.Load())
+		}
+	}
+}
+
+func TestJobRunnerGet(t *testing.T) {
+	alice := &Identity{User: "alice", Tenant: "acme"}
+	jr := newJobRunner()
+	jr.jobs["job_a"] = &Job{ID: "job_a", Status: JobRunning, owner: alice}
+	jr.jobs["job_anon"] = &Job{ID: "job_anon", Status: JobQueued}
+
+	tests := []struct {
+		id     string
+		caller *Identity
+		want   bool
+	}{
+		{"job_a", &Identity{User: "alice", Tenant: "acme"}, true},
+		{"job_a", &Identity{User: "alice", Tenant: "other"}, false},
+		{"job_a", &Identity{User: "bob", Tenant: "acme"}, false},
+		{"job_a", nil, true},
+		{"job_anon", alice, false},
+		{"job_missing", nil, false},
+	}
+	for _, tt := range tests {
+		if _, ok := jr.get(tt.id, tt.caller); ok != tt.want {
+			t.Errorf("get(%s, %+v) = %v, want %v", tt.id, tt.caller, ok, tt.want)
+		}
+	}
+}
+
+func TestJobRunnerPrune(t *testing.T) {
+	old := time.Now().Add(-2 * jobRetention)
+	jr := newJobRunner()
+	jr.jobs["done"] = &Job{ID: "done", FinishedAt: &old}
+	jr.jobs["calling"] = &Job{ID: "calling", FinishedAt: &old, CallbackStatus: callbackPending}
+	jr.jobs["running"] = &Job{ID: "running"}
+	jr.prune()
+	if _, ok := jr.jobs["done"]; ok {
+		t.Error("prune() kept an expired job")
+	}
+	if len(jr.jobs) != 2 {
+		t.Errorf("prune() left %d jobs, want the running job and the pending callback", len(jr.jobs))
+	}
+}
+
+func TestNewJobID(t *testing.T) {
+	a, err := newJobID()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := newJobID()
+	if !regexp.MustCompile(`^job_[0-9a-f]{24}$`).MatchString(a) || a == b {
+		t.Errorf("newJobID() = %q, %q, want distinct job_ ids", a, b)
+	}
+	if sessionIDPattern.MatchString(a) {
+		t.Errorf("job id %q looks like a session id", a)
+	}
+}
+
+func TestCheckCallbackConfig(t *testing.T) {
+	t.Setenv("CALLBACK_HOSTS", "hooks.example.com")
+	t.Setenv("CALLBACK_SECRET", "")
+	if err := checkCallbackConfig(); err == nil {
+		t.Error("checkCallbackConfig() accepted CALLBACK_HOSTS without CALLBACK_SECRET")
+	}
+	t.Setenv("CALLBACK_SECRET", "s")
+	if err := checkCallbackConfig(); err != nil {
+		t.Errorf("checkCallbackConfig() error = %v", err)
+	}
+
+	for url, want := range map[string]ErrorCode{
+		"https://hooks.example.com/done": "",
+		"https://evil.example.com/done":  ErrForbidden,
+		"ftp://hooks.example.com/done":   ErrBadRequest,
+		"/done":                          ErrBadRequest,
+	} {
+		err := checkCallbackURL(Request{CallbackURL: &url})
+		var got ErrorCode
+		if coded, ok := err.(*codedError); ok {
+			got = coded.Code
+		}
+		if got != want {
+			t.Errorf("checkCallbackURL(%s) = %v, want %q", url, err, want)
+		}
+	}
+}
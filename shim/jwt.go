@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// jwtLeeway tolerates small clock differences when checking exp and nbf.
+const jwtLeeway = 30 * time.Second
+
+// jwtAuth verifies "Authorization: Bearer" tokens signed by a key from a local
+// JWKS file. The identity is taken from the sub, tenant and roles claims.
+type jwtAuth struct {
+	keys     map[string]crypto.PublicKey
+	issuer   string
+	audience string
+}
+
+// jwk is the subset of RFC 7517 fields needed for RSA and EC public keys.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func loadJWTAuth(path, issuer, audience string) (*jwtAuth, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jwks file: %w", err)
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("failed to parse jwks file %s: %w", path, err)
+	}
+
+	a := &jwtAuth{keys: map[string]crypto.PublicKey{}, issuer: issuer, audience: audience}
+	for _, k := range set.Keys {
+		pub, err := k.publicKey()
+		if err != nil {
+			return nil, fmt.Errorf("jwks file %s: key %q: %w", path, k.Kid, err)
+		}
+		a.keys[k.Kid] = pub
+	}
+	if len(a.keys) == 0 {
+		return nil, fmt.Errorf("jwks file %s has no keys", path)
+	}
+	return a, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid base64url value: %w", err)
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (a *jwtAuth) Authenticate(r authRequest) (*Identity, error) {
+	token, ok := strings.CutPrefix(r.Headers.Get("Authorization"), "Bearer ")
+	if !ok || token == "" {
+		return nil, errNoCredentials
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %w", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	if err := a.verify(header.Alg, header.Kid, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, err
+	}
+
+	var claims struct {
+		Sub    string          `json:"sub"`
+		Iss    string          `json:"iss"`
+		Aud    json.RawMessage `json:"aud"`
+		Exp    *float64        `json:"exp"`
+		Nbf    *float64        `json:"nbf"`
+		Tenant string          `json:"tenant"`
+		Roles  []string        `json:"roles"`
+	}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %w", err)
+	}
+
+	now := time.Now()
+	if claims.Exp == nil {
+		return nil, errors.New("token has no exp claim")
+	}
+	if now.After(time.Unix(int64(*claims.Exp), 0).Add(jwtLeeway)) {
+		return nil, errors.New("token expired")
+	}
+	if claims.Nbf != nil && now.Add(jwtLeeway).Before(time.Unix(int64(*claims.Nbf), 0)) {
+		return nil, errors.New("token not yet valid")
+	}
+	if a.issuer != "" && claims.Iss != a.issuer {
+		return nil, errors.New("token issuer not accepted")
+	}
+	if a.audience != "" && !audienceContains(claims.Aud, a.audience) {
+		return nil, errors.New("token audience not accepted")
+	}
+	if claims.Sub == "" {
+		return nil, errors.New("token has no sub claim")
+	}
+
+	return &Identity{User: claims.Sub, Tenant: claims.Tenant, Roles: claims.Roles, Method: "jwt"}, nil
+}
+
+// verify checks sig over signed with the key named by kid. Only asymmetric
+// algorithms are accepted, which rules out "none" and HMAC confusion.
+func (a *jwtAuth) verify(alg, kid string, signed, sig []byte) error {
+	key, ok := a.keys[kid]
+	if !ok {
+		return errors.New("unknown signing key")
+	}
+
+	var hash crypto.Hash
+	switch alg[min(2, len(alg)):] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported alg %q", alg)
+	}
+	h := hash.New()
+	h.Write(signed)
+	digest := h.Sum(nil)
+
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("alg %q does not match RSA key", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(pub, hash, digest, sig); err != nil {
+			return errors.New("invalid token signature")
+		}
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return fmt.Errorf("alg %q does not match EC key", alg)
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(sig) != 2*size {
+			return errors.New("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("invalid token signature")
+		}
+	default:
+		return errors.New("unsupported key")
+	}
+	return nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// audienceContains handles aud being either a single string or a list.
+func audienceContains(raw json.RawMessage, want string) bool {
+	var one string
+	if err := json.Unmarshal(raw, &one); err == nil {
+		return one == want
+	}
+	var many []string
+	if err := json.Unmarshal(raw, &many); err == nil {
+		return slices.Contains(many, want)
+	}
+	return false
+}
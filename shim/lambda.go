@@ -0,0 +1,117 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// httpEvent holds the fields shared by API Gateway (REST and HTTP API) and
+// Lambda Function URL events, which wrap the Request JSON in an HTTP envelope.
+type httpEvent struct {
+	Headers         map[string]string `json:"headers"`
+	Body            string            `json:"body"`
+	IsBase64Encoded bool              `json:"isBase64Encoded"`
+	RequestContext  json.RawMessage   `json:"requestContext"`
+	// REST API events
+	HTTPMethod      string              `json:"httpMethod"`
+	Path            string              `json:"path"`
+	MultiValueQuery map[string][]string `json:"multiValueQueryStringParameters"`
+	// HTTP API and Function URL events
+	RawPath  string `json:"rawPath"`
+	RawQuery string `json:"rawQueryString"`
+}
+
+// authRequest describes the request the client sent, whichever event format
+// it is. The path is the one that was sent, including any stage or base path
+// mapping, and the query keeps every value of a repeated name, so HMAC
+// signatures are checked against what the client signed.
+func (ev httpEvent) authRequest(body []byte) authRequest {
+	r := authRequest{Headers: http.Header{}, Body: body}
+	for k, v := range ev.Headers {
+		r.Headers.Set(k, v)
+	}
+	var rc struct {
+		Path string `json:"path"`
+		HTTP struct {
+			Method string `json:"method"`
+		} `json:"http"`
+	}
+	_ = json.Unmarshal(ev.RequestContext, &rc)
+	if ev.HTTPMethod != "" {
+		// a REST API event's own path lacks the stage
+		r.Method, r.Path, r.Query = ev.HTTPMethod, cmp.Or(rc.Path, ev.Path), url.Values(ev.MultiValueQuery)
+	} else {
+		r.Method, r.Path = rc.HTTP.Method, ev.RawPath
+		r.Query, _ = url.ParseQuery(ev.RawQuery)
+	}
+	return r
+}
+
+// lambdaHandler accepts either a Request invoked directly or an HTTP event
+// from API Gateway or a Function URL. HTTP events are authenticated from their
+// headers; direct invocations carry no credentials and are refused when
+// authentication is enabled. Calls to the usage and session management APIs
+// are served by usageAPI and sessionAPI, streaming requests with a Lambda response stream and
+// everything else with the buffered handler.
+func lambdaHandler(ctx context.Context, payload json.RawMessage) (any, error) {
+	var req Request
+	var ev httpEvent
+	if err := json.Unmarshal(payload, &ev); err == nil && len(ev.RequestContext) > 0 {
+		body := []byte(ev.Body)
+		if ev.IsBase64Encoded {
+			if body, err = base64.StdEncoding.DecodeString(ev.Body); err != nil {
+				return errorResponse(ErrBadRequest, "invalid base64 body").ProxyResponse(), nil
+			}
+		}
+		auth := ev.authRequest(body)
+		if strings.Contains(auth.Path, jobsPath) {
+			return errorResponse(ErrBadRequest, "jobs require the HTTP server; invoke the function asynchronously with a callback_url instead").ProxyResponse(), nil
+		}
+		if strings.Contains(auth.Path, usagePath) {
+			// without authentication anyone could see everyone's spending
+			if authenticator == nil {
+				return errorResponse(ErrNotFound, "the usage API requires authentication").ProxyResponse(), nil
+			}
+			caller, err := authenticateCaller(auth)
+			if err != nil {
+				return errorResponseFrom(err).ProxyResponse(), nil
+			}
+			return usageAPI(ctx, caller, auth.Method, auth.Query), nil
+		}
+		if strings.Contains(auth.Path, sessionsPath) {
+			// without authentication anyone could read and delete every session
+			if authenticator == nil {
+				return errorResponse(ErrNotFound, "the session API requires authentication").ProxyResponse(), nil
+			}
+			// the path may carry a stage or mapping prefix before the API's own,
+			// which sessionAPI does not expect
+			path := auth.Path[strings.Index(auth.Path, sessionsPath):]
+			caller, err := authenticateCaller(auth)
+			if err != nil {
+				return errorResponseFrom(err).ProxyResponse(), nil
+			}
+			return sessionAPI(ctx, caller, auth.Method, path), nil
+		}
+		if req, err = authenticateRequest(auth); err != nil {
+			return errorResponseFrom(err).ProxyResponse(), nil
+		}
+	} else {
+		if authenticator != nil {
+			return errorResponse(ErrUnauthorized, "direct invocations are not accepted when authentication is enabled").ProxyResponse(), nil
+		}
+		if err := json.Unmarshal(payload, &req); err != nil {
+			return errorResponse(ErrBadRequest, fmt.Sprintf("invalid json: %v", err)).ProxyResponse(), nil
+		}
+	}
+
+	if req.Stream {
+		return lambdaStream(ctx, req), nil
+	}
+	return handler(ctx, req)
+}
@@ -2,42 +2,84 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 )
 
 type Request struct {
-	Prompt             json.RawMessage   `json:"prompt"`
-	AppendSystemPrompt *string           `json:"append_system_prompt"`
-	AllowedTools       []string          `json:"allowed_tools"`
-	DisallowedTools    []string          `json:"disallowed_tools"`
-	ResumeSessionID    *string           `json:"resume_session_id"`
-	Env                map[string]string `json:"env"`
-	User               json.RawMessage   `json:"user,omitempty"` // Optional user field
-}
+	Prompt               json.RawMessage   `json:"prompt"`
+	AppendSystemPrompt   *string           `json:"append_system_prompt"`
+	AllowedTools         []string          `json:"allowed_tools"`
+	DisallowedTools      []string          `json:"disallowed_tools"`
+	ResumeSessionID      *string           `json:"resume_session_id"`
+	Env                  map[string]string `json:"env"`
+	User                 json.RawMessage   `json:"user,omitempty"` // Optional user field
+	Stream               bool              `json:"stream,omitempty"`
+	TimeoutSeconds       *int              `json:"timeout_seconds,omitempty"`
+	PermissionWebhookURL *string           `json:"permission_webhook_url,omitempty"` // Receives permission prompts in delegate mode
+	Model                *string           `json:"model,omitempty"`                  // Must be in ALLOWED_MODELS
+	MaxTurns             *int              `json:"max_turns,omitempty"`              // Bounded by MAX_TURNS_LIMIT
+	SystemPromptID       *string           `json:"system_prompt_id,omitempty"`       // File in SYSTEM_PROMPTS_DIR
+	Agent                *string           `json:"agent,omitempty"`                  // Profile in AGENTS_DIR
+	IdempotencyKey       *string           `json:"idempotency_key,omitempty"`        // Replays the first result for retries
+	CallbackURL          *string           `json:"callback_url,omitempty"`           // Receives the finished job, host must be in CALLBACK_HOSTS
 
-func buildArgs(r Request) []string {
-	if len(r.Prompt) == 0 {
-		log.Fatal("prompt is required")
-	}
+	// identity is the verified caller, set only by authenticateRequest.
+	identity *Identity
+	// deniedTools are requested tools removed by the tool policy.
+	deniedTools []string
+	// systemPrompt is the prompt resolved from SystemPromptID.
+	systemPrompt string
+	// profile is the selected agent profile, if the agent has one.
+	profile *AgentProfile
+	// fingerprint identifies the request as sent, for its idempotency key.
+	fingerprint string
+	// replay is the stored response of an earlier run with the same
+	// idempotency key, which is returned instead of running again.
+	replay *events.APIGatewayProxyResponse
+	// budgetTurns lowers the turn limit to what the remaining budget affords.
+	budgetTurns int
+	// rateLimit is the tightest rate limit bucket the request drew from.
+	rateLimit *rateDecision
+}
 
+// buildArgs translates a validated request into CLI arguments. prompt is the
+// plain text prompt, or empty when the prompt is fed on stdin as stream-json.
+func buildArgs(r Request, prompt string) []string {
+	// The event stream is always read, even for buffered requests, so that an
+	// interrupted run can still report its session id. stream-json output is
+	// only emitted in print mode with --verbose.
 	args := []string{
-		"--output-format=json",
-		"--dangerously-skip-permissions",
-		"-p", fmt.Sprintf(`"%s"`, string(r.Prompt)),
+		"-p",
+		"--output-format=stream-json",
+		"--verbose",
 	}
+	if prompt == "" {
+		args = append(args, "--input-format=stream-json")
+	}
+	if config := mcpConfig(r); config != "" {
+		args = append(args, "--mcp-config", config)
+	}
+	args = append(args, permissionArgs(r)...)
 
 	if r.AppendSystemPrompt != nil {
 		args = append(args, "--append-system-prompt", *r.AppendSystemPrompt)
 	}
-	if len(r.AllowedTools) > 0 {
+	// In delegate mode the allowed tools bound the permission server instead:
+	// the CLI would run anything in --allowedTools without asking it.
+	if len(r.AllowedTools) > 0 && permissionMode != permissionDelegate {
 		args = append(args, "--allowedTools", strings.Join(r.AllowedTools, ","))
 	}
 
@@ -48,95 +90,330 @@ func buildArgs(r Request) []string {
 	if r.ResumeSessionID != nil {
 		args = append(args, "--resume", *r.ResumeSessionID)
 	}
-	if maxTurns := os.Getenv("MAX_TURNS"); maxTurns != "" {
-		args = append(args, "--max-turns", maxTurns)
+	if turns, ok := maxTurns(r); ok {
+		args = append(args, "--max-turns", strconv.Itoa(turns))
 	}
-	if model := os.Getenv("MODEL"); model != "" {
+	if r.Model != nil {
+		args = append(args, "--model", *r.Model)
+	} else if r.profile != nil && r.profile.Model != "" {
+		args = append(args, "--model", r.profile.Model)
+	} else if model := os.Getenv("MODEL"); model != "" {
 		args = append(args, "--model", model)
 	}
-	if sysPrompt := os.Getenv("SYSTEM_PROMPT"); sysPrompt != "" {
+	if r.systemPrompt != "" {
+		args = append(args, "--system-prompt", r.systemPrompt)
+	} else if r.profile != nil && r.profile.SystemPrompt != "" {
+		args = append(args, "--system-prompt", r.profile.SystemPrompt)
+	} else if sysPrompt := os.Getenv("SYSTEM_PROMPT"); sysPrompt != "" {
 		args = append(args, "--system-prompt", sysPrompt)
 	}
+	if prompt != "" {
+		// passed verbatim after "--" so a prompt starting with "-" is not
+		// mistaken for a flag
+		args = append(args, "--", prompt)
+	}
 	return args
 }
 
-func runClaude(r Request) (string, string, error) {
-	args := buildArgs(r)
+// claudeCommand prepares the CLI invocation for a validated request without
+// starting it. The agent and everything it spawns are stopped when ctx is done.
+func claudeCommand(ctx context.Context, r Request) (*exec.Cmd, error) {
+	prompt, blocks, err := parsePrompt(r.Prompt)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.CommandContext(ctx, "claude", buildArgs(r, prompt)...)
+	setProcessGroup(cmd)
+	cmd.Dir = runDir(r)
+	if err := os.MkdirAll(cmd.Dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create workspace: %w", err)
+	}
 
-	cmd := exec.Command("claude", args...)
+	if blocks != nil {
+		input, err := streamJSONInput(blocks)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Stdin = bytes.NewReader(input)
+	}
 
 	env := os.Environ()
 	if apiKey := os.Getenv("ANTHROPIC_API_KEY"); apiKey != "" {
 		env = append(env, "ANTHROPIC_API_KEY="+apiKey)
 	}
+	// the request's env is appended last so it wins over the profile defaults
+	if r.profile != nil {
+		for k, v := range r.profile.Env {
+			env = append(env, fmt.Sprintf("%s=%s", k, v))
+		}
+	}
 	for k, v := range r.Env {
 		env = append(env, fmt.Sprintf("%s=%s", k, v))
 	}
 	cmd.Env = env
+	return cmd, nil
+}
 
-	var out bytes.Buffer
-	var stderr bytes.Buffer
-	cmd.Stdout = &out
-	cmd.Stderr = &stderr
+// runClaude runs the agent to completion and returns its result.
+func runClaude(ctx context.Context, r Request) Response {
+	var run runState
+	err := streamClaude(ctx, r, run.observe)
+	return run.response(ctx, err)
+}
 
-	err := cmd.Run()
-	return out.String(), stderr.String(), err
+// prepare validates r and applies operator policy to it before anything is
+// run. Errors carry the code they should be reported with.
+func prepare(r *Request) error {
+	if err := r.Validate(); err != nil {
+		return &codedError{Code: ErrBadRequest, Message: err.Error()}
+	}
+	if err := checkIdempotencyKey(*r); err != nil {
+		return err
+	}
+	if err := checkIdempotentReplay(r); err != nil || r.replay != nil {
+		return err
+	}
+	if err := checkRateLimit(r); err != nil {
+		return err
+	}
+	if err := selectAgent(r); err != nil {
+		return err
+	}
+	if err := checkPermissionWebhook(*r); err != nil {
+		return err
+	}
+	if err := checkCallbackURL(*r); err != nil {
+		return err
+	}
+	if err := checkSessionOwner(*r); err != nil {
+		return err
+	}
+	if err := applyOverrides(r); err != nil {
+		return err
+	}
+	if err := checkBudget(r); err != nil {
+		return err
+	}
+	if r.profile != nil && r.profile.Tools != nil {
+		profilePolicy := &ToolPolicy{Agents: map[string]toolLimit{r.agentName(): *r.profile.Tools}}
+		if err := profilePolicy.Apply(r); err != nil {
+			return err
+		}
+	}
+	if toolPolicy != nil {
+		if err := toolPolicy.Apply(r); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func handler(r Request) (events.APIGatewayProxyResponse, error) {
-	stdOut, stdErr, err := runClaude(r)
-	statusCode := 200
-	body := stdOut
+// handler prepares and runs a buffered request. A request with a callback_url
+// also has its result posted there once the run has finished.
+func handler(ctx context.Context, r Request) (events.APIGatewayProxyResponse, error) {
+	if err := prepare(&r); err != nil {
+		return prepareError(r, err), nil
+	}
+	if r.replay != nil {
+		return *r.replay, nil
+	}
+	release, err := runPool.acquire(ctx)
 	if err != nil {
-		statusCode = 400
-		if stdErr != "" {
-			body = stdErr
+		return withHeaders(runPool.rejection(err), rateLimitHeaders(r)), nil
+	}
+	started := time.Now()
+	resp := execute(ctx, r)
+	// the callback may retry for minutes without needing a worker
+	release()
+	if r.CallbackURL != nil {
+		job := callbackJob(ctx, started, resp)
+		if err := deliverCallback(ctx, *r.CallbackURL, job); err != nil {
+			log.Printf("callback for %s failed: %v", job.ID, err)
 		}
 	}
-	return events.APIGatewayProxyResponse{
-		StatusCode: statusCode,
-		Body:       body,
-	}, nil
+	return withHeaders(resp, rateLimitHeaders(r)), nil
 }
 
-func fsShim() {
+// prepareError builds the response for a request prepare refused.
+func prepareError(r Request, err error) events.APIGatewayProxyResponse {
+	resp := errorResponseFrom(err)
+	resp.DeniedTools = r.deniedTools
+	return withHeaders(resp.ProxyResponse(), rateLimitHeaders(r))
+}
+
+// withHeaders adds headers to resp.
+func withHeaders(resp events.APIGatewayProxyResponse, headers map[string]string) events.APIGatewayProxyResponse {
+	if len(headers) == 0 {
+		return resp
+	}
+	if resp.Headers == nil {
+		resp.Headers = map[string]string{}
+	}
+	for k, v := range headers {
+		resp.Headers[k] = v
+	}
+	return resp
+}
+
+// execute runs a prepared request within its time budget, shared by the
+// buffered handler and background jobs.
+func execute(ctx context.Context, r Request) events.APIGatewayProxyResponse {
+	if r.replay != nil {
+		return *r.replay
+	}
+	ctx, cancel := withRunTimeout(ctx, r)
+	defer cancel()
+	run := func() events.APIGatewayProxyResponse {
+		resp := runClaude(ctx, r)
+		resp.DeniedTools = r.deniedTools
+		return resp.ProxyResponse()
+	}
+	if r.IdempotencyKey != nil {
+		return runIdempotent(ctx, r, run)
+	}
+	return run()
+}
+
+// fsShim links the mounted state directory into the CLI's config directory.
+// It is safe to run more than once, e.g. after entrypoint.sh already did it.
+func fsShim() error {
 	// check if /mnt/state exists
 	if _, err := os.Stat("/mnt/state"); os.IsNotExist(err) {
 		log.Println("fs-shim: /mnt/state does not exist, please mount it")
-		return
+		return nil
 	}
-	// check if /mnt/state/projects exists
-	if _, err := os.Stat("/mnt/state/projects"); os.IsNotExist(err) {
-		// create /mnt/state/projects
-		if err := os.MkdirAll("/mnt/state/projects", 0o755); err != nil {
-			log.Fatalf("failed to create /mnt/state/projects: %v", err)
-		}
+	// create /mnt/state/projects if it doesn't exist
+	if err := os.MkdirAll("/mnt/state/projects", 0o755); err != nil {
+		return fmt.Errorf("failed to create /mnt/state/projects: %w", err)
 	}
 	// symlink /mnt/state/projects to /root/.claude/projects
-	if err := os.Symlink("/mnt/state/projects", "/root/.claude/projects"); err != nil {
-		log.Fatalf("failed to create symlink: %v", err)
+	if err := ensureSymlink("/mnt/state/projects", "/root/.claude/projects"); err != nil {
+		return err
 	}
 	// check if /mnt/state/__store.db exists
 	if _, err := os.Stat("/mnt/state/__store.db"); os.IsNotExist(err) {
 		// create an empty sqlite db at __store.db
-		if _, err := os.Create("/mnt/state/__store.db"); err != nil {
-			log.Fatalf("failed to create __store.db: %v", err)
+		f, err := os.Create("/mnt/state/__store.db")
+		if err != nil {
+			return fmt.Errorf("failed to create __store.db: %w", err)
 		}
+		f.Close()
 	}
 	// symlink /mnt/state/__store.db to /root/.claude/__store.db
-	if err := os.Symlink("/mnt/state/__store.db", "/root/.claude/__store.db"); err != nil {
-		log.Fatalf("failed to create symlink: %v", err)
+	return ensureSymlink("/mnt/state/__store.db", "/root/.claude/__store.db")
+}
+
+// ensureSymlink creates link pointing at target unless it already does.
+func ensureSymlink(target, link string) error {
+	if existing, err := os.Readlink(link); err == nil && existing == target {
+		return nil
+	}
+	if err := os.Symlink(target, link); err != nil {
+		return fmt.Errorf("failed to create symlink %s -> %s: %w", link, target, err)
 	}
+	return nil
 }
 
 func main() {
+	// the CLI starts the shim as its permission prompt tool in delegate mode
+	if len(os.Args) > 1 && os.Args[1] == "permission-server" {
+		if err := runPermissionServer(); err != nil {
+			log.Fatalf("permission server: %v", err)
+		}
+		return
+	}
+
+	var err error
+	if authenticator, err = loadAuthenticator(); err != nil {
+		log.Fatalf("failed to load authenticators: %v", err)
+	}
+	if requestEnvPolicy, err = loadEnvPolicy(); err != nil {
+		log.Fatalf("failed to load env policy: %v", err)
+	}
+	if toolPolicy, err = loadToolPolicy(); err != nil {
+		log.Fatalf("failed to load tool policy: %v", err)
+	}
+	if defaultMaxTurns, maxTurnsCeiling, err = loadMaxTurns(); err != nil {
+		log.Fatalf("failed to load turn limits: %v", err)
+	}
+	if runTimeout, err = loadRunTimeout(); err != nil {
+		log.Fatalf("failed to load timeout: %v", err)
+	}
+	if permissionMode, err = loadPermissionMode(); err != nil {
+		log.Fatalf("failed to load permission mode: %v", err)
+	}
+	if err := checkCallbackConfig(); err != nil {
+		log.Fatalf("failed to load callback settings: %v", err)
+	}
+	if callbackAttempts, err = loadCallbackAttempts(); err != nil {
+		log.Fatalf("failed to load callback settings: %v", err)
+	}
+	if jobRetention, err = loadJobRetention(); err != nil {
+		log.Fatalf("failed to load job settings: %v", err)
+	}
+	if agentProfiles, err = loadAgentProfiles(); err != nil {
+		log.Fatalf("failed to load agent profiles: %v", err)
+	}
+	if err := checkToolPolicyMode(permissionMode, toolPolicy, agentProfiles); err != nil {
+		log.Fatalf("failed to load tool policy: %v", err)
+	}
+	if err := checkWorkspaceMode(permissionMode); err != nil {
+		log.Fatalf("failed to load workspaces: %v", err)
+	}
+	if sessionStore, err = loadSessionStore(); err != nil {
+		log.Fatalf("failed to open session store: %v", err)
+	}
+	if sessionStore == nil {
+		if localSessions, err = loadLocalSessions(); err != nil {
+			log.Fatalf("failed to open local session metadata: %v", err)
+		}
+	}
+	if idempotencyStore, err = loadIdempotencyStore(); err != nil {
+		log.Fatalf("failed to open idempotency store: %v", err)
+	}
+	if idempotencyTTL, err = loadIdempotencyTTL(); err != nil {
+		log.Fatalf("failed to load idempotency settings: %v", err)
+	}
+	if usageLedger, err = loadUsageLedger(); err != nil {
+		log.Fatalf("failed to open usage ledger: %v", err)
+	}
+	if budgetPolicy, err = loadBudgetPolicy(); err != nil {
+		log.Fatalf("failed to load budgets: %v", err)
+	}
+	if rateLimitPolicy, rateLimiter, err = loadRateLimits(); err != nil {
+		log.Fatalf("failed to load rate limits: %v", err)
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "sessions" {
+		if err := runSessionsCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "usage" {
+		if err := runUsageCommand(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if os.Getenv("LAMBDA") == "true" {
-		lambda.Start(handler)
+		lambda.Start(lambdaHandler)
 		return
 	}
 
 	if os.Getenv("FS_SHIM") != "" {
-		fsShim()
+		if err := fsShim(); err != nil {
+			log.Printf("fs-shim: %v", err)
+		}
+	}
+
+	if addr := os.Getenv("HTTP_ADDR"); addr != "" {
+		if err := serveHTTP(addr); err != nil {
+			log.Fatalf("http server: %v", err)
+		}
+		return
 	}
 
 	if len(os.Args) < 2 {
@@ -146,15 +423,29 @@ func main() {
 	if err := json.Unmarshal([]byte(os.Args[1]), &req); err != nil {
 		log.Fatalf("invalid json: %v", err)
 	}
-	resp, err := handler(req)
-	if err != nil {
-		resp = events.APIGatewayProxyResponse{
-			StatusCode: 500,
-			Body:       err.Error(),
+
+	// stop the agent cleanly if the container is stopped mid-run
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if req.Stream {
+		if err := prepare(&req); err != nil {
+			printJSON(prepareError(req, err))
+			return
 		}
+		streamSSE(ctx, req, os.Stdout, nil)
+		return
 	}
+	resp, err := handler(ctx, req)
+	if err != nil {
+		resp = errorResponse(ErrCLICrashed, err.Error()).ProxyResponse()
+	}
+	printJSON(resp)
+}
 
-	output, err := json.MarshalIndent(resp, "", "  ")
+// printJSON writes v to stdout as indented JSON for CLI mode.
+func printJSON(v any) {
+	output, err := json.MarshalIndent(v, "", "  ")
 	if err != nil {
 		log.Fatalf("failed to marshal response: %v", err)
 	}
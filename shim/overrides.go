@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// promptIDPattern keeps system_prompt_id to a plain file name.
+var promptIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// applyOverrides checks the request's model, max_turns and system_prompt_id
+// against the operator's bounds and resolves the system prompt text:
+//
+//   - model must be listed in ALLOWED_MODELS
+//   - max_turns may not exceed MAX_TURNS_LIMIT, or MAX_TURNS when no limit is
+//     set, nor the agent profile's budget
+//   - timeout_seconds may not exceed the agent profile's budget
+//   - system_prompt_id names a file <id>.txt or <id>.md in SYSTEM_PROMPTS_DIR
+func applyOverrides(r *Request) error {
+	if r.Model != nil && !slices.Contains(splitList(os.Getenv("ALLOWED_MODELS")), *r.Model) {
+		return &codedError{Code: ErrForbidden, Message: fmt.Sprintf("model %q is not allowed", *r.Model)}
+	}
+
+	if r.MaxTurns != nil {
+		if limit, ok := maxTurnsLimit(*r); ok && *r.MaxTurns > limit {
+			return &codedError{Code: ErrForbidden, Message: fmt.Sprintf("max_turns may not exceed %d", limit)}
+		}
+	}
+	if r.TimeoutSeconds != nil && r.profile != nil {
+		if limit := r.profile.Budget.TimeoutSeconds; limit > 0 && *r.TimeoutSeconds > limit {
+			return &codedError{Code: ErrForbidden, Message: fmt.Sprintf("timeout_seconds may not exceed %d", limit)}
+		}
+	}
+
+	if r.SystemPromptID != nil {
+		prompt, err := loadSystemPrompt(*r.SystemPromptID)
+		if err != nil {
+			return err
+		}
+		r.systemPrompt = prompt
+	}
+	return nil
+}
+
+// Turn limits from the environment, 0 when unset.
+var (
+	// defaultMaxTurns is MAX_TURNS, the turn limit of requests without one.
+	defaultMaxTurns int
+	// maxTurnsCeiling is MAX_TURNS_LIMIT, the most turns a request may ask for.
+	maxTurnsCeiling int
+)
+
+// loadMaxTurns reads MAX_TURNS and MAX_TURNS_LIMIT.
+func loadMaxTurns() (defaultTurns, ceiling int, err error) {
+	for _, setting := range []struct {
+		key string
+		n   *int
+	}{{"MAX_TURNS", &defaultTurns}, {"MAX_TURNS_LIMIT", &ceiling}} {
+		v := os.Getenv(setting.key)
+		if v == "" {
+			continue
+		}
+		if *setting.n, err = strconv.Atoi(v); err != nil || *setting.n <= 0 {
+			return 0, 0, fmt.Errorf("%s must be a positive number, got %q", setting.key, v)
+		}
+	}
+	return defaultTurns, ceiling, nil
+}
+
+// maxTurnsLimit is the ceiling for r's max_turns, if there is one.
+func maxTurnsLimit(r Request) (int, bool) {
+	limit, ok := 0, false
+	if maxTurnsCeiling > 0 {
+		limit, ok = maxTurnsCeiling, true
+	} else if defaultMaxTurns > 0 {
+		limit, ok = defaultMaxTurns, true
+	}
+	if r.profile != nil && r.profile.Budget.MaxTurns > 0 && (!ok || r.profile.Budget.MaxTurns < limit) {
+		limit, ok = r.profile.Budget.MaxTurns, true
+	}
+	return limit, ok
+}
+
+// maxTurns is the turn limit of a run of r: its own max_turns, else its
+// profile's, else MAX_TURNS, lowered to what its remaining budget affords.
+func maxTurns(r Request) (int, bool) {
+	turns, ok := 0, false
+	if r.MaxTurns != nil {
+		turns, ok = *r.MaxTurns, true
+	} else if r.profile != nil && r.profile.Budget.MaxTurns > 0 {
+		turns, ok = r.profile.Budget.MaxTurns, true
+	} else if defaultMaxTurns > 0 {
+		turns, ok = defaultMaxTurns, true
+	}
+	if r.budgetTurns > 0 && (!ok || r.budgetTurns < turns) {
+		turns, ok = r.budgetTurns, true
+	}
+	return turns, ok
+}
+
+// loadSystemPrompt reads an operator-provided system prompt by id.
+func loadSystemPrompt(id string) (string, error) {
+	dir := os.Getenv("SYSTEM_PROMPTS_DIR")
+	if dir == "" {
+		return "", &codedError{Code: ErrForbidden, Message: "system_prompt_id is not enabled"}
+	}
+	for _, ext := range []string{".txt", ".md"} {
+		data, err := os.ReadFile(filepath.Join(dir, id+ext))
+		if err == nil {
+			return strings.TrimSpace(string(data)), nil
+		}
+		if !os.IsNotExist(err) {
+			return "", fmt.Errorf("failed to read system prompt %q: %w", id, err)
+		}
+	}
+	return "", &codedError{Code: ErrBadRequest, Message: fmt.Sprintf("unknown system_prompt_id %q", id)}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadMaxTurns(t *testing.T) {
+	tests := []struct {
+		maxTurns, limit       string
+		wantDefault, wantCeil int
+		wantErr               bool
+	}{
+		{"", "", 0, 0, false},
+		{"10", "", 10, 0, false},
+		{"10", "50", 10, 50, false},
+		{"", "50", 0, 50, false},
+		{"ten", "", 0, 0, true},
+		{"0", "", 0, 0, true},
+		{"10", "-5", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("MAX_TURNS", tt.maxTurns)
+		t.Setenv("MAX_TURNS_LIMIT", tt.limit)
+		def, ceil, err := loadMaxTurns()
+		if (err != nil) != tt.wantErr || def != tt.wantDefault || ceil != tt.wantCeil {
+			t.Errorf("loadMaxTurns() with MAX_TURNS=%q MAX_TURNS_LIMIT=%q = %d, %d, %v",
+				tt.maxTurns, tt.limit, def, ceil, err)
+		}
+	}
+}
+
+func TestApplyOverrides(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "gardener.md"), []byte("  You tend the garden.\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SYSTEM_PROMPTS_DIR", dir)
+	t.Setenv("ALLOWED_MODELS", "claude-sonnet-4, claude-3-5-haiku")
+	defaultMaxTurns, maxTurnsCeiling = 10, 25
+	t.Cleanup(func() { defaultMaxTurns, maxTurnsCeiling = 0, 0 })
+
+	str := func(s string) *string { return &s }
+	turns := func(n int) *int { return &n }
+	tests := []struct {
+		name       string
+		req        Request
+		wantCode   ErrorCode
+		wantPrompt string
+	}{
+		{name: "no overrides", req: Request{}},
+		{name: "allowed model", req: Request{Model: str("claude-3-5-haiku")}},
+		{name: "other model", req: Request{Model: str("claude-opus-4")}, wantCode: ErrForbidden},
+		{name: "turns above the default", req: Request{MaxTurns: turns(25)}},
+		{name: "turns above the ceiling", req: Request{MaxTurns: turns(26)}, wantCode: ErrForbidden},
+		{name: "system prompt", req: Request{SystemPromptID: str("gardener")}, wantPrompt: "You tend the garden."},
+		{name: "unknown system prompt", req: Request{SystemPromptID: str("pirate")}, wantCode: ErrBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := tt.req
+			err := applyOverrides(&r)
+			var coded *codedError
+			switch {
+			case tt.wantCode == "" && err != nil:
+				t.Fatalf("applyOverrides() error = %v", err)
+			case tt.wantCode != "" && (!errors.As(err, &coded) || coded.Code != tt.wantCode):
+				t.Fatalf("applyOverrides() error = %v, want %s", err, tt.wantCode)
+			}
+			if r.systemPrompt != tt.wantPrompt {
+				t.Errorf("system prompt = %q, want %q", r.systemPrompt, tt.wantPrompt)
+			}
+		})
+	}
+
+	// without MAX_TURNS_LIMIT, MAX_TURNS is the ceiling too
+	maxTurnsCeiling = 0
+	if err := applyOverrides(&Request{MaxTurns: turns(11)}); err == nil {
+		t.Error("applyOverrides() allowed max_turns above MAX_TURNS")
+	}
+}
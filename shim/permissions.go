@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"gopkg.in/yaml.v3"
+)
+
+// Permission modes selected by PERMISSION_MODE.
+const (
+	// permissionSkip runs the agent with --dangerously-skip-permissions.
+	permissionSkip = "skip"
+	// permissionAllowlist lets the agent use only its allowed tools; anything
+	// that would need a prompt is denied by the CLI.
+	permissionAllowlist = "allowlist"
+	// permissionDelegate routes every permission prompt to the shim's own
+	// permission MCP server, which consults a rules file and/or a webhook.
+	permissionDelegate = "delegate"
+)
+
+const (
+	permissionServerName = "shim-permissions"
+	permissionToolName   = "approve"
+	// defaultPermissionTimeout leaves time for a human to answer a webhook.
+	defaultPermissionTimeout = 5 * time.Minute
+)
+
+// permissionMode is the configured mode, loaded at startup.
+var permissionMode = permissionSkip
+
+// loadPermissionMode reads PERMISSION_MODE, defaulting to skip.
+func loadPermissionMode() (string, error) {
+	switch mode := os.Getenv("PERMISSION_MODE"); mode {
+	case "":
+		return permissionSkip, nil
+	case permissionSkip, permissionAllowlist, permissionDelegate:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown PERMISSION_MODE %q", mode)
+	}
+}
+
+// permissionArgs returns the CLI flags implementing the permission mode for r.
+// In delegate mode the shim's permission server, registered through
+// mcpConfig, is named as the permission prompt tool.
+func permissionArgs(r Request) []string {
+	switch permissionMode {
+	case permissionAllowlist:
+		return nil
+	case permissionDelegate:
+		return []string{"--permission-prompt-tool", "mcp__" + permissionServerName + "__" + permissionToolName}
+	default:
+		return []string{"--dangerously-skip-permissions"}
+	}
+}
+
+// permissionServerConfig is the MCP server config that runs the shim binary itself
+// as the permission server in delegate mode, or nil in any other mode.
+// Per-request settings reach it through the server's environment.
+func permissionServerConfig(r Request) map[string]any {
+	if permissionMode != permissionDelegate {
+		return nil
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		exe = "shim"
+	}
+	env := map[string]string{}
+	if webhook := permissionWebhookURL(r); webhook != "" {
+		env["SHIM_PERMISSION_WEBHOOK_URL"] = webhook
+	}
+	if len(r.User) > 0 {
+		env["SHIM_PERMISSION_USER"] = string(r.User)
+	}
+	if len(r.AllowedTools) > 0 {
+		if allowed, err := json.Marshal(r.AllowedTools); err == nil {
+			env["SHIM_PERMISSION_ALLOWED_TOOLS"] = string(allowed)
+		}
+	}
+	return map[string]any{
+		"command": exe,
+		"args":    []string{"permission-server"},
+		"env":     env,
+	}
+}
+
+// permissionWebhookURL is the caller's webhook if given, else the operator's.
+func permissionWebhookURL(r Request) string {
+	if r.PermissionWebhookURL != nil {
+		return *r.PermissionWebhookURL
+	}
+	return os.Getenv("PERMISSION_WEBHOOK_URL")
+}
+
+// checkPermissionWebhook refuses a caller-supplied webhook unless the shim
+// delegates permissions and its host is in PERMISSION_WEBHOOK_HOSTS, so the
+// field cannot be used to make the shim call arbitrary hosts.
+func checkPermissionWebhook(r Request) error {
+	if r.PermissionWebhookURL == nil {
+		return nil
+	}
+	if permissionMode != permissionDelegate {
+		return &codedError{Code: ErrBadRequest, Message: "permission_webhook_url requires PERMISSION_MODE=delegate"}
+	}
+	u, err := url.Parse(*r.PermissionWebhookURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return &codedError{Code: ErrBadRequest, Message: "permission_webhook_url must be an absolute http(s) url"}
+	}
+	if !matchAny(splitList(os.Getenv("PERMISSION_WEBHOOK_HOSTS")), u.Hostname()) {
+		return &codedError{Code: ErrForbidden, Message: fmt.Sprintf("permission webhook host %q is not allowed", u.Hostname())}
+	}
+	return nil
+}
+
+// permissionRule decides prompts for tools matching Tool and, if set, whose
+// input fields match every glob in Input. In these globs * matches anything,
+// including "/".
+type permissionRule struct {
+	Tool     string            `yaml:"tool"`
+	Input    map[string]string `yaml:"input"`
+	Decision string            `yaml:"decision"`
+	Message  string            `yaml:"message"`
+}
+
+// permissionRules is the PERMISSION_RULES_FILE format. The first matching
+// rule wins; Default applies when none match.
+type permissionRules struct {
+	Rules   []permissionRule `yaml:"rules"`
+	Default string           `yaml:"default"`
+}
+
+// Permission decisions a rule can make.
+const (
+	decisionAllow = "allow"
+	decisionDeny  = "deny"
+	decisionAsk   = "ask"
+)
+
+func loadPermissionRules(file string) (*permissionRules, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read permission rules: %w", err)
+	}
+	var rules permissionRules
+	if err := yaml.Unmarshal(data, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse permission rules %s: %w", file, err)
+	}
+	for i, rule := range rules.Rules {
+		switch rule.Decision {
+		case decisionAllow, decisionDeny, decisionAsk:
+		default:
+			return nil, fmt.Errorf("permission rule %d: unknown decision %q", i, rule.Decision)
+		}
+	}
+	switch rules.Default {
+	case "", decisionAllow, decisionDeny, decisionAsk:
+	default:
+		return nil, fmt.Errorf("permission rules: unknown default decision %q", rules.Default)
+	}
+	return &rules, nil
+}
+
+// decide returns the decision for a tool call and the message of the rule
+// that made it.
+func (p *permissionRules) decide(tool string, input map[string]any) (string, string) {
+	for _, rule := range p.Rules {
+		if !globMatch(rule.Tool, tool) {
+			continue
+		}
+		matched := true
+		for field, pattern := range rule.Input {
+			v, ok := input[field]
+			if !ok || !globMatch(pattern, fmt.Sprint(v)) {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return rule.Decision, rule.Message
+		}
+	}
+	if p.Default != "" {
+		return p.Default, ""
+	}
+	return decisionAsk, ""
+}
+
+// allowsToolCall reports whether a call of tool with input falls within the
+// CLI tool names in allowed. A whole MCP server such as "mcp__weather" covers
+// each of its tools, and "Bash(git log:*)" covers Bash commands starting with
+// "git log" while "Bash(git status)" covers that command only. A prefix never
+// covers a command with shell operators, which could chain anything after it.
+// Other scoped names are not interpreted and allow nothing.
+func allowsToolCall(allowed []string, tool string, input map[string]any) bool {
+	for _, name := range allowed {
+		base, spec, scoped := strings.Cut(name, "(")
+		if !scoped {
+			if name == tool || (strings.HasPrefix(name, "mcp__") && strings.Count(name, "__") == 1 && strings.HasPrefix(tool, name+"__")) {
+				return true
+			}
+			continue
+		}
+		command, ok := input["command"].(string)
+		if base != "Bash" || tool != "Bash" || !ok || !strings.HasSuffix(spec, ")") {
+			continue
+		}
+		spec = strings.TrimSuffix(spec, ")")
+		if prefix, ok := strings.CutSuffix(spec, ":*"); ok {
+			if !strings.ContainsAny(command, ";&|`$<>()\n") && (command == prefix || strings.HasPrefix(command, prefix+" ")) {
+				return true
+			}
+		} else if command == spec {
+			return true
+		}
+	}
+	return false
+}
+
+// globMatch matches s against a pattern where * matches any run of characters
+// and ? any single character.
+func globMatch(pattern, s string) bool {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.ReplaceAll(expr, `\*`, ".*")
+	expr = strings.ReplaceAll(expr, `\?`, ".")
+	ok, _ := regexp.MatchString("^"+expr+"$", s)
+	return ok
+}
+
+// permissionResult is what the CLI expects back from a permission prompt
+// tool, and what a permission webhook must answer with.
+type permissionResult struct {
+	Behavior     string         `json:"behavior"`
+	Message      string         `json:"message,omitempty"`
+	UpdatedInput map[string]any `json:"updatedInput,omitempty"`
+}
+
+// permissionServer answers the CLI's permission prompts.
+type permissionServer struct {
+	rules *permissionRules
+	// allowed is the request's allowed tools after the tool policy, or nil
+	// if it named none; tools outside it are denied without asking.
+	allowed []string
+	webhook string
+	secret  string
+	user    json.RawMessage
+	client  *http.Client
+}
+
+// runPermissionServer serves the permission prompt tool over stdio. It is
+// started by the CLI as "shim permission-server" in delegate mode.
+func runPermissionServer() error {
+	ps := &permissionServer{
+		webhook: os.Getenv("SHIM_PERMISSION_WEBHOOK_URL"),
+		secret:  os.Getenv("PERMISSION_WEBHOOK_SECRET"),
+		client:  &http.Client{Timeout: defaultPermissionTimeout, CheckRedirect: noRedirects},
+	}
+	if user := os.Getenv("SHIM_PERMISSION_USER"); user != "" {
+		ps.user = json.RawMessage(user)
+	}
+	if allowed := os.Getenv("SHIM_PERMISSION_ALLOWED_TOOLS"); allowed != "" {
+		if err := json.Unmarshal([]byte(allowed), &ps.allowed); err != nil {
+			return fmt.Errorf("invalid SHIM_PERMISSION_ALLOWED_TOOLS: %w", err)
+		}
+	}
+	if file := os.Getenv("PERMISSION_RULES_FILE"); file != "" {
+		rules, err := loadPermissionRules(file)
+		if err != nil {
+			return err
+		}
+		ps.rules = rules
+	}
+	if v := os.Getenv("PERMISSION_WEBHOOK_TIMEOUT_SECONDS"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs <= 0 {
+			return fmt.Errorf("invalid PERMISSION_WEBHOOK_TIMEOUT_SECONDS %q", v)
+		}
+		ps.client.Timeout = time.Duration(secs) * time.Second
+	}
+
+	s := server.NewMCPServer(permissionServerName, "1.0.0", server.WithToolCapabilities(false))
+	s.AddTool(mcp.NewTool(permissionToolName,
+		mcp.WithDescription("Decides whether the agent may run a tool"),
+		mcp.WithString("tool_name", mcp.Required(), mcp.Description("Tool requesting permission")),
+		mcp.WithObject("input", mcp.Required(), mcp.Description("Input the tool will be called with")),
+		mcp.WithString("tool_use_id", mcp.Description("Id of the tool use")),
+	), ps.handleApprove)
+	return server.ServeStdio(s)
+}
+
+// noRedirects stops a webhook client at the first response, since a redirect
+// could lead anywhere, past the hosts the operator allowed.
+func noRedirects(*http.Request, []*http.Request) error {
+	return http.ErrUseLastResponse
+}
+
+func (ps *permissionServer) handleApprove(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	tool := request.GetString("tool_name", "")
+	input, _ := request.GetArguments()["input"].(map[string]any)
+
+	result := ps.decide(ctx, tool, input, request.GetString("tool_use_id", ""))
+	if result.Behavior == decisionAllow && result.UpdatedInput == nil {
+		result.UpdatedInput = input
+	}
+	log.Printf("permission: %s %s", result.Behavior, tool)
+
+	out, err := json.Marshal(result)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal permission result: %w", err)
+	}
+	return mcp.NewToolResultText(string(out)), nil
+}
+
+// decide applies the rules file, falling back to the webhook for "ask" and
+// denying when there is nobody to ask.
+func (ps *permissionServer) decide(ctx context.Context, tool string, input map[string]any, toolUseID string) permissionResult {
+	if ps.allowed != nil && !allowsToolCall(ps.allowed, tool, input) {
+		return permissionResult{Behavior: decisionDeny, Message: fmt.Sprintf("%s is not among the allowed tools", tool)}
+	}
+	decision, message := decisionAsk, ""
+	if ps.rules != nil {
+		decision, message = ps.rules.decide(tool, input)
+	}
+	switch decision {
+	case decisionAllow:
+		return permissionResult{Behavior: decisionAllow}
+	case decisionDeny:
+		if message == "" {
+			message = fmt.Sprintf("%s is not permitted", tool)
+		}
+		return permissionResult{Behavior: decisionDeny, Message: message}
+	}
+
+	if ps.webhook == "" {
+		return permissionResult{Behavior: decisionDeny, Message: fmt.Sprintf("%s requires approval and no approver is configured", tool)}
+	}
+	result, err := ps.askWebhook(ctx, tool, input, toolUseID)
+	if err != nil {
+		log.Printf("permission: webhook failed: %v", err)
+		return permissionResult{Behavior: decisionDeny, Message: "approval request failed"}
+	}
+	return result
+}
+
+// askWebhook posts the pending tool call to the webhook and waits for its
+// decision. Requests are signed like HMAC-authenticated shim requests when
+// PERMISSION_WEBHOOK_SECRET is set.
+func (ps *permissionServer) askWebhook(ctx context.Context, tool string, input map[string]any, toolUseID string) (permissionResult, error) {
+	body, err := json.Marshal(map[string]any{
+		"tool_name":   tool,
+		"input":       input,
+		"tool_use_id": toolUseID,
+		"user":        ps.user,
+	})
+	if err != nil {
+		return permissionResult{}, fmt.Errorf("failed to marshal webhook request: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", ps.webhook, bytes.NewReader(body))
+	if err != nil {
+		return permissionResult{}, fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if ps.secret != "" {
+		signRequest(req, ps.secret, body)
+	}
+
+	resp, err := ps.client.Do(req)
+	if err != nil {
+		return permissionResult{}, fmt.Errorf("failed to call webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return permissionResult{}, fmt.Errorf("failed to read webhook response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return permissionResult{}, fmt.Errorf("webhook returned status %d: %s", resp.StatusCode, string(respBody))
+	}
+
+	var result permissionResult
+	if err := json.Unmarshal(respBody, &result); err != nil {
+		return permissionResult{}, fmt.Errorf("failed to unmarshal webhook response: %w", err)
+	}
+	if result.Behavior != decisionAllow && result.Behavior != decisionDeny {
+		return permissionResult{}, fmt.Errorf("webhook returned unknown behavior %q", result.Behavior)
+	}
+	return result, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAllowsToolCall(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		tool    string
+		input   map[string]any
+		want    bool
+	}{
+		{"listed tool", []string{"Read", "Write"}, "Write", nil, true},
+		{"unlisted tool", []string{"Read"}, "Bash", map[string]any{"command": "ls"}, false},
+		{"tool of a listed mcp server", []string{"mcp__weather"}, "mcp__weather__forecast", nil, true},
+		{"tool of another mcp server", []string{"mcp__weather"}, "mcp__weatherman__forecast", nil, false},
+		{"bash prefix", []string{"Bash(git log:*)"}, "Bash", map[string]any{"command": "git log --oneline"}, true},
+		{"bash prefix alone", []string{"Bash(git log:*)"}, "Bash", map[string]any{"command": "git log"}, true},
+		{"bash prefix of a longer word", []string{"Bash(git log:*)"}, "Bash", map[string]any{"command": "git logout"}, false},
+		{"bash prefix with chained command", []string{"Bash(git log:*)"}, "Bash", map[string]any{"command": "git log; rm -rf /"}, false},
+		{"bash prefix with substitution", []string{"Bash(git log:*)"}, "Bash", map[string]any{"command": "git log $(rm -rf /)"}, false},
+		{"bash exact command", []string{"Bash(git status)"}, "Bash", map[string]any{"command": "git status"}, true},
+		{"bash other command", []string{"Bash(git status)"}, "Bash", map[string]any{"command": "git status -s"}, false},
+		{"bash without command", []string{"Bash(git status)"}, "Bash", nil, false},
+		{"other scoped tool", []string{"Read(./docs/**)"}, "Read", map[string]any{"file_path": "./docs/a.md"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := allowsToolCall(tt.allowed, tt.tool, tt.input); got != tt.want {
+				t.Errorf("allowsToolCall(%q, %q, %v) = %v, want %v", tt.allowed, tt.tool, tt.input, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPermissionWebhook(t *testing.T) {
+	const secret = "webhook-secret"
+	var elsewhere atomic.Int32
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		elsewhere.Add(1)
+		fmt.Fprint(w, `{"behavior":"allow"}`)
+	}))
+	defer other.Close()
+
+	var calls atomic.Int32
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		want := signHMAC([]byte(secret), r.Header.Get("X-Timestamp"), r.Method, r.URL.Path, r.URL.Query(), body)
+		if r.Header.Get("X-Signature") != want {
+			http.Error(w, "bad signature", http.StatusUnauthorized)
+			return
+		}
+		var call struct {
+			ToolName string         `json:"tool_name"`
+			Input    map[string]any `json:"input"`
+		}
+		_ = json.Unmarshal(body, &call)
+		switch call.Input["command"] {
+		case "make deploy":
+			fmt.Fprint(w, `{"behavior":"deny","message":"not today"}`)
+		case "make redirect":
+			http.Redirect(w, r, other.URL, http.StatusTemporaryRedirect)
+		case "make fail":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			fmt.Fprint(w, `{"behavior":"allow"}`)
+		}
+	}))
+	defer webhook.Close()
+
+	ps := &permissionServer{
+		allowed: []string{"Bash"},
+		webhook: webhook.URL + "/approve?agent=default",
+		secret:  secret,
+		client:  &http.Client{Timeout: defaultPermissionTimeout, CheckRedirect: noRedirects},
+	}
+	cases := []struct {
+		tool, command string
+		want          string
+		wantCalls     int32
+	}{
+		{"Bash", "make test", decisionAllow, 1},
+		{"Bash", "make deploy", decisionDeny, 1},
+		{"Bash", "make redirect", decisionDeny, 1},
+		{"Bash", "make fail", decisionDeny, 1},
+		{"Write", "", decisionDeny, 0}, // outside the allowed tools, nobody is asked
+	}
+	for _, c := range cases {
+		calls.Store(0)
+		got := ps.decide(context.Background(), c.tool, map[string]any{"command": c.command}, "toolu_1")
+		if got.Behavior != c.want {
+			t.Errorf("decide(%s %q) = %+v, want %s", c.tool, c.command, got, c.want)
+		}
+		if calls.Load() != c.wantCalls {
+			t.Errorf("decide(%s %q) called the webhook %d times, want %d", c.tool, c.command, calls.Load(), c.wantCalls)
+		}
+	}
+	if elsewhere.Load() != 0 {
+		t.Error("the webhook client followed a redirect")
+	}
+}
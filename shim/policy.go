@@ -0,0 +1,250 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// defaultAgent names the agent a deployment serves when AGENT_NAME is unset.
+const defaultAgent = "default"
+
+// toolLimit is one set of tool patterns in the policy file. Patterns are
+// globs over tool names, e.g. "Read", "mcp__assistant-mcp__*" or "*". An entry
+// without a tools key does not restrict tools; "tools: []" allows none.
+type toolLimit struct {
+	Tools []string `yaml:"tools"`
+	Deny  []string `yaml:"deny"`
+}
+
+// ToolPolicy is the operator's upper bound on the tools a request may use.
+// A tool is permitted only if the agent's limit and the caller's limit both
+// allow it and no applicable deny pattern matches it. The caller's limit is
+// their user entry if there is one, else the union of their role entries,
+// else the default entry. A missing limit places no restriction.
+type ToolPolicy struct {
+	Agents  map[string]toolLimit `yaml:"agents"`
+	Roles   map[string]toolLimit `yaml:"roles"`
+	Users   map[string]toolLimit `yaml:"users"`
+	Default *toolLimit           `yaml:"default"`
+}
+
+// toolPolicy is the policy loaded from TOOL_POLICY_FILE, or nil if unset.
+var toolPolicy *ToolPolicy
+
+// loadToolPolicy reads the YAML policy named by TOOL_POLICY_FILE.
+func loadToolPolicy() (*ToolPolicy, error) {
+	file := os.Getenv("TOOL_POLICY_FILE")
+	if file == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tool policy: %w", err)
+	}
+	var p ToolPolicy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, fmt.Errorf("failed to parse tool policy %s: %w", file, err)
+	}
+	for name, l := range p.entries() {
+		if err := l.checkDeny(); err != nil {
+			return nil, fmt.Errorf("tool policy %s: %s: %w", file, name, err)
+		}
+	}
+	return &p, nil
+}
+
+// entries lists every limit in the policy by name, for validation.
+func (p *ToolPolicy) entries() map[string]toolLimit {
+	all := map[string]toolLimit{}
+	for name, l := range p.Agents {
+		all["agents."+name] = l
+	}
+	for name, l := range p.Roles {
+		all["roles."+name] = l
+	}
+	for name, l := range p.Users {
+		all["users."+name] = l
+	}
+	if p.Default != nil {
+		all["default"] = *p.Default
+	}
+	return all
+}
+
+// checkDeny refuses deny patterns the CLI cannot enforce. Deny patterns are
+// passed on as --disallowedTools, which knows tool names, scoped rules ending
+// in a ":*" prefix and whole MCP servers but no other globs, so a pattern
+// like "Web*" would deny nothing.
+func (l toolLimit) checkDeny() error {
+	for _, pattern := range l.Deny {
+		if server, ok := strings.CutSuffix(pattern, "__*"); ok && strings.HasPrefix(server, "mcp__") {
+			pattern = server
+		}
+		base, scope, _ := strings.Cut(pattern, "(")
+		scope = strings.TrimSuffix(strings.TrimSuffix(scope, ")"), ":*")
+		if strings.ContainsAny(base+scope, "*?[") {
+			return fmt.Errorf("deny pattern %q is a glob, which --disallowedTools cannot enforce", pattern)
+		}
+	}
+	return nil
+}
+
+// checkToolPolicyMode refuses tool limits under PERMISSION_MODE=skip, where
+// --dangerously-skip-permissions lets the agent run any tool whatever
+// --allowedTools says, so the policy would bound nothing.
+func checkToolPolicyMode(mode string, policy *ToolPolicy, profiles map[string]*AgentProfile) error {
+	if mode != permissionSkip {
+		return nil
+	}
+	if policy != nil {
+		return fmt.Errorf("TOOL_POLICY_FILE requires PERMISSION_MODE=%s or %s", permissionAllowlist, permissionDelegate)
+	}
+	for name, profile := range profiles {
+		if profile.Tools != nil {
+			return fmt.Errorf("agent profile %s: tools require PERMISSION_MODE=%s or %s", name, permissionAllowlist, permissionDelegate)
+		}
+	}
+	return nil
+}
+
+// limits returns the agent and caller allow lists (nil meaning unrestricted)
+// and every deny pattern that applies to the request.
+func (p *ToolPolicy) limits(agent string, id *Identity) (agentAllow, callerAllow, deny []string) {
+	if l, ok := p.Agents[agent]; ok {
+		agentAllow = l.Tools
+		deny = append(deny, l.Deny...)
+	}
+
+	var caller []toolLimit
+	if id != nil {
+		if l, ok := p.Users[id.User]; ok {
+			caller = append(caller, l)
+		} else {
+			for _, role := range id.Roles {
+				if l, ok := p.Roles[role]; ok {
+					caller = append(caller, l)
+				}
+			}
+		}
+	}
+	if len(caller) == 0 && p.Default != nil {
+		caller = append(caller, *p.Default)
+	}
+	unrestricted := false
+	for _, l := range caller {
+		if l.Tools == nil {
+			unrestricted = true
+		}
+		callerAllow = append(callerAllow, l.Tools...)
+		deny = append(deny, l.Deny...)
+	}
+	if unrestricted {
+		callerAllow = nil
+	} else if len(caller) > 0 && callerAllow == nil {
+		callerAllow = []string{}
+	}
+	return agentAllow, callerAllow, deny
+}
+
+// Apply narrows r's tool lists to what the policy permits. Requested tools the
+// policy removes are recorded so they can be reported in the response; a
+// request left with none of the tools it asked for is refused outright rather
+// than silently falling back to the policy maximum.
+func (p *ToolPolicy) Apply(r *Request) error {
+	agentAllow, callerAllow, deny := p.limits(r.agentName(), r.identity)
+	permitted := func(tool string) bool {
+		return (agentAllow == nil || matchTool(agentAllow, tool)) &&
+			(callerAllow == nil || matchTool(callerAllow, tool)) &&
+			!matchTool(deny, tool)
+	}
+
+	if len(r.AllowedTools) > 0 {
+		var allowed []string
+		for _, tool := range r.AllowedTools {
+			if permitted(tool) {
+				allowed = append(allowed, tool)
+			} else {
+				r.deniedTools = append(r.deniedTools, tool)
+			}
+		}
+		if len(allowed) == 0 {
+			return &codedError{
+				Code:    ErrForbidden,
+				Message: "none of the requested tools are permitted: " + strings.Join(r.deniedTools, ", "),
+			}
+		}
+		r.AllowedTools = allowed
+	} else {
+		// No list requested: grant the policy maximum, i.e. every pattern from
+		// either limit that the other limit also admits.
+		var allowed []string
+		for _, pattern := range slices.Concat(agentAllow, callerAllow) {
+			if permitted(pattern) && !slices.Contains(allowed, pattern) {
+				allowed = append(allowed, pattern)
+			}
+		}
+		if (agentAllow != nil || callerAllow != nil) && !slices.Contains(allowed, "*") {
+			if len(allowed) == 0 {
+				return &codedError{Code: ErrForbidden, Message: "no tools are permitted for this caller"}
+			}
+			r.AllowedTools = cliToolNames(allowed)
+		}
+	}
+
+	for _, pattern := range cliToolNames(deny) {
+		if !slices.Contains(r.DisallowedTools, pattern) {
+			r.DisallowedTools = append(r.DisallowedTools, pattern)
+		}
+	}
+	return nil
+}
+
+// matchTool reports whether tool matches any pattern. A rule-scoped tool such
+// as "Bash(git log:*)" also matches patterns for its bare name, and a whole MCP
+// server such as "mcp__assistant-mcp" is treated as "mcp__assistant-mcp__*".
+func matchTool(patterns []string, tool string) bool {
+	if strings.HasPrefix(tool, "mcp__") && strings.Count(tool, "__") == 1 {
+		tool += "__*"
+	}
+	base, _, scoped := strings.Cut(tool, "(")
+	for _, pattern := range patterns {
+		if pattern == tool {
+			return true
+		}
+		if ok, _ := path.Match(pattern, tool); ok {
+			return true
+		}
+		if scoped && !strings.Contains(pattern, "(") {
+			if ok, _ := path.Match(pattern, base); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cliToolNames converts policy patterns to names the CLI understands: a whole
+// MCP server pattern like "mcp__assistant-mcp__*" becomes "mcp__assistant-mcp".
+// Any other glob has no CLI equivalent; in an allow list it is only enforced
+// against the tools a request names explicitly, and checkDeny keeps it out of
+// deny lists.
+func cliToolNames(patterns []string) []string {
+	var names []string
+	for _, pattern := range patterns {
+		if server, ok := strings.CutSuffix(pattern, "__*"); ok && strings.HasPrefix(server, "mcp__") {
+			pattern = server
+		}
+		if base, _, _ := strings.Cut(pattern, "("); strings.ContainsAny(base, "*?[") {
+			continue
+		}
+		if !slices.Contains(names, pattern) {
+			names = append(names, pattern)
+		}
+	}
+	return names
+}
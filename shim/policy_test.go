@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatchTool(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		tool     string
+		want     bool
+	}{
+		{"exact name", []string{"Read"}, "Read", true},
+		{"other name", []string{"Read", "Grep"}, "Bash", false},
+		{"no patterns", nil, "Read", false},
+		{"wildcard", []string{"*"}, "Bash", true},
+		{"mcp tool glob", []string{"mcp__assistant-mcp__*"}, "mcp__assistant-mcp__search", true},
+		{"mcp tool of another server", []string{"mcp__assistant-mcp__*"}, "mcp__weather__forecast", false},
+		{"whole mcp server", []string{"mcp__weather__*"}, "mcp__weather", true},
+		{"whole mcp server against one tool", []string{"mcp__weather__forecast"}, "mcp__weather", false},
+		{"scoped tool against bare name", []string{"Bash"}, "Bash(git log:*)", true},
+		{"scoped tool against same scope", []string{"Bash(git log:*)"}, "Bash(git log:*)", true},
+		{"scoped tool against other scope", []string{"Bash(npm test)"}, "Bash(git log:*)", false},
+		{"bare name against scoped pattern", []string{"Bash(git log:*)"}, "Bash", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchTool(tt.patterns, tt.tool); got != tt.want {
+				t.Errorf("matchTool(%q, %q) = %v, want %v", tt.patterns, tt.tool, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadToolPolicyRejectsDenyGlobs(t *testing.T) {
+	tests := []struct {
+		deny    string
+		wantErr bool
+	}{
+		{"Bash", false},
+		{"Bash(rm:*)", false},
+		{"Bash(git push)", false},
+		{"mcp__assistant-mcp__*", false},
+		{"mcp__assistant-mcp__delete", false},
+		{"Web*", true},
+		{"Bash(rm*)", true},
+		{"mcp__*", true},
+		{"mcp__assistant-mcp__delete_*", true},
+		{"[BR]ead", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.deny, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "policy.yaml")
+			data := fmt.Sprintf("roles:\n  member:\n    deny: [%q]\n", tt.deny)
+			if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			t.Setenv("TOOL_POLICY_FILE", file)
+			_, err := loadToolPolicy()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("loadToolPolicy() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckToolPolicyMode(t *testing.T) {
+	policy := &ToolPolicy{Default: &toolLimit{Tools: []string{"Read"}}}
+	limited := map[string]*AgentProfile{"gardener": {Tools: &toolLimit{Deny: []string{"Bash"}}}}
+	unlimited := map[string]*AgentProfile{"gardener": {}}
+
+	tests := []struct {
+		name     string
+		mode     string
+		policy   *ToolPolicy
+		profiles map[string]*AgentProfile
+		wantErr  bool
+	}{
+		{"skip without limits", permissionSkip, nil, unlimited, false},
+		{"skip with policy", permissionSkip, policy, nil, true},
+		{"skip with profile tools", permissionSkip, nil, limited, true},
+		{"allowlist with policy", permissionAllowlist, policy, limited, false},
+		{"delegate with policy", permissionDelegate, policy, limited, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkToolPolicyMode(tt.mode, tt.policy, tt.profiles)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkToolPolicyMode() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
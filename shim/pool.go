@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// defaultQueueDepth is how many requests may wait for a worker when
+	// QUEUE_MAX_DEPTH is unset.
+	defaultQueueDepth = 100
+	// defaultQueueTimeout is how long a request may wait for a worker when
+	// QUEUE_TIMEOUT_SECONDS is unset.
+	defaultQueueTimeout = 30 * time.Second
+)
+
+var (
+	errQueueFull    = &codedError{Code: ErrRateLimited, Message: "all workers are busy and the queue is full, retry later"}
+	errQueueTimeout = &codedError{Code: ErrRateLimited, Message: "timed out waiting for a free worker, retry later"}
+	errQueueAborted = &codedError{Code: ErrCLICrashed, Message: "request was cancelled while waiting for a worker"}
+)
+
+// queueWaitBuckets are the upper bounds, in seconds, of the queue wait
+// histogram.
+var queueWaitBuckets = []float64{0.01, 0.1, 0.5, 1, 2.5, 5, 10, 30, 60, 120, 300}
+
+// runPool bounds the agent runs of the HTTP server. It is nil in the other
+// modes, which handle one request at a time, and a nil pool admits everything.
+var runPool *workerPool
+
+// workerPool limits how many agent runs, each a CLI process, execute at once.
+// Requests beyond the limit wait in a FIFO queue of bounded depth and give up
+// after the queue timeout.
+type workerPool struct {
+	limit    int
+	maxDepth int
+	timeout  time.Duration
+
+	mu    sync.Mutex
+	busy  int
+	queue []*ticket
+
+	// metrics, guarded by mu
+	waitCounts []uint64 // per queueWaitBuckets entry, not cumulative
+	waitSum    time.Duration
+	waitTotal  uint64
+	rejected   map[string]uint64
+}
+
+// ticket is a request's place in the queue. ready is closed once it has been
+// handed a worker.
+type ticket struct {
+	ready    chan struct{}
+	enqueued time.Time
+}
+
+// loadWorkerPool reads WORKER_CONCURRENCY (default: the number of CPUs, 0 for
+// no limit), QUEUE_MAX_DEPTH and QUEUE_TIMEOUT_SECONDS.
+func loadWorkerPool() (*workerPool, error) {
+	limit, err := envInt("WORKER_CONCURRENCY", runtime.NumCPU())
+	if err != nil {
+		return nil, err
+	}
+	if limit == 0 {
+		return nil, nil
+	}
+	depth, err := envInt("QUEUE_MAX_DEPTH", defaultQueueDepth)
+	if err != nil {
+		return nil, err
+	}
+	timeout := defaultQueueTimeout
+	if v := os.Getenv("QUEUE_TIMEOUT_SECONDS"); v != "" {
+		secs, err := strconv.Atoi(v)
+		if err != nil || secs <= 0 {
+			return nil, fmt.Errorf("QUEUE_TIMEOUT_SECONDS must be a positive number of seconds, got %q", v)
+		}
+		timeout = time.Duration(secs) * time.Second
+	}
+	return newWorkerPool(limit, depth, timeout), nil
+}
+
+// envInt reads a non-negative integer setting.
+func envInt(name string, def int) (int, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer, got %q", name, v)
+	}
+	return n, nil
+}
+
+func newWorkerPool(limit, maxDepth int, timeout time.Duration) *workerPool {
+	return &workerPool{
+		limit:      limit,
+		maxDepth:   maxDepth,
+		timeout:    timeout,
+		waitCounts: make([]uint64, len(queueWaitBuckets)),
+		rejected:   map[string]uint64{},
+	}
+}
+
+// acquire waits up to the queue timeout for a worker. The returned release
+// must be called once the run is over.
+func (p *workerPool) acquire(ctx context.Context) (release func(), err error) {
+	t, err := p.enqueue()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.wait(ctx, t, p.timeoutOrZero()); err != nil {
+		return nil, err
+	}
+	return p.release, nil
+}
+
+// enqueue takes a place in the queue, or a worker straight away if one is free
+// and nobody is waiting. It fails only when the queue is full.
+func (p *workerPool) enqueue() (*ticket, error) {
+	t := &ticket{ready: make(chan struct{}), enqueued: time.Now()}
+	if p == nil {
+		close(t.ready)
+		return t, nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	switch {
+	case p.busy < p.limit && len(p.queue) == 0:
+		p.busy++
+		close(t.ready)
+	case len(p.queue) >= p.maxDepth:
+		p.rejected["queue_full"]++
+		return nil, errQueueFull
+	default:
+		p.queue = append(p.queue, t)
+	}
+	return t, nil
+}
+
+// wait blocks until t is handed a worker, ctx is done or, unless timeout is
+// zero, timeout has passed since t was enqueued.
+func (p *workerPool) wait(ctx context.Context, t *ticket, timeout time.Duration) error {
+	if p == nil {
+		return nil
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout - time.Since(t.enqueued))
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-t.ready:
+		p.observeWait(time.Since(t.enqueued))
+		return nil
+	case <-expired:
+		p.abandon(t, "timeout")
+		return errQueueTimeout
+	case <-ctx.Done():
+		p.abandon(t, "cancelled")
+		return errQueueAborted
+	}
+}
+
+// abandon takes t out of the queue. If it was handed a worker in the meantime
+// the worker is passed on instead.
+func (p *workerPool) abandon(t *ticket, reason string) {
+	p.mu.Lock()
+	if i := slices.Index(p.queue, t); i >= 0 {
+		p.queue = slices.Delete(p.queue, i, i+1)
+		p.rejected[reason]++
+		p.mu.Unlock()
+		return
+	}
+	p.mu.Unlock()
+	p.release()
+}
+
+// release hands the caller's worker to the longest waiting request.
+func (p *workerPool) release() {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.queue) > 0 {
+		close(p.queue[0].ready)
+		p.queue = slices.Delete(p.queue, 0, 1)
+		return
+	}
+	p.busy--
+}
+
+func (p *workerPool) timeoutOrZero() time.Duration {
+	if p == nil {
+		return 0
+	}
+	return p.timeout
+}
+
+func (p *workerPool) observeWait(d time.Duration) {
+	if d > time.Second {
+		log.Printf("pool: request waited %s for a worker", d.Round(time.Millisecond))
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.waitTotal++
+	p.waitSum += d
+	for i, bound := range queueWaitBuckets {
+		if d.Seconds() <= bound {
+			p.waitCounts[i]++
+			break
+		}
+	}
+}
+
+// rejection builds the response for a request the pool turned away. Every
+// request queued now has a worker or has given up within the queue timeout,
+// so that is when a retry has a chance.
+func (p *workerPool) rejection(err error) events.APIGatewayProxyResponse {
+	resp := errorResponseFrom(err).ProxyResponse()
+	if errors.Is(err, errQueueFull) || errors.Is(err, errQueueTimeout) {
+		resp.Headers["Retry-After"] = strconv.Itoa(int(max(p.timeoutOrZero(), time.Second).Seconds()))
+	}
+	return resp
+}
+
+// writeMetrics writes the pool's state in the Prometheus text format.
+func (p *workerPool) writeMetrics(w io.Writer) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	fmt.Fprintf(w, "# HELP shim_workers_limit Maximum number of concurrent agent runs.\n# TYPE shim_workers_limit gauge\nshim_workers_limit %d\n", p.limit)
+	fmt.Fprintf(w, "# HELP shim_workers_busy Agent runs in progress.\n# TYPE shim_workers_busy gauge\nshim_workers_busy %d\n", p.busy)
+	fmt.Fprintf(w, "# HELP shim_queue_depth Requests waiting for a worker.\n# TYPE shim_queue_depth gauge\nshim_queue_depth %d\n", len(p.queue))
+
+	fmt.Fprintf(w, "# HELP shim_queue_rejected_total Requests that gave up or were turned away before getting a worker.\n# TYPE shim_queue_rejected_total counter\n")
+	for _, reason := range []string{"queue_full", "timeout", "cancelled"} {
+		fmt.Fprintf(w, "shim_queue_rejected_total{reason=%q} %d\n", reason, p.rejected[reason])
+	}
+
+	fmt.Fprintf(w, "# HELP shim_queue_wait_seconds Time requests waited for a worker.\n# TYPE shim_queue_wait_seconds histogram\n")
+	var cumulative uint64
+	for i, bound := range queueWaitBuckets {
+		cumulative += p.waitCounts[i]
+		fmt.Fprintf(w, "shim_queue_wait_seconds_bucket{le=\"%g\"} %d\n", bound, cumulative)
+	}
+	fmt.Fprintf(w, "shim_queue_wait_seconds_bucket{le=\"+Inf\"} %d\n", p.waitTotal)
+	fmt.Fprintf(w, "shim_queue_wait_seconds_sum %g\n", p.waitSum.Seconds())
+	fmt.Fprintf(w, "shim_queue_wait_seconds_count %d\n", p.waitTotal)
+}
+
+// handleMetrics serves the worker pool metrics.
+func handleMetrics(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if runPool != nil {
+		runPool.writeMetrics(w)
+	}
+}
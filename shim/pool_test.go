@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolFIFO(t *testing.T) {
+	p := newWorkerPool(1, 3, time.Minute)
+	ctx := context.Background()
+	release, err := p.acquire(ctx)
+	if err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+
+	var tickets []*ticket
+	for range 3 {
+		tk, err := p.enqueue()
+		if err != nil {
+			t.Fatalf("enqueue() error = %v", err)
+		}
+		tickets = append(tickets, tk)
+	}
+	if _, err := p.enqueue(); !errors.Is(err, errQueueFull) {
+		t.Fatalf("enqueue() on a full queue error = %v, want %v", err, errQueueFull)
+	}
+
+	// each release hands the worker to the longest waiting ticket only
+	for i, tk := range tickets {
+		release()
+		if err := p.wait(ctx, tk, 0); err != nil {
+			t.Fatalf("ticket %d wait() error = %v", i, err)
+		}
+		for _, later := range tickets[i+1:] {
+			select {
+			case <-later.ready:
+				t.Fatalf("a later ticket got the worker before ticket %d finished", i)
+			default:
+			}
+		}
+		release = p.release
+	}
+	release()
+	if p.busy != 0 || len(p.queue) != 0 {
+		t.Errorf("pool busy %d with %d queued, want idle", p.busy, len(p.queue))
+	}
+}
+
+func TestWorkerPoolAbandon(t *testing.T) {
+	p := newWorkerPool(1, 10, 20*time.Millisecond)
+	release, err := p.acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.acquire(context.Background()); !errors.Is(err, errQueueTimeout) {
+		t.Errorf("acquire() on a busy pool error = %v, want %v", err, errQueueTimeout)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := p.acquire(ctx); !errors.Is(err, errQueueAborted) {
+		t.Errorf("acquire() with a cancelled context error = %v, want %v", err, errQueueAborted)
+	}
+	if len(p.queue) != 0 {
+		t.Fatalf("%d abandoned tickets left in the queue", len(p.queue))
+	}
+
+	// a ticket handed the worker just as it gives up passes the worker on
+	tk, _ := p.enqueue()
+	release()
+	p.abandon(tk, "cancelled")
+	if p.busy != 0 {
+		t.Errorf("busy = %d after the only waiter abandoned its worker, want 0", p.busy)
+	}
+
+	var metrics strings.Builder
+	p.writeMetrics(&metrics)
+	for _, want := range []string{`shim_queue_rejected_total{reason="timeout"} 1`, `shim_queue_rejected_total{reason="cancelled"} 1`} {
+		if !strings.Contains(metrics.String(), want) {
+			t.Errorf("metrics lack %s:\n%s", want, metrics.String())
+		}
+	}
+}
+
+func TestWorkerPoolRejection(t *testing.T) {
+	p := newWorkerPool(1, 0, 30*time.Second)
+	if got := p.rejection(errQueueFull).Headers["Retry-After"]; got != "30" {
+		t.Errorf("Retry-After = %q, want 30", got)
+	}
+	if got := p.rejection(errQueueAborted).Headers["Retry-After"]; got != "" {
+		t.Errorf("Retry-After for a cancelled request = %q, want none", got)
+	}
+
+	// without a pool every request runs at once
+	var none *workerPool
+	release, err := none.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("acquire() without a pool error = %v", err)
+	}
+	release()
+}
+
+func TestLoadWorkerPool(t *testing.T) {
+	t.Setenv("WORKER_CONCURRENCY", "0")
+	if p, err := loadWorkerPool(); p != nil || err != nil {
+		t.Errorf("loadWorkerPool() with no limit = %v, %v, want nil", p, err)
+	}
+	t.Setenv("WORKER_CONCURRENCY", "2")
+	t.Setenv("QUEUE_MAX_DEPTH", "5")
+	t.Setenv("QUEUE_TIMEOUT_SECONDS", "10")
+	p, err := loadWorkerPool()
+	if err != nil || p.limit != 2 || p.maxDepth != 5 || p.timeout != 10*time.Second {
+		t.Errorf("loadWorkerPool() = %+v, %v", p, err)
+	}
+	for name, value := range map[string]string{"WORKER_CONCURRENCY": "-1", "QUEUE_MAX_DEPTH": "many", "QUEUE_TIMEOUT_SECONDS": "0"} {
+		t.Run(name, func(t *testing.T) {
+			t.Setenv(name, value)
+			if _, err := loadWorkerPool(); err == nil {
+				t.Errorf("loadWorkerPool() accepted %s=%s", name, value)
+			}
+		})
+	}
+}
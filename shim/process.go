@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+const (
+	// killGrace is how long the agent gets to exit after SIGTERM before its
+	// whole process group is killed.
+	killGrace = 5 * time.Second
+	// lambdaDeadlineMargin is reserved at the end of a Lambda invocation so a
+	// timed out run can still return its partial result before the sandbox
+	// is frozen.
+	lambdaDeadlineMargin = killGrace + 3*time.Second
+	// maxTimeoutSeconds bounds the timeout_seconds a caller may request.
+	maxTimeoutSeconds = 60 * 60
+)
+
+// runTimeout is the TIMEOUT_SECONDS default for runs, or 0 for none.
+var runTimeout time.Duration
+
+// loadRunTimeout reads TIMEOUT_SECONDS.
+func loadRunTimeout() (time.Duration, error) {
+	v := os.Getenv("TIMEOUT_SECONDS")
+	if v == "" {
+		return 0, nil
+	}
+	secs, err := strconv.Atoi(v)
+	if err != nil || secs <= 0 {
+		return 0, fmt.Errorf("TIMEOUT_SECONDS must be a positive number of seconds, got %q", v)
+	}
+	return time.Duration(secs) * time.Second, nil
+}
+
+// setProcessGroup runs cmd in its own process group and, when its context is
+// done, sends SIGTERM and then SIGKILL to the whole group so MCP servers and
+// tool subprocesses spawned by the agent are not left behind.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		pgid := cmd.Process.Pid
+		if err := syscall.Kill(-pgid, syscall.SIGTERM); err != nil {
+			return err
+		}
+		time.AfterFunc(killGrace, func() {
+			_ = syscall.Kill(-pgid, syscall.SIGKILL)
+		})
+		return nil
+	}
+	cmd.WaitDelay = killGrace + time.Second
+}
+
+// killProcessGroup immediately kills a started command and its children.
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process == nil {
+		return
+	}
+	if err := syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL); err != nil {
+		_ = cmd.Process.Kill()
+	}
+}
+
+// withRunTimeout bounds a run by the request's timeout_seconds, falling back to
+// the agent profile's budget and then the TIMEOUT_SECONDS server default, and
+// by the Lambda invocation deadline.
+func withRunTimeout(ctx context.Context, r Request) (context.Context, context.CancelFunc) {
+	timeout := time.Duration(0)
+	if r.TimeoutSeconds != nil {
+		timeout = time.Duration(*r.TimeoutSeconds) * time.Second
+	} else if r.profile != nil && r.profile.Budget.TimeoutSeconds > 0 {
+		timeout = time.Duration(r.profile.Budget.TimeoutSeconds) * time.Second
+	} else {
+		timeout = runTimeout
+	}
+
+	if _, ok := lambdacontext.FromContext(ctx); ok {
+		if deadline, ok := ctx.Deadline(); ok {
+			remaining := time.Until(deadline) - lambdaDeadlineMargin
+			if timeout == 0 || remaining < timeout {
+				timeout = max(remaining, time.Second)
+			}
+		}
+	}
+
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+func TestRunClaudeTimeout(t *testing.T) {
+	pidFile := filepath.Join(t.TempDir(), "child.pid")
+	fakeClaude(t, `echo '{"type":"system","subtype":"init","session_id":"s1"}'
+echo '{"type":"assistant","message":{"content":[{"type":"text","text":"halfway there"}]}}'
+sleep 30 &
+echo $! > `+pidFile+`
+wait`)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	resp := runClaude(ctx, Request{Prompt: []byte(`"hi"`)})
+	if elapsed := time.Since(start); elapsed > killGrace {
+		t.Errorf("runClaude() took %s to stop", elapsed)
+	}
+	if resp.Error == nil || resp.Error.Code != ErrTimeout || resp.SessionID != "s1" || resp.Result != "halfway there" {
+		t.Errorf("runClaude() = %+v, want a timeout with the session and last text", resp)
+	}
+
+	// the agent's own children are stopped with it
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	deadline := time.Now().Add(2 * time.Second)
+	for processRunning(pid) {
+		if time.Now().After(deadline) {
+			t.Fatalf("child %d outlived the timed out agent", pid)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// processRunning reports whether pid is alive and not a zombie.
+func processRunning(pid int) bool {
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	// the state follows the parenthesized command name
+	fields := strings.Fields(string(stat[strings.LastIndexByte(string(stat), ')')+1:]))
+	return len(fields) > 0 && fields[0] != "Z"
+}
+
+func TestRunClaudeCancelled(t *testing.T) {
+	fakeClaude(t, `exec sleep 30`)
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if resp := runClaude(ctx, Request{Prompt: []byte(`"hi"`)}); resp.Error == nil || resp.Error.Code != ErrCLICrashed {
+		t.Errorf("runClaude() = %+v, want a cancelled run", resp)
+	}
+}
+
+func TestWithRunTimeout(t *testing.T) {
+	defer func(d time.Duration) { runTimeout = d }(runTimeout)
+	runTimeout = time.Hour
+	ten := 10
+
+	remaining := func(ctx context.Context) time.Duration {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return 0
+		}
+		return time.Until(deadline).Round(time.Second)
+	}
+
+	ctx, cancel := withRunTimeout(context.Background(), Request{TimeoutSeconds: &ten})
+	defer cancel()
+	if got := remaining(ctx); got != 10*time.Second {
+		t.Errorf("request timeout left %s, want 10s", got)
+	}
+	ctx, cancel = withRunTimeout(context.Background(), Request{})
+	defer cancel()
+	if got := remaining(ctx); got != time.Hour {
+		t.Errorf("default timeout left %s, want 1h", got)
+	}
+
+	// a Lambda invocation ends the run early enough to report it
+	lambdaCtx, cancelLambda := context.WithTimeout(lambdacontext.NewContext(context.Background(), &lambdacontext.LambdaContext{}), time.Minute)
+	defer cancelLambda()
+	ctx, cancel = withRunTimeout(lambdaCtx, Request{})
+	defer cancel()
+	if got, want := remaining(ctx), time.Minute-lambdaDeadlineMargin; got != want {
+		t.Errorf("Lambda timeout left %s, want %s", got, want)
+	}
+
+	runTimeout = 0
+	ctx, cancel = withRunTimeout(context.Background(), Request{})
+	defer cancel()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("withRunTimeout() set a deadline where none is configured")
+	}
+}
+
+func TestLoadRunTimeout(t *testing.T) {
+	for value, want := range map[string]time.Duration{"": 0, "90": 90 * time.Second} {
+		t.Setenv("TIMEOUT_SECONDS", value)
+		if got, err := loadRunTimeout(); err != nil || got != want {
+			t.Errorf("loadRunTimeout(%q) = %s, %v, want %s", value, got, err, want)
+		}
+	}
+	for _, value := range []string{"0", "-5", "1m"} {
+		t.Setenv("TIMEOUT_SECONDS", value)
+		if _, err := loadRunTimeout(); err == nil {
+			t.Errorf("loadRunTimeout(%q) accepted it", value)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// imageMediaTypes are the image formats the model accepts.
+var imageMediaTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+// PromptBlock is one part of a multi-part prompt:
+//
+//	{"type": "text", "text": "What is in this photo?"}
+//	{"type": "image", "media_type": "image/jpeg", "data": "<base64>"}
+//	{"type": "file", "path": "notes/groceries.md"}
+type PromptBlock struct {
+	Type      string `json:"type"`
+	Text      string `json:"text,omitempty"`
+	MediaType string `json:"media_type,omitempty"`
+	Data      string `json:"data,omitempty"`
+	Path      string `json:"path,omitempty"`
+}
+
+// parsePrompt decodes a prompt that is either a plain JSON string or a list of
+// content blocks. A single block object is accepted as a list of one.
+func parsePrompt(raw json.RawMessage) (string, []PromptBlock, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return "", nil, errors.New("prompt is required")
+	}
+
+	switch raw[0] {
+	case '"':
+		var text string
+		if err := json.Unmarshal(raw, &text); err != nil {
+			return "", nil, fmt.Errorf("invalid prompt string: %w", err)
+		}
+		if strings.TrimSpace(text) == "" {
+			return "", nil, errors.New("prompt is required")
+		}
+		return text, nil, nil
+	case '{':
+		var block PromptBlock
+		if err := json.Unmarshal(raw, &block); err != nil {
+			return "", nil, fmt.Errorf("invalid prompt block: %w", err)
+		}
+		return "", []PromptBlock{block}, validateBlocks([]PromptBlock{block})
+	case '[':
+		var blocks []PromptBlock
+		if err := json.Unmarshal(raw, &blocks); err != nil {
+			return "", nil, fmt.Errorf("invalid prompt blocks: %w", err)
+		}
+		return "", blocks, validateBlocks(blocks)
+	default:
+		return "", nil, errors.New("prompt must be a string or a list of content blocks")
+	}
+}
+
+func validateBlocks(blocks []PromptBlock) error {
+	if len(blocks) == 0 {
+		return errors.New("prompt is required")
+	}
+	for i, b := range blocks {
+		switch b.Type {
+		case "text":
+			if b.Text == "" {
+				return fmt.Errorf("prompt block %d: text is required", i)
+			}
+		case "image":
+			if !slices.Contains(imageMediaTypes, b.MediaType) {
+				return fmt.Errorf("prompt block %d: media_type must be one of %s", i, strings.Join(imageMediaTypes, ", "))
+			}
+			if _, err := base64.StdEncoding.DecodeString(b.Data); err != nil || b.Data == "" {
+				return fmt.Errorf("prompt block %d: data must be base64", i)
+			}
+		case "file":
+			if b.Path == "" || strings.ContainsRune(b.Path, 0) {
+				return fmt.Errorf("prompt block %d: path is required", i)
+			}
+		default:
+			return fmt.Errorf("prompt block %d: unknown type %q", i, b.Type)
+		}
+	}
+	return nil
+}
+
+// streamJSONInput encodes blocks as the single user message the CLI reads
+// from stdin with --input-format=stream-json. File references become text
+// pointing the agent at the file, which it then reads with its own tools and
+// permissions.
+func streamJSONInput(blocks []PromptBlock) ([]byte, error) {
+	content := make([]map[string]any, 0, len(blocks))
+	for _, b := range blocks {
+		switch b.Type {
+		case "text":
+			content = append(content, map[string]any{"type": "text", "text": b.Text})
+		case "image":
+			content = append(content, map[string]any{
+				"type": "image",
+				"source": map[string]any{
+					"type":       "base64",
+					"media_type": b.MediaType,
+					"data":       b.Data,
+				},
+			})
+		case "file":
+			content = append(content, map[string]any{"type": "text", "text": "Attached file: @" + b.Path})
+		}
+	}
+
+	line, err := json.Marshal(map[string]any{
+		"type": "user",
+		"message": map[string]any{
+			"role":    "user",
+			"content": content,
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal prompt: %w", err)
+	}
+	return append(line, '\n'), nil
+}
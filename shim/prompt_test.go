@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParsePrompt(t *testing.T) {
+	tests := []struct {
+		name       string
+		raw        string
+		wantText   string
+		wantBlocks int
+		wantErr    string
+	}{
+		{name: "text", raw: `"say \"hi\""`, wantText: `say "hi"`},
+		{name: "blocks", raw: `[{"type":"text","text":"what is this?"},{"type":"image","media_type":"image/png","data":"aGVsbG8="},{"type":"file","path":"notes.md"}]`, wantBlocks: 3},
+		{name: "single block", raw: ` {"type":"text","text":"hi"}`, wantBlocks: 1},
+		{name: "blank text", raw: `"  "`, wantErr: "prompt is required"},
+		{name: "no blocks", raw: `[]`, wantErr: "prompt is required"},
+		{name: "number", raw: `42`, wantErr: "must be a string or a list"},
+		{name: "empty text block", raw: `[{"type":"text"}]`, wantErr: "block 0: text is required"},
+		{name: "svg image", raw: `[{"type":"text","text":"hi"},{"type":"image","media_type":"image/svg+xml","data":"aGk="}]`, wantErr: "block 1: media_type"},
+		{name: "bad base64", raw: `[{"type":"image","media_type":"image/png","data":"not base64!"}]`, wantErr: "data must be base64"},
+		{name: "unknown type", raw: `[{"type":"audio"}]`, wantErr: `unknown type "audio"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text, blocks, err := parsePrompt(json.RawMessage(tt.raw))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("parsePrompt() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil || text != tt.wantText || len(blocks) != tt.wantBlocks {
+				t.Errorf("parsePrompt() = %q, %d blocks, %v", text, len(blocks), err)
+			}
+		})
+	}
+}
+
+// The agent gets a text prompt exactly as sent and a multi-part prompt as a
+// stream-json user message on stdin.
+func TestClaudeCommandPrompt(t *testing.T) {
+	dir := t.TempDir()
+	fakeClaude(t, `printf '%s\n' "$@" > `+filepath.Join(dir, "args")+`
+cat > `+filepath.Join(dir, "stdin")+`
+echo '{"type":"result","result":"ok"}'`)
+	read := func(name string) string {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	text := `--help "quoted" $HOME`
+	raw, _ := json.Marshal(text)
+	if resp := runClaude(context.Background(), Request{Prompt: raw}); resp.Error != nil {
+		t.Fatalf("runClaude() error = %+v", resp.Error)
+	}
+	args := strings.Split(strings.TrimSuffix(read("args"), "\n"), "\n")
+	if n := len(args); n < 2 || args[n-2] != "--" || args[n-1] != text {
+		t.Errorf("args end with %q, want the prompt verbatim after --", args)
+	}
+	if read("stdin") != "" {
+		t.Errorf("a text prompt wrote %q to stdin", read("stdin"))
+	}
+
+	blocks := `[{"type":"text","text":"describe"},{"type":"image","media_type":"image/png","data":"aGk="},{"type":"file","path":"a.md"}]`
+	if resp := runClaude(context.Background(), Request{Prompt: json.RawMessage(blocks)}); resp.Error != nil {
+		t.Fatalf("runClaude() error = %+v", resp.Error)
+	}
+	if !strings.Contains(read("args"), "--input-format=stream-json") {
+		t.Errorf("args %q lack --input-format=stream-json", read("args"))
+	}
+	var msg struct {
+		Type    string `json:"type"`
+		Message struct {
+			Role    string           `json:"role"`
+			Content []map[string]any `json:"content"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal([]byte(read("stdin")), &msg); err != nil {
+		t.Fatalf("stdin %q: %v", read("stdin"), err)
+	}
+	if msg.Type != "user" || msg.Message.Role != "user" || len(msg.Message.Content) != 3 {
+		t.Fatalf("stdin message = %+v, want one user message of three parts", msg)
+	}
+	if source, _ := msg.Message.Content[1]["source"].(map[string]any); source["media_type"] != "image/png" || source["data"] != "aGk=" {
+		t.Errorf("image part = %v", msg.Message.Content[1])
+	}
+	if got := msg.Message.Content[2]["text"]; got != "Attached file: @a.md" {
+		t.Errorf("file part text = %v, want a reference to a.md", got)
+	}
+}
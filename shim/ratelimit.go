@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// maxIdleBuckets is how many in-memory buckets are kept before full ones,
+// which carry no state, are dropped.
+const maxIdleBuckets = 10000
+
+// redisRateLimitPrefix namespaces token buckets in a shared Redis database.
+const redisRateLimitPrefix = "agentcontainers:ratelimit:"
+
+// rateLimit is a token bucket: it holds up to Burst requests, default
+// Requests, and refills at Requests per Per.
+type rateLimit struct {
+	Requests int           `yaml:"requests"`
+	Per      time.Duration `yaml:"per"`
+	Burst    int           `yaml:"burst"`
+}
+
+func (l rateLimit) capacity() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return float64(l.Requests)
+}
+
+// perMilli is the refill rate in tokens per millisecond.
+func (l rateLimit) perMilli() float64 {
+	return float64(l.Requests) / float64(l.Per.Milliseconds())
+}
+
+// RateLimitPolicy is the operator's request rate limits. A request takes a
+// token from the global bucket, from its API key's bucket and from its user's
+// bucket (their entry, else the default entry), and is refused if any of them
+// is empty. Unauthenticated requests only have the global bucket.
+type RateLimitPolicy struct {
+	Global  *rateLimit           `yaml:"global"`
+	Keys    map[string]rateLimit `yaml:"keys"`
+	Users   map[string]rateLimit `yaml:"users"`
+	Default *rateLimit           `yaml:"default"`
+}
+
+// rateLimitPolicy is the policy loaded from RATE_LIMITS_FILE, or nil if unset.
+var rateLimitPolicy *RateLimitPolicy
+
+// rateLimiter holds the buckets, in memory or in RATE_LIMIT_STORE.
+var rateLimiter RateLimiter
+
+// loadRateLimits reads the YAML policy named by RATE_LIMITS_FILE and opens
+// the bucket store named by RATE_LIMIT_STORE: memory (the default) or a
+// redis:// URL shared by every instance.
+func loadRateLimits() (*RateLimitPolicy, RateLimiter, error) {
+	file := os.Getenv("RATE_LIMITS_FILE")
+	if file == "" {
+		return nil, nil, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read rate limits: %w", err)
+	}
+	var p RateLimitPolicy
+	if err := yaml.Unmarshal(data, &p); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse rate limits %s: %w", file, err)
+	}
+	for name, l := range p.scopes() {
+		if l.Requests <= 0 || l.Per < time.Millisecond || l.Burst < 0 {
+			return nil, nil, fmt.Errorf("rate limit %s needs positive requests and per", name)
+		}
+	}
+
+	switch spec := os.Getenv("RATE_LIMIT_STORE"); {
+	case spec == "" || spec == "memory":
+		return &p, newMemoryRateLimiter(), nil
+	case strings.HasPrefix(spec, "redis://"), strings.HasPrefix(spec, "rediss://"):
+		client, err := newRedisClient(spec)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &p, &redisRateLimiter{client: client}, nil
+	default:
+		return nil, nil, fmt.Errorf("unknown RATE_LIMIT_STORE %q", spec)
+	}
+}
+
+// scopes lists every configured limit by name, for validation.
+func (p *RateLimitPolicy) scopes() map[string]rateLimit {
+	all := map[string]rateLimit{}
+	if p.Global != nil {
+		all["global"] = *p.Global
+	}
+	if p.Default != nil {
+		all["default"] = *p.Default
+	}
+	for k, l := range p.Keys {
+		all["keys."+k] = l
+	}
+	for u, l := range p.Users {
+		all["users."+u] = l
+	}
+	return all
+}
+
+// buckets returns the bucket keys and limits that apply to a caller.
+func (p *RateLimitPolicy) buckets(id *Identity) map[string]rateLimit {
+	buckets := map[string]rateLimit{}
+	if p.Global != nil {
+		buckets["global"] = *p.Global
+	}
+	if id == nil {
+		return buckets
+	}
+	if l, ok := p.Keys[id.KeyID]; ok && id.KeyID != "" {
+		buckets["key:"+id.KeyID] = l
+	}
+	if l, ok := p.Users[id.User]; ok {
+		buckets["user:"+id.Tenant+"/"+id.User] = l
+	} else if p.Default != nil {
+		buckets["user:"+id.Tenant+"/"+id.User] = *p.Default
+	}
+	return buckets
+}
+
+// rateDecision is the state of a bucket after a request tried to take a token.
+type rateDecision struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is how long until the next token, if none was left.
+	RetryAfter time.Duration
+}
+
+// RateLimiter keeps token buckets.
+type RateLimiter interface {
+	// Take removes a token from bucket key if it has one.
+	Take(ctx context.Context, key string, limit rateLimit) (rateDecision, error)
+}
+
+// decide takes a token from a bucket holding tokens, reporting the result and
+// the tokens left.
+func decide(limit rateLimit, tokens float64) (rateDecision, float64) {
+	d := rateDecision{Limit: int(limit.capacity())}
+	if tokens >= 1 {
+		tokens--
+		d.Allowed = true
+	} else {
+		d.RetryAfter = time.Duration((1-tokens)/limit.perMilli()) * time.Millisecond
+	}
+	d.Remaining = int(tokens)
+	d.Reset = time.Duration((limit.capacity()-tokens)/limit.perMilli()) * time.Millisecond
+	return d, tokens
+}
+
+// checkRateLimit takes a token from every bucket that applies to r and refuses
+// it if any was empty. The tightest bucket is kept on r for the RateLimit-*
+// response headers. Buckets the store cannot be reached for are skipped, so an
+// outage of a shared store does not take the shim down with it.
+func checkRateLimit(r *Request) error {
+	if rateLimitPolicy == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), redisDialTimeout)
+	defer cancel()
+
+	var tightest *rateDecision
+	for key, limit := range rateLimitPolicy.buckets(r.identity) {
+		d, err := rateLimiter.Take(ctx, key, limit)
+		if err != nil {
+			log.Printf("rate limit: failed to check %s: %v", key, err)
+			continue
+		}
+		if tightest == nil || (!d.Allowed && (tightest.Allowed || d.RetryAfter > tightest.RetryAfter)) ||
+			(d.Allowed && tightest.Allowed && d.Remaining < tightest.Remaining) {
+			tightest = &d
+		}
+	}
+	r.rateLimit = tightest
+	if tightest != nil && !tightest.Allowed {
+		return &codedError{Code: ErrRateLimited, Message: "rate limit exceeded, retry later"}
+	}
+	return nil
+}
+
+// rateLimitHeaders describes r's tightest bucket in the RateLimit-* headers,
+// with Retry-After once it is empty.
+func rateLimitHeaders(r Request) map[string]string {
+	d := r.rateLimit
+	if d == nil {
+		return nil
+	}
+	seconds := func(d time.Duration) string {
+		return strconv.Itoa(int(math.Ceil(d.Seconds())))
+	}
+	h := map[string]string{
+		"RateLimit-Limit":     strconv.Itoa(d.Limit),
+		"RateLimit-Remaining": strconv.Itoa(d.Remaining),
+		"RateLimit-Reset":     seconds(d.Reset),
+	}
+	if !d.Allowed {
+		h["Retry-After"] = seconds(max(d.RetryAfter, time.Second))
+	}
+	return h
+}
+
+// memoryRateLimiter keeps buckets in this process.
+type memoryRateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	limit   rateLimit
+	tokens  float64
+	updated time.Time
+}
+
+func newMemoryRateLimiter() *memoryRateLimiter {
+	return &memoryRateLimiter{buckets: map[string]*tokenBucket{}}
+}
+
+// refilled returns the tokens in b at now.
+func (b *tokenBucket) refilled(now time.Time) float64 {
+	elapsed := float64(now.Sub(b.updated).Milliseconds())
+	return min(b.limit.capacity(), b.tokens+elapsed*b.limit.perMilli())
+}
+
+func (m *memoryRateLimiter) Take(ctx context.Context, key string, limit rateLimit) (rateDecision, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	b, ok := m.buckets[key]
+	if !ok {
+		if len(m.buckets) >= maxIdleBuckets {
+			m.prune(now)
+		}
+		b = &tokenBucket{limit: limit, tokens: limit.capacity(), updated: now}
+		m.buckets[key] = b
+	}
+	b.limit = limit
+	d, tokens := decide(limit, b.refilled(now))
+	b.tokens, b.updated = tokens, now
+	return d, nil
+}
+
+// prune drops buckets that have refilled completely.
+func (m *memoryRateLimiter) prune(now time.Time) {
+	for key, b := range m.buckets {
+		if b.refilled(now) >= b.limit.capacity() {
+			delete(m.buckets, key)
+		}
+	}
+}
+
+// redisTakeScript refills and takes from a bucket stored as a hash of tokens
+// and the millisecond it was last updated, on the server's clock so instances
+// need not agree on the time. Tokens are returned as a string since Redis
+// truncates Lua numbers to integers.
+const redisTakeScript = `
+pcall(redis.replicate_commands)
+local capacity, rate = tonumber(ARGV[1]), tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local state = redis.call('HMGET', KEYS[1], 'tokens', 'updated')
+local tokens, updated = tonumber(state[1]), tonumber(state[2])
+if tokens == nil then
+  tokens, updated = capacity, now
+end
+tokens = math.min(capacity, tokens + math.max(0, now - updated) * rate)
+local allowed = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+end
+redis.call('HSET', KEYS[1], 'tokens', tostring(tokens), 'updated', now)
+redis.call('PEXPIRE', KEYS[1], math.ceil((capacity - tokens) / rate) + 1000)
+return {allowed, tostring(tokens)}
+`
+
+// redisRateLimiter keeps buckets in Redis, shared by every instance.
+type redisRateLimiter struct {
+	client *redisClient
+}
+
+func (l *redisRateLimiter) Take(ctx context.Context, key string, limit rateLimit) (rateDecision, error) {
+	reply, err := l.client.do(ctx, "EVAL", redisTakeScript, "1", redisRateLimitPrefix+key,
+		strconv.FormatFloat(limit.capacity(), 'f', -1, 64), strconv.FormatFloat(limit.perMilli(), 'g', -1, 64))
+	if err != nil {
+		return rateDecision{}, err
+	}
+	values, ok := reply.([]any)
+	if !ok || len(values) != 2 {
+		return rateDecision{}, fmt.Errorf("unexpected redis reply %v", reply)
+	}
+	var left string
+	switch v := values[1].(type) {
+	case []byte:
+		left = string(v)
+	case string:
+		left = v
+	}
+	tokens, err := strconv.ParseFloat(left, 64)
+	if err != nil {
+		return rateDecision{}, fmt.Errorf("unexpected redis reply %v", reply)
+	}
+	// the script already took the token; decide on what was there before
+	if allowed, _ := values[0].(int64); allowed == 1 {
+		tokens++
+	}
+	d, _ := decide(limit, tokens)
+	return d, nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDecide(t *testing.T) {
+	// 0.125 tokens per millisecond keeps every duration exact
+	limit := rateLimit{Requests: 2, Per: 16 * time.Millisecond}
+	tests := []struct {
+		name       string
+		limit      rateLimit
+		tokens     float64
+		want       rateDecision
+		wantTokens float64
+	}{
+		{"full bucket", limit, 2,
+			rateDecision{Allowed: true, Limit: 2, Remaining: 1, Reset: 8 * time.Millisecond}, 1},
+		{"partial token left over", limit, 1.5,
+			rateDecision{Allowed: true, Limit: 2, Remaining: 0, Reset: 12 * time.Millisecond}, 0.5},
+		{"exactly one token", limit, 1,
+			rateDecision{Allowed: true, Limit: 2, Remaining: 0, Reset: 16 * time.Millisecond}, 0},
+		{"less than a token", limit, 0.5,
+			rateDecision{Limit: 2, Remaining: 0, Reset: 12 * time.Millisecond, RetryAfter: 4 * time.Millisecond}, 0.5},
+		{"empty bucket", limit, 0,
+			rateDecision{Limit: 2, Remaining: 0, Reset: 16 * time.Millisecond, RetryAfter: 8 * time.Millisecond}, 0},
+		{"burst above rate", rateLimit{Requests: 2, Per: 16 * time.Millisecond, Burst: 8}, 8,
+			rateDecision{Allowed: true, Limit: 8, Remaining: 7, Reset: 8 * time.Millisecond}, 7},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, tokens := decide(tt.limit, tt.tokens)
+			if got != tt.want {
+				t.Errorf("decide() = %+v, want %+v", got, tt.want)
+			}
+			if tokens != tt.wantTokens {
+				t.Errorf("decide() tokens = %v, want %v", tokens, tt.wantTokens)
+			}
+		})
+	}
+}
+
+func TestMemoryRateLimiter(t *testing.T) {
+	// refills a token every 30s, slow enough that the test's own runtime adds
+	// nothing measurable
+	limit := rateLimit{Requests: 2, Per: time.Minute, Burst: 3}
+	type take struct {
+		key           string
+		elapsed       time.Duration
+		wantAllowed   bool
+		wantRemaining int
+	}
+	tests := []struct {
+		name  string
+		takes []take
+	}{
+		{"drains the burst then refuses", []take{
+			{"a", 0, true, 2},
+			{"a", 0, true, 1},
+			{"a", 0, true, 0},
+			{"a", 0, false, 0},
+		}},
+		{"refills at the rate", []take{
+			{"a", 0, true, 2},
+			{"a", 0, true, 1},
+			{"a", 0, true, 0},
+			{"a", 15 * time.Second, false, 0},
+			{"a", 15 * time.Second, true, 0},
+		}},
+		{"refills no higher than the burst", []take{
+			{"a", 0, true, 2},
+			{"a", time.Hour, true, 2},
+		}},
+		{"keeps keys apart", []take{
+			{"a", 0, true, 2},
+			{"a", 0, true, 1},
+			{"a", 0, true, 0},
+			{"b", 0, true, 2},
+			{"a", 0, false, 0},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newMemoryRateLimiter()
+			for i, step := range tt.takes {
+				if b, ok := m.buckets[step.key]; ok {
+					// wind the bucket's clock back rather than sleeping
+					b.updated = b.updated.Add(-step.elapsed)
+				}
+				d, err := m.Take(context.Background(), step.key, limit)
+				if err != nil {
+					t.Fatalf("take %d: Take() error = %v", i, err)
+				}
+				if d.Allowed != step.wantAllowed || d.Remaining != step.wantRemaining {
+					t.Errorf("take %d: Take(%s) = allowed %v, remaining %d, want %v, %d",
+						i, step.key, d.Allowed, d.Remaining, step.wantAllowed, step.wantRemaining)
+				}
+				if !d.Allowed && (d.RetryAfter <= 0 || d.RetryAfter > 30*time.Second) {
+					t.Errorf("take %d: RetryAfter = %v, want within 30s", i, d.RetryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryRateLimiterPrune(t *testing.T) {
+	limit := rateLimit{Requests: 1, Per: time.Minute}
+	m := newMemoryRateLimiter()
+	ctx := context.Background()
+	for _, key := range []string{"idle", "busy"} {
+		if _, err := m.Take(ctx, key, limit); err != nil {
+			t.Fatal(err)
+		}
+	}
+	m.buckets["idle"].updated = m.buckets["idle"].updated.Add(-time.Hour)
+
+	m.prune(time.Now())
+	if _, ok := m.buckets["idle"]; ok {
+		t.Error("prune() kept a full bucket")
+	}
+	if _, ok := m.buckets["busy"]; !ok {
+		t.Error("prune() dropped a bucket that is still refilling")
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisDialTimeout bounds connecting to the Redis server.
+const redisDialTimeout = 5 * time.Second
+
+// Keys namespacing session transcripts, metadata and the sets indexing them
+// in a shared Redis database.
+const (
+	redisSessionPrefix     = "agentcontainers:session:"
+	redisSessionMetaPrefix = "agentcontainers:session-meta:"
+	redisOwnerPrefix       = "agentcontainers:owner-sessions:"
+	redisAllSessions       = "agentcontainers:sessions"
+)
+
+// errRedisNil is the reply to a GET of a missing key.
+var errRedisNil = errors.New("redis: nil")
+
+// redisClient speaks just enough of the Redis protocol (RESP) to store and
+// fetch values. It opens a connection per command, which suits short-lived
+// Lambda instances and any Redis-compatible server.
+type redisClient struct {
+	addr     string
+	username string
+	password string
+	db       int
+	tls      bool
+}
+
+// newRedisClient parses redis://[[user]:password@]host[:port][/db]. The
+// rediss scheme connects over TLS.
+func newRedisClient(spec string) (*redisClient, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis url: %w", err)
+	}
+	c := &redisClient{addr: u.Host, tls: u.Scheme == "rediss"}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil {
+			return nil, fmt.Errorf("invalid redis database %q", db)
+		}
+	}
+	return c, nil
+}
+
+// do runs one command and returns its reply: a string, int64, []byte, []any
+// or nil. Error replies are returned as errors.
+func (c *redisClient) do(ctx context.Context, args ...string) (any, error) {
+	dialer := &net.Dialer{Timeout: redisDialTimeout}
+	var conn net.Conn
+	var err error
+	if c.tls {
+		host, _, _ := net.SplitHostPort(c.addr)
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}).DialContext(ctx, "tcp", c.addr)
+	} else {
+		conn, err = dialer.DialContext(ctx, "tcp", c.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	var cmds [][]string
+	if c.password != "" {
+		if c.username != "" {
+			cmds = append(cmds, []string{"AUTH", c.username, c.password})
+		} else {
+			cmds = append(cmds, []string{"AUTH", c.password})
+		}
+	}
+	if c.db != 0 {
+		cmds = append(cmds, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	cmds = append(cmds, args)
+
+	w := bufio.NewWriter(conn)
+	for _, cmd := range cmds {
+		fmt.Fprintf(w, "*%d\r\n", len(cmd))
+		for _, arg := range cmd {
+			fmt.Fprintf(w, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to send redis command: %w", err)
+	}
+
+	r := bufio.NewReader(conn)
+	var reply any
+	for range cmds {
+		if reply, err = readRESP(r); err != nil {
+			return nil, err
+		}
+	}
+	return reply, nil
+}
+
+// readRESP reads one reply.
+func readRESP(r *bufio.Reader) (any, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("failed to read redis reply: %w", err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid bulk length %q", line[1:])
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, fmt.Errorf("failed to read redis reply: %w", err)
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, fmt.Errorf("redis: invalid array length %q", line[1:])
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			items[i], err = readRESP(r)
+			if errors.Is(err, errRedisNil) {
+				err = nil
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
+
+// redisSessionStore keeps each transcript under its own key.
+type redisSessionStore struct {
+	client *redisClient
+}
+
+func newRedisSessionStore(spec string) (*redisSessionStore, error) {
+	client, err := newRedisClient(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &redisSessionStore{client: client}, nil
+}
+
+func (s *redisSessionStore) Load(ctx context.Context, id string) ([]byte, error) {
+	return s.get(ctx, redisSessionPrefix+id)
+}
+
+// get fetches key, mapping a missing key to errSessionNotFound.
+func (s *redisSessionStore) get(ctx context.Context, key string) ([]byte, error) {
+	reply, err := s.client.do(ctx, "GET", key)
+	if errors.Is(err, errRedisNil) {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	data, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected GET reply %T", reply)
+	}
+	return data, nil
+}
+
+func (s *redisSessionStore) Save(ctx context.Context, id string, transcript []byte) error {
+	_, err := s.client.do(ctx, "SET", redisSessionPrefix+id, string(transcript))
+	return err
+}
+
+func (s *redisSessionStore) LoadMeta(ctx context.Context, id string) (*SessionMeta, error) {
+	data, err := s.get(ctx, redisSessionMetaPrefix+id)
+	if err != nil {
+		return nil, err
+	}
+	var meta SessionMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("invalid session metadata %s: %w", id, err)
+	}
+	return &meta, nil
+}
+
+func (s *redisSessionStore) CreateMeta(ctx context.Context, meta SessionMeta) (bool, error) {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return false, err
+	}
+	_, err = s.client.do(ctx, "SET", redisSessionMetaPrefix+meta.ID, string(data), "NX")
+	if errors.Is(err, errRedisNil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, s.index(ctx, meta)
+}
+
+func (s *redisSessionStore) SaveMeta(ctx context.Context, meta SessionMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	if _, err := s.client.do(ctx, "SET", redisSessionMetaPrefix+meta.ID, string(data)); err != nil {
+		return err
+	}
+	return s.index(ctx, meta)
+}
+
+// index adds a session to the sets ListMeta reads.
+func (s *redisSessionStore) index(ctx context.Context, meta SessionMeta) error {
+	if _, err := s.client.do(ctx, "SADD", redisAllSessions, meta.ID); err != nil {
+		return err
+	}
+	_, err := s.client.do(ctx, "SADD", redisOwnerKey(meta.User, meta.Tenant), meta.ID)
+	return err
+}
+
+// redisOwnerKey is the set of sessions owned by user in tenant.
+func redisOwnerKey(user, tenant string) string {
+	return redisOwnerPrefix + strconv.Quote(tenant) + ":" + strconv.Quote(user)
+}
+
+func (s *redisSessionStore) ListMeta(ctx context.Context, owner *Identity) ([]SessionMeta, error) {
+	set := redisAllSessions
+	if owner != nil {
+		set = redisOwnerKey(owner.User, owner.Tenant)
+	}
+	reply, err := s.client.do(ctx, "SMEMBERS", set)
+	if err != nil {
+		return nil, err
+	}
+	ids, _ := reply.([]any)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	keys := []string{"MGET"}
+	for _, id := range ids {
+		if id, ok := id.([]byte); ok {
+			keys = append(keys, redisSessionMetaPrefix+string(id))
+		}
+	}
+	if reply, err = s.client.do(ctx, keys...); err != nil {
+		return nil, err
+	}
+	values, _ := reply.([]any)
+	var sessions []SessionMeta
+	for _, v := range values {
+		data, ok := v.([]byte)
+		if !ok {
+			continue // deleted since SMEMBERS
+		}
+		var meta SessionMeta
+		if err := json.Unmarshal(data, &meta); err != nil {
+			return nil, fmt.Errorf("invalid session metadata: %w", err)
+		}
+		if owner == nil || meta.ownedBy(owner) {
+			sessions = append(sessions, meta)
+		}
+	}
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+func (s *redisSessionStore) Delete(ctx context.Context, id string) error {
+	meta, err := s.LoadMeta(ctx, id)
+	if err != nil && !errors.Is(err, errSessionNotFound) {
+		return err
+	}
+	if _, err := s.client.do(ctx, "DEL", redisSessionPrefix+id, redisSessionMetaPrefix+id); err != nil {
+		return err
+	}
+	if _, err := s.client.do(ctx, "SREM", redisAllSessions, id); err != nil {
+		return err
+	}
+	if meta == nil {
+		return nil
+	}
+	_, err = s.client.do(ctx, "SREM", redisOwnerKey(meta.User, meta.Tenant), id)
+	return err
+}
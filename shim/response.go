@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// ErrorCode is the machine-readable reason a request failed.
+type ErrorCode string
+
+const (
+	// ErrBadRequest means the request was rejected before the agent ran.
+	ErrBadRequest ErrorCode = "bad_request"
+	// ErrAgent means the agent ran but reported a failure (e.g. max turns).
+	ErrAgent ErrorCode = "agent_error"
+	// ErrTimeout means the agent did not finish within its deadline.
+	ErrTimeout ErrorCode = "timeout"
+	// ErrCLICrashed means the CLI exited without producing a usable result.
+	ErrCLICrashed ErrorCode = "cli_crashed"
+	// ErrRateLimited means the caller or the upstream API is being throttled.
+	ErrRateLimited ErrorCode = "rate_limited"
+	// ErrUnauthorized means the caller could not be authenticated.
+	ErrUnauthorized ErrorCode = "unauthorized"
+	// ErrForbidden means operator policy does not allow what was requested.
+	ErrForbidden ErrorCode = "forbidden"
+	// ErrNotFound means the requested resource does not exist or is not the
+	// caller's.
+	ErrNotFound ErrorCode = "not_found"
+	// ErrInProgress means an earlier request with the same idempotency key is
+	// still running.
+	ErrInProgress ErrorCode = "in_progress"
+	// ErrBudgetExceeded means the caller, their tenant or the agent has spent
+	// its budget for the day or month.
+	ErrBudgetExceeded ErrorCode = "budget_exceeded"
+)
+
+// StatusCode maps an error code to the HTTP status returned to the caller.
+func (c ErrorCode) StatusCode() int {
+	switch c {
+	case ErrBadRequest:
+		return http.StatusBadRequest
+	case ErrUnauthorized:
+		return http.StatusUnauthorized
+	case ErrForbidden:
+		return http.StatusForbidden
+	case ErrNotFound:
+		return http.StatusNotFound
+	case ErrInProgress:
+		return http.StatusConflict
+	case ErrBudgetExceeded:
+		return http.StatusPaymentRequired
+	case ErrAgent:
+		return http.StatusUnprocessableEntity
+	case ErrTimeout:
+		return http.StatusGatewayTimeout
+	case ErrRateLimited:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusBadGateway
+	}
+}
+
+// ErrorInfo describes why a request failed.
+type ErrorInfo struct {
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+}
+
+// Response is the JSON envelope returned for every non-streaming request,
+// whether the failure came from the shim, the CLI or the agent itself.
+type Response struct {
+	Result        string          `json:"result"`
+	SessionID     string          `json:"session_id,omitempty"`
+	IsError       bool            `json:"is_error"`
+	NumTurns      int             `json:"num_turns"`
+	TotalCostUSD  float64         `json:"total_cost_usd"`
+	Usage         json.RawMessage `json:"usage,omitempty"`
+	DurationMS    int64           `json:"duration_ms"`
+	DurationAPIMS int64           `json:"duration_api_ms"`
+	DeniedTools   []string        `json:"denied_tools,omitempty"`
+	Error         *ErrorInfo      `json:"error,omitempty"`
+}
+
+// cliResult is the final result event printed by the CLI.
+type cliResult struct {
+	Type          string          `json:"type"`
+	Subtype       string          `json:"subtype"`
+	IsError       bool            `json:"is_error"`
+	Result        string          `json:"result"`
+	SessionID     string          `json:"session_id"`
+	NumTurns      int             `json:"num_turns"`
+	TotalCostUSD  float64         `json:"total_cost_usd"`
+	Usage         json.RawMessage `json:"usage"`
+	DurationMS    int64           `json:"duration_ms"`
+	DurationAPIMS int64           `json:"duration_api_ms"`
+}
+
+// codedError is an error that already knows how it should be reported.
+type codedError struct {
+	Code    ErrorCode
+	Message string
+}
+
+func (e *codedError) Error() string {
+	return e.Message
+}
+
+// errorResponseFrom builds an envelope for err, using its code if it has one.
+func errorResponseFrom(err error) Response {
+	var coded *codedError
+	if errors.As(err, &coded) {
+		return errorResponse(coded.Code, coded.Message)
+	}
+	return errorResponse(ErrCLICrashed, err.Error())
+}
+
+// errorResponse builds an envelope for a failure that produced no result.
+func errorResponse(code ErrorCode, message string) Response {
+	return Response{
+		IsError: true,
+		Error:   &ErrorInfo{Code: code, Message: message},
+	}
+}
+
+// parseCLIResult turns the CLI's result event, stderr and exit error into a
+// Response, classifying failures into the error code taxonomy.
+func parseCLIResult(stdOut, stdErr string, runErr error) Response {
+	var res cliResult
+	if err := json.Unmarshal([]byte(strings.TrimSpace(stdOut)), &res); err != nil || res.Type != "result" {
+		msg := strings.TrimSpace(stdErr)
+		if msg == "" && runErr != nil {
+			msg = runErr.Error()
+		}
+		if msg == "" {
+			msg = "claude produced no result"
+		}
+		if isRateLimited(msg) {
+			return errorResponse(ErrRateLimited, msg)
+		}
+		return errorResponse(ErrCLICrashed, msg)
+	}
+
+	resp := Response{
+		Result:        res.Result,
+		SessionID:     res.SessionID,
+		IsError:       res.IsError,
+		NumTurns:      res.NumTurns,
+		TotalCostUSD:  res.TotalCostUSD,
+		Usage:         res.Usage,
+		DurationMS:    res.DurationMS,
+		DurationAPIMS: res.DurationAPIMS,
+	}
+	if res.IsError {
+		msg := res.Result
+		if msg == "" {
+			msg = res.Subtype
+		}
+		code := ErrAgent
+		if isRateLimited(msg) {
+			code = ErrRateLimited
+		}
+		resp.Error = &ErrorInfo{Code: code, Message: msg}
+	}
+	return resp
+}
+
+// runState accumulates what is known about a run from its stream-json events
+// so that a run which never reaches its result event can still be reported.
+type runState struct {
+	sessionID string
+	lastText  string
+	result    []byte
+}
+
+// observe records the session id, the latest assistant text and the final
+// result from a single CLI event. It never fails so it can be used as an emit
+// function directly.
+func (s *runState) observe(eventType string, data []byte) error {
+	var ev struct {
+		SessionID string `json:"session_id"`
+		Message   struct {
+			Content []struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"content"`
+		} `json:"message"`
+	}
+	if err := json.Unmarshal(data, &ev); err != nil {
+		return nil
+	}
+	if ev.SessionID != "" {
+		s.sessionID = ev.SessionID
+	}
+	switch eventType {
+	case "assistant":
+		for _, c := range ev.Message.Content {
+			if c.Type == "text" && c.Text != "" {
+				s.lastText = c.Text
+			}
+		}
+	case "result":
+		s.result = append([]byte(nil), data...)
+	}
+	return nil
+}
+
+// response builds the envelope for a finished run. A run cut short by ctx
+// reports a timeout along with the session id and last assistant text seen so
+// far, so the caller can resume it.
+func (s *runState) response(ctx context.Context, runErr error) Response {
+	if s.result == nil && ctx.Err() != nil {
+		resp := errorResponse(ErrTimeout, "agent did not finish within its deadline")
+		if !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			resp = errorResponse(ErrCLICrashed, "agent run was cancelled")
+		}
+		resp.SessionID = s.sessionID
+		resp.Result = s.lastText
+		return resp
+	}
+	return parseCLIResult(string(s.result), "", runErr)
+}
+
+// isRateLimited reports whether an error message looks like an upstream
+// API throttling error.
+func isRateLimited(msg string) bool {
+	msg = strings.ToLower(msg)
+	return strings.Contains(msg, "rate limit") ||
+		strings.Contains(msg, "rate_limit") ||
+		strings.Contains(msg, "429")
+}
+
+// ProxyResponse wraps the envelope in an API Gateway proxy response with a
+// status code derived from the error, if any.
+func (r Response) ProxyResponse() events.APIGatewayProxyResponse {
+	statusCode := http.StatusOK
+	if r.Error != nil {
+		statusCode = r.Error.Code.StatusCode()
+	}
+	body, err := json.Marshal(r)
+	if err != nil {
+		log.Printf("failed to marshal response: %v", err)
+		statusCode = http.StatusInternalServerError
+		body = []byte(`{"is_error":true,"error":{"code":"cli_crashed","message":"failed to marshal response"}}`)
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: statusCode,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+	}
+}
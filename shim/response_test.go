@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+)
+
+func TestParseCLIResult(t *testing.T) {
+	tests := []struct {
+		name     string
+		stdout   string
+		stderr   string
+		runErr   error
+		wantCode ErrorCode
+		wantMsg  string
+	}{
+		{name: "success", stdout: `{"type":"result","subtype":"success","result":"hi","session_id":"s1","num_turns":2}`},
+		{name: "agent error", stdout: `{"type":"result","subtype":"error_max_turns","is_error":true}`,
+			runErr: errors.New("exit status 1"), wantCode: ErrAgent, wantMsg: "error_max_turns"},
+		{name: "throttled agent", stdout: `{"type":"result","is_error":true,"result":"API Error: 429 rate limit"}`,
+			wantCode: ErrRateLimited, wantMsg: "API Error: 429 rate limit"},
+		{name: "stderr", stderr: "segfault\n", runErr: errors.New("exit status 2"), wantCode: ErrCLICrashed, wantMsg: "segfault"},
+		{name: "exit error only", runErr: errors.New("signal: killed"), wantCode: ErrCLICrashed, wantMsg: "signal: killed"},
+		{name: "not a result", stdout: `{"type":"assistant"}`, wantCode: ErrCLICrashed, wantMsg: "claude produced no result"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := parseCLIResult(tt.stdout, tt.stderr, tt.runErr)
+			if tt.wantCode == "" {
+				if resp.Error != nil || resp.Result != "hi" || resp.SessionID != "s1" || resp.NumTurns != 2 {
+					t.Errorf("parseCLIResult() = %+v, want the CLI's result", resp)
+				}
+				return
+			}
+			if resp.Error == nil || resp.Error.Code != tt.wantCode || resp.Error.Message != tt.wantMsg || !resp.IsError {
+				t.Errorf("parseCLIResult() error = %+v, want %s %q", resp.Error, tt.wantCode, tt.wantMsg)
+			}
+		})
+	}
+}
+
+func TestResponseProxyResponse(t *testing.T) {
+	for code, want := range map[ErrorCode]int{
+		"":             http.StatusOK,
+		ErrBadRequest:  http.StatusBadRequest,
+		ErrAgent:       http.StatusUnprocessableEntity,
+		ErrTimeout:     http.StatusGatewayTimeout,
+		ErrRateLimited: http.StatusTooManyRequests,
+		ErrCLICrashed:  http.StatusBadGateway,
+	} {
+		r := Response{Result: "ok"}
+		if code != "" {
+			r = errorResponse(code, "failed")
+		}
+		resp := r.ProxyResponse()
+		if resp.StatusCode != want {
+			t.Errorf("%q: status = %d, want %d", code, resp.StatusCode, want)
+		}
+		var got Response
+		if err := json.Unmarshal([]byte(resp.Body), &got); err != nil || (code != "" && got.Error.Code != code) {
+			t.Errorf("%q: body %s does not round-trip: %v", code, resp.Body, err)
+		}
+	}
+}
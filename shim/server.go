@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// maxRequestBytes caps the size of a request body accepted by the HTTP server.
+	maxRequestBytes = 10 << 20
+	// shutdownTimeout is how long in-flight agent runs get to finish once a
+	// shutdown signal has been received.
+	shutdownTimeout = 5 * time.Minute
+)
+
+// serveHTTP runs the shim as a long-lived HTTP service on addr until SIGINT or
+// SIGTERM is received, then drains in-flight requests before returning.
+func serveHTTP(addr string) error {
+	var err error
+	if runPool, err = loadWorkerPool(); err != nil {
+		return fmt.Errorf("failed to load worker pool: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/run", handleRun)
+	mux.HandleFunc("POST "+jobsPath, handleSubmitJob)
+	mux.HandleFunc("GET "+jobsPath+"/{id}", handleGetJob)
+	// without authentication anyone could read and delete every session and
+	// see everyone's spending
+	if authenticator != nil {
+		mux.HandleFunc(usagePath, handleUsage)
+		mux.HandleFunc(sessionsPath, handleSessions)
+		mux.HandleFunc(sessionsPath+"/", handleSessions)
+	}
+	mux.HandleFunc("GET /metrics", handleMetrics)
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	errCh := make(chan error, 1)
+	go func() {
+		log.Printf("http: listening on %s", addr)
+		errCh <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Printf("http: shutting down, waiting up to %s for in-flight requests", shutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("http shutdown: %w", err)
+	}
+	// background jobs share the same grace period as in-flight requests
+	jobs.shutdown(shutdownCtx)
+	return nil
+}
+
+// handleRun authenticates the caller, decodes a Request from the body and runs
+// it through the same handler used by the Lambda and CLI modes.
+func handleRun(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	if err != nil {
+		writeProxyResponse(w, errorResponse(ErrBadRequest, fmt.Sprintf("failed to read body: %v", err)).ProxyResponse())
+		return
+	}
+	req, err := authenticateRequest(newAuthRequest(r, body))
+	if err != nil {
+		writeProxyResponse(w, errorResponseFrom(err).ProxyResponse())
+		return
+	}
+
+	if req.Stream {
+		handleStream(r.Context(), w, req)
+		return
+	}
+
+	resp, err := handler(r.Context(), req)
+	if err != nil {
+		resp = errorResponse(ErrCLICrashed, err.Error()).ProxyResponse()
+	}
+	writeProxyResponse(w, resp)
+}
+
+// writeProxyResponse writes resp the way API Gateway would translate a proxy
+// integration response, so callers see the same thing in both deployments.
+func writeProxyResponse(w http.ResponseWriter, resp events.APIGatewayProxyResponse) {
+	for k, v := range resp.Headers {
+		w.Header().Set(k, v)
+	}
+	for k, vs := range resp.MultiValueHeaders {
+		for _, v := range vs {
+			w.Header().Add(k, v)
+		}
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(resp.StatusCode)
+	if _, err := w.Write([]byte(resp.Body)); err != nil {
+		log.Printf("http: failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// fakeClaude puts a claude executable that runs script first on PATH.
+func fakeClaude(t *testing.T, script string) {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "claude"), []byte("#!/bin/sh\n"+script+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+func TestHandleRun(t *testing.T) {
+	tests := []struct {
+		name       string
+		script     string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"success", `echo '{"type":"result","result":"hi"}'`, `{"prompt":"hello"}`, http.StatusOK, `"result":"hi"`},
+		{"cli crash", `echo boom >&2; exit 1`, `{"prompt":"hello"}`, http.StatusBadGateway, `"code":"cli_crashed","message":"exit status 1: boom`},
+		{"invalid json", `exit 0`, `{"prompt":`, http.StatusBadRequest, `"code":"bad_request"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeClaude(t, tt.script)
+			rec := httptest.NewRecorder()
+			handleRun(rec, httptest.NewRequest(http.MethodPost, "/v1/run", strings.NewReader(tt.body)))
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if !strings.Contains(rec.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want it to contain %q", rec.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestWriteProxyResponse(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeProxyResponse(rec, events.APIGatewayProxyResponse{
+		StatusCode:        http.StatusCreated,
+		Headers:           map[string]string{"X-Request-Id": "r1"},
+		MultiValueHeaders: map[string][]string{"Set-Cookie": {"a=1", "b=2"}},
+		Body:              "created",
+	})
+	if rec.Code != http.StatusCreated || rec.Body.String() != "created" {
+		t.Errorf("wrote %d %q, want 201 created", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Values("Set-Cookie"); len(got) != 2 {
+		t.Errorf("Set-Cookie = %v, want both values", got)
+	}
+	if rec.Header().Get("X-Request-Id") != "r1" || rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("headers = %v, want X-Request-Id and a JSON content type", rec.Header())
+	}
+
+	// a content type of the response's own is kept
+	rec = httptest.NewRecorder()
+	writeProxyResponse(rec, events.APIGatewayProxyResponse{StatusCode: http.StatusOK, Headers: map[string]string{"Content-Type": "text/plain"}})
+	if got := rec.Header().Get("Content-Type"); got != "text/plain" {
+		t.Errorf("Content-Type = %q, want text/plain", got)
+	}
+}
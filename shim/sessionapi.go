@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// sessionsPath is the root of the session management API:
+//
+//	GET    /v1/sessions                 the caller's sessions, most recent first
+//	GET    /v1/sessions/{id}            the normalized transcript as JSON
+//	GET    /v1/sessions/{id}/markdown   the transcript as Markdown
+//	POST   /v1/sessions/{id}/fork       copy the session under a new id
+//	DELETE /v1/sessions/{id}            delete the session and its files
+const sessionsPath = "/v1/sessions"
+
+// sessionAPI serves one session management call for caller, a nil caller
+// meaning authentication is disabled and every session is visible. It is
+// shared by the HTTP server, Lambda HTTP events and the CLI.
+func sessionAPI(ctx context.Context, caller *Identity, method, path string) events.APIGatewayProxyResponse {
+	rest := strings.Trim(strings.TrimPrefix(path, sessionsPath), "/")
+	if rest == "" {
+		if method != http.MethodGet {
+			return methodNotAllowed(method, path)
+		}
+		sessions, err := listSessions(ctx, caller)
+		if err != nil {
+			return errorResponseFrom(err).ProxyResponse()
+		}
+		if sessions == nil {
+			sessions = []SessionMeta{}
+		}
+		return jsonResponse(http.StatusOK, map[string]any{"sessions": sessions})
+	}
+
+	id, action, _ := strings.Cut(rest, "/")
+	if !sessionIDPattern.MatchString(id) {
+		return errorResponse(ErrNotFound, fmt.Sprintf("session %s not found", id)).ProxyResponse()
+	}
+
+	switch {
+	case action == "" && method == http.MethodGet:
+		t, err := sessionTranscript(ctx, caller, id)
+		if err != nil {
+			return errorResponseFrom(err).ProxyResponse()
+		}
+		return jsonResponse(http.StatusOK, t)
+	case action == "" && method == http.MethodDelete:
+		if err := deleteSession(ctx, caller, id); err != nil {
+			return errorResponseFrom(err).ProxyResponse()
+		}
+		return jsonResponse(http.StatusOK, map[string]string{"deleted": id})
+	case action == "markdown" && method == http.MethodGet:
+		t, err := sessionTranscript(ctx, caller, id)
+		if err != nil {
+			return errorResponseFrom(err).ProxyResponse()
+		}
+		return events.APIGatewayProxyResponse{
+			StatusCode: http.StatusOK,
+			Headers: map[string]string{
+				"Content-Type":        "text/markdown; charset=utf-8",
+				"Content-Disposition": fmt.Sprintf(`attachment; filename="%s.md"`, id),
+			},
+			Body: t.Markdown(),
+		}
+	case action == "fork" && method == http.MethodPost:
+		meta, err := forkSession(ctx, caller, id)
+		if err != nil {
+			return errorResponseFrom(err).ProxyResponse()
+		}
+		return jsonResponse(http.StatusCreated, meta)
+	case action == "" || action == "markdown" || action == "fork":
+		return methodNotAllowed(method, path)
+	default:
+		return errorResponse(ErrNotFound, fmt.Sprintf("no such endpoint %s", path)).ProxyResponse()
+	}
+}
+
+func methodNotAllowed(method, path string) events.APIGatewayProxyResponse {
+	return errorResponse(ErrBadRequest, fmt.Sprintf("method %s is not allowed on %s", method, path)).ProxyResponse()
+}
+
+// jsonResponse wraps v in a proxy response.
+func jsonResponse(status int, v any) events.APIGatewayProxyResponse {
+	body, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("failed to marshal response: %v", err)
+		return errorResponse(ErrCLICrashed, "failed to marshal response").ProxyResponse()
+	}
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+	}
+}
+
+// handleSessions serves the session management API over HTTP.
+func handleSessions(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBytes))
+	if err != nil {
+		writeProxyResponse(w, errorResponse(ErrBadRequest, fmt.Sprintf("failed to read body: %v", err)).ProxyResponse())
+		return
+	}
+	caller, err := authenticateCaller(newAuthRequest(r, body))
+	if err != nil {
+		writeProxyResponse(w, errorResponseFrom(err).ProxyResponse())
+		return
+	}
+	writeProxyResponse(w, sessionAPI(r.Context(), caller, r.Method, r.URL.Path))
+}
+
+// runSessionsCommand implements "shim sessions <command> [id]" for operators
+// with access to the container, printing what the HTTP API would return.
+func runSessionsCommand(args []string) error {
+	usage := errors.New("usage: shim sessions list | show <id> | markdown <id> | fork <id> | delete <id>")
+	if len(args) == 0 {
+		return usage
+	}
+	var method, path string
+	switch cmd := args[0]; {
+	case cmd == "list" && len(args) == 1:
+		method, path = http.MethodGet, sessionsPath
+	case cmd == "show" && len(args) == 2:
+		method, path = http.MethodGet, sessionsPath+"/"+args[1]
+	case cmd == "markdown" && len(args) == 2:
+		method, path = http.MethodGet, sessionsPath+"/"+args[1]+"/markdown"
+	case cmd == "fork" && len(args) == 2:
+		method, path = http.MethodPost, sessionsPath+"/"+args[1]+"/fork"
+	case cmd == "delete" && len(args) == 2:
+		method, path = http.MethodDelete, sessionsPath+"/"+args[1]
+	default:
+		return usage
+	}
+
+	resp := sessionAPI(context.Background(), nil, method, path)
+	fmt.Println(resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s failed with status %d", method, path, resp.StatusCode)
+	}
+	return nil
+}
+
+// listSessions returns the sessions visible to caller.
+func listSessions(ctx context.Context, caller *Identity) ([]SessionMeta, error) {
+	store := sessionMetas()
+	if store == nil {
+		return nil, nil
+	}
+	sessions, err := store.ListMeta(ctx, caller)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	return sessions, nil
+}
+
+// findSession returns the metadata of session id if caller may see it.
+// Unknown and foreign sessions are both reported as not found.
+func findSession(ctx context.Context, caller *Identity, id string) (*SessionMeta, error) {
+	notFound := &codedError{Code: ErrNotFound, Message: fmt.Sprintf("session %s not found", id)}
+	store := sessionMetas()
+	if store == nil {
+		return nil, notFound
+	}
+	meta, err := store.LoadMeta(ctx, id)
+	if errors.Is(err, errSessionNotFound) {
+		return nil, notFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up session %s: %w", id, err)
+	}
+	if caller != nil && !meta.ownedBy(caller) {
+		return nil, notFound
+	}
+	return meta, nil
+}
+
+// sessionTranscript returns the normalized transcript of session id.
+func sessionTranscript(ctx context.Context, caller *Identity, id string) (*Transcript, error) {
+	meta, err := findSession(ctx, caller, id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := loadTranscript(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := parseTranscript(data)
+	if err != nil {
+		return nil, err
+	}
+	if messages == nil {
+		messages = []TranscriptMessage{}
+	}
+	return &Transcript{SessionMeta: *meta, Messages: messages}, nil
+}
+
+// loadTranscript reads the CLI transcript of session id from the session
+// store, falling back to the CLI's projects directory.
+func loadTranscript(ctx context.Context, id string) ([]byte, error) {
+	if sessionStore != nil {
+		data, err := sessionStore.Load(ctx, id)
+		if err == nil {
+			return data, nil
+		}
+		if !errors.Is(err, errSessionNotFound) {
+			return nil, fmt.Errorf("failed to load session %s: %w", id, err)
+		}
+	}
+	paths := localTranscripts(id)
+	if len(paths) == 0 {
+		return nil, &codedError{Code: ErrNotFound, Message: fmt.Sprintf("transcript of session %s not found", id)}
+	}
+	return os.ReadFile(paths[0])
+}
+
+// localTranscripts finds the CLI's transcripts of session id, whichever
+// working directory it ran in.
+func localTranscripts(id string) []string {
+	paths, _ := filepath.Glob(filepath.Join(claudeConfigDir(), "projects", "*", id+".jsonl"))
+	return paths
+}
+
+// forkSession copies session id under a new session id that can be resumed
+// independently. The fork keeps the original's owner, title, turn count and
+// cost so far.
+func forkSession(ctx context.Context, caller *Identity, id string) (*SessionMeta, error) {
+	meta, err := findSession(ctx, caller, id)
+	if err != nil {
+		return nil, err
+	}
+	data, err := loadTranscript(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	forkID, err := newSessionID()
+	if err != nil {
+		return nil, err
+	}
+	forked := rewriteSessionID(data, forkID)
+
+	if sessionStore != nil {
+		if err := sessionStore.Save(ctx, forkID, forked); err != nil {
+			return nil, fmt.Errorf("failed to save fork: %w", err)
+		}
+	} else {
+		// next to the original, where a resume from the same workspace looks
+		dir := filepath.Dir(localTranscripts(id)[0])
+		if err := writeFileAtomic(filepath.Join(dir, forkID+".jsonl"), forked); err != nil {
+			return nil, fmt.Errorf("failed to save fork: %w", err)
+		}
+	}
+
+	fork := *meta
+	fork.ID = forkID
+	fork.ForkedFrom = id
+	fork.CreatedAt = time.Now().UTC()
+	fork.UpdatedAt = fork.CreatedAt
+	if err := sessionMetas().SaveMeta(ctx, fork); err != nil {
+		return nil, fmt.Errorf("failed to save fork: %w", err)
+	}
+	return &fork, nil
+}
+
+// rewriteSessionID points every line of a CLI transcript at session id.
+func rewriteSessionID(data []byte, id string) []byte {
+	newID, _ := json.Marshal(id)
+	var out bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxEventBytes)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(line, &fields); err == nil {
+			if _, ok := fields["sessionId"]; ok {
+				fields["sessionId"] = newID
+				if rewritten, err := json.Marshal(fields); err == nil {
+					line = rewritten
+				}
+			}
+		}
+		out.Write(line)
+		out.WriteByte('\n')
+	}
+	return out.Bytes()
+}
+
+// newSessionID returns a random UUID in the form the CLI uses.
+func newSessionID() (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "", fmt.Errorf("failed to generate session id: %w", err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+// deleteSession removes session id from the store along with the CLI's local
+// transcript and todo files for it.
+func deleteSession(ctx context.Context, caller *Identity, id string) error {
+	if _, err := findSession(ctx, caller, id); err != nil {
+		return err
+	}
+	if err := sessionMetas().Delete(ctx, id); err != nil {
+		return fmt.Errorf("failed to delete session %s: %w", id, err)
+	}
+
+	config := claudeConfigDir()
+	var files []string
+	for _, pattern := range []string{
+		filepath.Join(config, "projects", "*", id+".jsonl"),
+		filepath.Join(config, "projects", "*", id),
+		filepath.Join(config, "todos", id+"-*.json"),
+	} {
+		matches, _ := filepath.Glob(pattern)
+		files = append(files, matches...)
+	}
+	for _, file := range files {
+		if err := os.RemoveAll(file); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", file, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// errSessionNotFound is returned by a SessionStore that has no transcript for
+// the requested session.
+var errSessionNotFound = errors.New("session not found")
+
+// persistTimeout bounds saving a transcript after a run, which happens even
+// when the run's own context has already expired.
+const persistTimeout = 30 * time.Second
+
+// SessionStore keeps session transcripts outside the CLI's projects directory
+// so that a session started on one instance can be resumed on another.
+// Transcripts are the CLI's own JSONL files, stored opaquely by session id,
+// next to the shim's own metadata about each session. CreateMeta stores meta
+// only if the session has none yet, atomically, and reports whether it did.
+type SessionStore interface {
+	Load(ctx context.Context, id string) ([]byte, error)
+	Save(ctx context.Context, id string, transcript []byte) error
+	LoadMeta(ctx context.Context, id string) (*SessionMeta, error)
+	CreateMeta(ctx context.Context, meta SessionMeta) (bool, error)
+	SaveMeta(ctx context.Context, meta SessionMeta) error
+	// ListMeta returns the metadata of every session owned by owner, or of
+	// all sessions if owner is nil.
+	ListMeta(ctx context.Context, owner *Identity) ([]SessionMeta, error)
+	// Delete removes the transcript and metadata of a session.
+	Delete(ctx context.Context, id string) error
+}
+
+// SessionMeta records who a session belongs to and what it has cost so far.
+// User and Tenant are empty for sessions created without authentication.
+type SessionMeta struct {
+	ID           string    `json:"session_id"`
+	User         string    `json:"user,omitempty"`
+	Tenant       string    `json:"tenant,omitempty"`
+	Title        string    `json:"title"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	NumTurns     int       `json:"num_turns"`
+	TotalCostUSD float64   `json:"total_cost_usd"`
+	ForkedFrom   string    `json:"forked_from,omitempty"`
+}
+
+// sessionRun is what one run adds to its session.
+type sessionRun struct {
+	id           string
+	numTurns     int
+	costUSD      float64
+	inputTokens  int64
+	outputTokens int64
+}
+
+// maxTitleRunes caps the title taken from a session's first prompt.
+const maxTitleRunes = 80
+
+// sessionStore is the store configured by SESSION_STORE, or nil if sessions
+// only live on local disk.
+var sessionStore SessionStore
+
+// localSessions holds session metadata when no SESSION_STORE is configured.
+var localSessions SessionStore
+
+// loadSessionStore opens the store named by SESSION_STORE:
+//
+//	file:/mnt/state/sessions        one <id>.jsonl file per session
+//	sqlite:/mnt/state/sessions.db   a single SQLite database
+//	redis://:password@host:6379/0   a Redis protocol server (rediss:// for TLS)
+func loadSessionStore() (SessionStore, error) {
+	spec := os.Getenv("SESSION_STORE")
+	switch {
+	case spec == "":
+		return nil, nil
+	case strings.HasPrefix(spec, "file:"):
+		return newFileSessionStore(strings.TrimPrefix(spec, "file:"))
+	case strings.HasPrefix(spec, "sqlite:"):
+		return newSQLiteSessionStore(strings.TrimPrefix(spec, "sqlite:"))
+	case strings.HasPrefix(spec, "redis://"), strings.HasPrefix(spec, "rediss://"):
+		return newRedisSessionStore(spec)
+	default:
+		return nil, fmt.Errorf("unknown SESSION_STORE %q", spec)
+	}
+}
+
+// nonAlphanumeric matches the characters the CLI replaces when naming a
+// project directory after its working directory.
+var nonAlphanumeric = regexp.MustCompile(`[^A-Za-z0-9]`)
+
+// claudeConfigDir is the CLI's configuration directory.
+func claudeConfigDir() string {
+	if dir := os.Getenv("CLAUDE_CONFIG_DIR"); dir != "" {
+		return dir
+	}
+	home, _ := os.UserHomeDir()
+	return filepath.Join(home, ".claude")
+}
+
+// transcriptPath is where the CLI keeps the transcript of session id for runs
+// started in the working directory dir.
+func transcriptPath(dir, id string) string {
+	return filepath.Join(claudeConfigDir(), "projects", nonAlphanumeric.ReplaceAllString(dir, "-"), id+".jsonl")
+}
+
+// hydrateSession copies the transcript of the session r resumes from the
+// store into the CLI's projects directory. A session the store does not know
+// is left to the CLI, which may still find it on local disk.
+func hydrateSession(ctx context.Context, r Request) error {
+	if sessionStore == nil || r.ResumeSessionID == nil {
+		return nil
+	}
+	transcript, err := sessionStore.Load(ctx, *r.ResumeSessionID)
+	if errors.Is(err, errSessionNotFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load session %s: %w", *r.ResumeSessionID, err)
+	}
+	path := transcriptPath(runDir(r), *r.ResumeSessionID)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("failed to create project dir: %w", err)
+	}
+	if err := writeFileAtomic(path, transcript); err != nil {
+		return fmt.Errorf("failed to hydrate session %s: %w", *r.ResumeSessionID, err)
+	}
+	return nil
+}
+
+// persistSession records the run in its session's metadata and saves the
+// transcript the CLI wrote back to the store. It runs after every run,
+// including failed and timed-out ones, so whatever the agent did can still be
+// resumed; failures are only logged.
+func persistSession(r Request, run sessionRun) {
+	id := run.id
+	if id == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+
+	if err := recordSession(ctx, r, run); err != nil {
+		log.Printf("session store: failed to record session %s: %v", id, err)
+	}
+	if sessionStore == nil {
+		return
+	}
+	transcript, err := os.ReadFile(transcriptPath(runDir(r), id))
+	if err != nil {
+		log.Printf("session store: failed to read transcript %s: %v", id, err)
+		return
+	}
+	if err := sessionStore.Save(ctx, id, transcript); err != nil {
+		log.Printf("session store: failed to save session %s: %v", id, err)
+	}
+}
+
+// sessionMetas is where session metadata is kept: the shared store if there
+// is one, else local disk.
+func sessionMetas() SessionStore {
+	if sessionStore != nil {
+		return sessionStore
+	}
+	return localSessions
+}
+
+// loadLocalSessions opens the metadata store used without SESSION_STORE.
+func loadLocalSessions() (SessionStore, error) {
+	return newFileSessionStore(filepath.Join(claudeConfigDir(), "shim-sessions"))
+}
+
+// recordSession creates or updates the metadata of run's session. A session
+// keeps the owner and title it was created with, whoever resumes it later:
+// the first run to record a session claims it with CreateMeta, so two
+// concurrent first runs cannot both become its owner.
+func recordSession(ctx context.Context, r Request, run sessionRun) error {
+	store := sessionMetas()
+	if store == nil {
+		return nil
+	}
+	now := time.Now().UTC()
+	meta := &SessionMeta{
+		ID:           run.id,
+		Title:        promptTitle(r.Prompt),
+		CreatedAt:    now,
+		UpdatedAt:    now,
+		NumTurns:     run.numTurns,
+		TotalCostUSD: run.costUSD,
+	}
+	if r.identity != nil {
+		meta.User, meta.Tenant = r.identity.User, r.identity.Tenant
+	}
+	created, err := store.CreateMeta(ctx, *meta)
+	if err != nil || created {
+		return err
+	}
+	if meta, err = store.LoadMeta(ctx, run.id); err != nil {
+		return err
+	}
+	meta.UpdatedAt = now
+	meta.NumTurns += run.numTurns
+	meta.TotalCostUSD += run.costUSD
+	return store.SaveMeta(ctx, *meta)
+}
+
+// promptTitle is the first line of a prompt's text, shortened to a title.
+func promptTitle(raw json.RawMessage) string {
+	text, blocks, _ := parsePrompt(raw)
+	for _, b := range blocks {
+		if b.Type == "text" {
+			text = b.Text
+			break
+		}
+	}
+	text, _, _ = strings.Cut(strings.TrimSpace(text), "\n")
+	if runes := []rune(text); len(runes) > maxTitleRunes {
+		text = string(runes[:maxTitleRunes-1]) + "…"
+	}
+	return text
+}
+
+// checkSessionOwner refuses to resume a session that was not created by r's
+// caller. Unauthenticated requests are not checked, since there is no caller
+// to tell apart. Unknown and foreign sessions are refused alike so callers
+// cannot probe which session ids exist.
+func checkSessionOwner(r Request) error {
+	if r.ResumeSessionID == nil || r.identity == nil {
+		return nil
+	}
+	denied := &codedError{Code: ErrForbidden, Message: fmt.Sprintf("session %s is not available to this caller", *r.ResumeSessionID)}
+	store := sessionMetas()
+	if store == nil {
+		return denied
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	meta, err := store.LoadMeta(ctx, *r.ResumeSessionID)
+	if errors.Is(err, errSessionNotFound) {
+		return denied
+	}
+	if err != nil {
+		return fmt.Errorf("failed to look up session %s: %w", *r.ResumeSessionID, err)
+	}
+	if !meta.ownedBy(r.identity) {
+		return denied
+	}
+	return nil
+}
+
+// ownedBy reports whether id is the session's owner.
+func (m *SessionMeta) ownedBy(id *Identity) bool {
+	return m.User != "" && m.User == id.User && m.Tenant == id.Tenant
+}
+
+// sortSessions orders sessions by most recent activity first.
+func sortSessions(sessions []SessionMeta) {
+	slices.SortFunc(sessions, func(a, b SessionMeta) int {
+		return b.UpdatedAt.Compare(a.UpdatedAt)
+	})
+}
+
+// writeFileAtomic replaces path with data so readers never see a partial file.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// createFileExclusive writes data to path only if path does not exist yet,
+// reporting whether it did. The file appears complete or not at all.
+func createFileExclusive(path string, data []byte) (bool, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return false, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Link(tmp.Name(), path); err != nil {
+		if os.IsExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// fileSessionStore keeps each transcript as <dir>/<id>.jsonl, e.g. on a
+// shared volume.
+type fileSessionStore struct {
+	dir string
+}
+
+func newFileSessionStore(dir string) (*fileSessionStore, error) {
+	if dir == "" {
+		return nil, errors.New("file session store requires a directory")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create session dir: %w", err)
+	}
+	return &fileSessionStore{dir: dir}, nil
+}
+
+func (s *fileSessionStore) Load(ctx context.Context, id string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, id+".jsonl"))
+	if os.IsNotExist(err) {
+		return nil, errSessionNotFound
+	}
+	return data, err
+}
+
+func (s *fileSessionStore) Save(ctx context.Context, id string, transcript []byte) error {
+	return writeFileAtomic(filepath.Join(s.dir, id+".jsonl"), transcript)
+}
+
+func (s *fileSessionStore) LoadMeta(ctx context.Context, id string) (*SessionMeta, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, id+".meta.json"))
+	if os.IsNotExist(err) {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var meta SessionMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("invalid session metadata %s: %w", id, err)
+	}
+	return &meta, nil
+}
+
+func (s *fileSessionStore) CreateMeta(ctx context.Context, meta SessionMeta) (bool, error) {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return false, err
+	}
+	return createFileExclusive(filepath.Join(s.dir, meta.ID+".meta.json"), data)
+}
+
+func (s *fileSessionStore) SaveMeta(ctx context.Context, meta SessionMeta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(s.dir, meta.ID+".meta.json"), data)
+}
+
+func (s *fileSessionStore) ListMeta(ctx context.Context, owner *Identity) ([]SessionMeta, error) {
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.meta.json"))
+	if err != nil {
+		return nil, err
+	}
+	var sessions []SessionMeta
+	for _, file := range files {
+		meta, err := s.LoadMeta(ctx, strings.TrimSuffix(filepath.Base(file), ".meta.json"))
+		if errors.Is(err, errSessionNotFound) {
+			continue // deleted since the glob
+		}
+		if err != nil {
+			return nil, err
+		}
+		if owner == nil || meta.ownedBy(owner) {
+			sessions = append(sessions, *meta)
+		}
+	}
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+func (s *fileSessionStore) Delete(ctx context.Context, id string) error {
+	for _, name := range []string{id + ".jsonl", id + ".meta.json"} {
+		if err := os.Remove(filepath.Join(s.dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
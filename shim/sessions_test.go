@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// fakeRedis serves the few Redis commands redisSessionStore sends, keeping
+// strings and sets in memory.
+type fakeRedis struct {
+	mu      sync.Mutex
+	strings map[string][]byte
+	sets    map[string]map[string]bool
+}
+
+// startFakeRedis listens on a local port and returns a redis:// url for it.
+func startFakeRedis(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	f := &fakeRedis{strings: map[string][]byte{}, sets: map[string]map[string]bool{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(conn)
+		}
+	}()
+	return "redis://" + ln.Addr().String()
+}
+
+func (f *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		req, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		items, _ := req.([]any)
+		var args []string
+		for _, item := range items {
+			b, _ := item.([]byte)
+			args = append(args, string(b))
+		}
+		if _, err := conn.Write(f.reply(args)); err != nil {
+			return
+		}
+	}
+}
+
+func (f *fakeRedis) reply(args []string) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(args) == 0 {
+		return []byte("-ERR empty command\r\n")
+	}
+	switch args[0] {
+	case "AUTH", "SELECT":
+		return []byte("+OK\r\n")
+	case "SET":
+		if len(args) > 3 && args[3] == "NX" && f.strings[args[1]] != nil {
+			return bulk(nil, false)
+		}
+		f.strings[args[1]] = []byte(args[2])
+		return []byte("+OK\r\n")
+	case "GET":
+		return bulk(f.strings[args[1]], f.strings[args[1]] != nil)
+	case "MGET":
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "*%d\r\n", len(args)-1)
+		for _, key := range args[1:] {
+			b.Write(bulk(f.strings[key], f.strings[key] != nil))
+		}
+		return b.Bytes()
+	case "DEL":
+		n := 0
+		for _, key := range args[1:] {
+			if _, ok := f.strings[key]; ok {
+				delete(f.strings, key)
+				n++
+			}
+		}
+		return []byte(fmt.Sprintf(":%d\r\n", n))
+	case "SADD":
+		if f.sets[args[1]] == nil {
+			f.sets[args[1]] = map[string]bool{}
+		}
+		f.sets[args[1]][args[2]] = true
+		return []byte(":1\r\n")
+	case "SREM":
+		delete(f.sets[args[1]], args[2])
+		return []byte(":1\r\n")
+	case "SMEMBERS":
+		var b bytes.Buffer
+		fmt.Fprintf(&b, "*%d\r\n", len(f.sets[args[1]]))
+		for member := range f.sets[args[1]] {
+			b.Write(bulk([]byte(member), true))
+		}
+		return b.Bytes()
+	default:
+		return []byte("-ERR unknown command " + args[0] + "\r\n")
+	}
+}
+
+// bulk renders a bulk string reply, or the nil reply if !ok.
+func bulk(data []byte, ok bool) []byte {
+	if !ok {
+		return []byte("$-1\r\n")
+	}
+	return append(fmt.Appendf(nil, "$%d\r\n", len(data)), append(data, '\r', '\n')...)
+}
+
+// sessionStores opens each kind of session store in a fresh location.
+var sessionStores = []struct {
+	name string
+	open func(t *testing.T) (SessionStore, error)
+}{
+	{"file", func(t *testing.T) (SessionStore, error) {
+		return newFileSessionStore(t.TempDir())
+	}},
+	{"sqlite", func(t *testing.T) (SessionStore, error) {
+		return newSQLiteSessionStore(filepath.Join(t.TempDir(), "sessions.db"))
+	}},
+	{"redis", func(t *testing.T) (SessionStore, error) {
+		return newRedisSessionStore(startFakeRedis(t))
+	}},
+}
+
+func TestSessionStoreRoundTrip(t *testing.T) {
+	for _, tt := range sessionStores {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := tt.open(t)
+			if err != nil {
+				t.Fatalf("failed to open store: %v", err)
+			}
+			t.Setenv("CLAUDE_CONFIG_DIR", t.TempDir())
+			sessionStore = store
+			t.Cleanup(func() { sessionStore = nil })
+
+			const id = "0b0e9a4e-5a4e-4d43-9a4c-3c1b8f6d2a10"
+			// transcripts are stored opaquely, NUL and invalid UTF-8 included
+			transcript := []byte("{\"type\":\"user\",\"text\":\"it's \\u00e9t\\u00e9\"}\n\x00\xff{\"type\":\"assistant\"}\n")
+			owner := &Identity{User: "alice", Tenant: "acme"}
+			r := Request{Prompt: json.RawMessage(`"Plan the garden\nin detail"`), identity: owner}
+
+			if _, err := store.Load(context.Background(), id); !errors.Is(err, errSessionNotFound) {
+				t.Fatalf("Load() of an unknown session error = %v, want errSessionNotFound", err)
+			}
+
+			// the CLI wrote a transcript on this instance; persist it
+			path := transcriptPath(runDir(r), id)
+			if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, transcript, 0o600); err != nil {
+				t.Fatal(err)
+			}
+			persistSession(r, sessionRun{id: id, numTurns: 2, costUSD: 0.25})
+			persistSession(r, sessionRun{id: id, numTurns: 1, costUSD: 0.5})
+
+			// another instance resumes it
+			if err := os.Remove(path); err != nil {
+				t.Fatal(err)
+			}
+			resume := id
+			r.ResumeSessionID = &resume
+			if err := hydrateSession(context.Background(), r); err != nil {
+				t.Fatalf("hydrateSession() error = %v", err)
+			}
+			got, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("transcript not hydrated: %v", err)
+			}
+			if !bytes.Equal(got, transcript) {
+				t.Errorf("hydrated transcript = %q, want %q", got, transcript)
+			}
+
+			ctx := context.Background()
+			meta, err := store.LoadMeta(ctx, id)
+			if err != nil {
+				t.Fatalf("LoadMeta() error = %v", err)
+			}
+			if meta.User != "alice" || meta.Tenant != "acme" || meta.Title != "Plan the garden" ||
+				meta.NumTurns != 3 || meta.TotalCostUSD != 0.75 {
+				t.Errorf("LoadMeta() = %+v", meta)
+			}
+			for _, lister := range []*Identity{owner, nil} {
+				sessions, err := store.ListMeta(ctx, lister)
+				if err != nil {
+					t.Fatalf("ListMeta(%v) error = %v", lister, err)
+				}
+				if !slices.ContainsFunc(sessions, func(m SessionMeta) bool { return m.ID == id }) {
+					t.Errorf("ListMeta(%v) = %+v, want session %s", lister, sessions, id)
+				}
+			}
+			if sessions, err := store.ListMeta(ctx, &Identity{User: "bob", Tenant: "acme"}); err != nil || len(sessions) != 0 {
+				t.Errorf("ListMeta(bob) = %+v, %v, want none", sessions, err)
+			}
+
+			if err := store.Delete(ctx, id); err != nil {
+				t.Fatalf("Delete() error = %v", err)
+			}
+			if _, err := store.Load(ctx, id); !errors.Is(err, errSessionNotFound) {
+				t.Errorf("Load() after Delete error = %v, want errSessionNotFound", err)
+			}
+			if _, err := store.LoadMeta(ctx, id); !errors.Is(err, errSessionNotFound) {
+				t.Errorf("LoadMeta() after Delete error = %v, want errSessionNotFound", err)
+			}
+		})
+	}
+}
+
+func TestLoadSessionStore(t *testing.T) {
+	for _, spec := range []string{"s3://bucket", "file:", "sqlite:"} {
+		t.Setenv("SESSION_STORE", spec)
+		if _, err := loadSessionStore(); err == nil {
+			t.Errorf("loadSessionStore() with SESSION_STORE=%q succeeded", spec)
+		}
+	}
+}
+
+func TestRecordSessionOwner(t *testing.T) {
+	for _, tt := range sessionStores {
+		t.Run(tt.name, func(t *testing.T) {
+			store, err := tt.open(t)
+			if err != nil {
+				t.Fatalf("failed to open store: %v", err)
+			}
+			sessionStore = store
+			t.Cleanup(func() { sessionStore = nil })
+			ctx := context.Background()
+			const id = "3f1c2d9e-7b6a-4e1f-8c2d-5a9b0e4f6c71"
+
+			// concurrent first runs race to claim the session; exactly one wins
+			var wg sync.WaitGroup
+			var claims atomic.Int32
+			for _, user := range []string{"alice", "bob", "carol", "dave"} {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					meta := SessionMeta{ID: id, User: user, Tenant: "acme"}
+					created, err := store.CreateMeta(ctx, meta)
+					if err != nil {
+						t.Errorf("CreateMeta(%s) error = %v", user, err)
+					}
+					if created {
+						claims.Add(1)
+					}
+				}()
+			}
+			wg.Wait()
+			if n := claims.Load(); n != 1 {
+				t.Fatalf("%d callers claimed the session, want 1", n)
+			}
+			owner, err := store.LoadMeta(ctx, id)
+			if err != nil {
+				t.Fatalf("LoadMeta() error = %v", err)
+			}
+
+			// a later run by someone else touches the session but keeps its owner
+			r := Request{identity: &Identity{User: "mallory", Tenant: "acme"}}
+			if err := recordSession(ctx, r, sessionRun{id: id}); err != nil {
+				t.Fatalf("recordSession() error = %v", err)
+			}
+			meta, err := store.LoadMeta(ctx, id)
+			if err != nil {
+				t.Fatalf("LoadMeta() error = %v", err)
+			}
+			if meta.User != owner.User || meta.Tenant != "acme" {
+				t.Errorf("owner after resume = %s/%s, want %s/acme", meta.Tenant, meta.User, owner.User)
+			}
+		})
+	}
+}
+
+func TestCheckSessionOwner(t *testing.T) {
+	store, err := newFileSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessionStore = store
+	t.Cleanup(func() { sessionStore = nil })
+
+	alice := &Identity{User: "alice", Tenant: "acme"}
+	if err := recordSession(context.Background(), Request{identity: alice}, sessionRun{id: "mine"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := recordSession(context.Background(), Request{}, sessionRun{id: "anonymous"}); err != nil {
+		t.Fatal(err)
+	}
+
+	str := func(s string) *string { return &s }
+	tests := []struct {
+		name     string
+		identity *Identity
+		resume   *string
+		wantErr  bool
+	}{
+		{"new session", alice, nil, false},
+		{"own session", alice, str("mine"), false},
+		{"same user in another tenant", &Identity{User: "alice", Tenant: "other"}, str("mine"), true},
+		{"another user", &Identity{User: "bob", Tenant: "acme"}, str("mine"), true},
+		{"unknown session", alice, str("missing"), true},
+		{"anonymous session", alice, str("anonymous"), true},
+		{"unauthenticated", nil, str("mine"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkSessionOwner(Request{identity: tt.identity, ResumeSessionID: tt.resume})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("checkSessionOwner() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
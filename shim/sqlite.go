@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// sqliteBusyTimeoutMS is how long a statement waits on another instance's
+// lock before failing.
+const sqliteBusyTimeoutMS = 5000
+
+// openSQLite opens the SQLite database at path, creating it if needed, and
+// applies schema. The driver is pure Go, so no sqlite3 library or tool has to
+// be installed; transactions take the write lock up front so that concurrent
+// instances queue on busy_timeout instead of failing to upgrade a read lock.
+func openSQLite(path, schema string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", fmt.Sprintf("file:%s?_pragma=busy_timeout(%d)&_txlock=immediate", path, sqliteBusyTimeoutMS))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// sqliteSessionStore keeps transcripts in one table of a SQLite database.
+type sqliteSessionStore struct {
+	db *sql.DB
+}
+
+func newSQLiteSessionStore(path string) (*sqliteSessionStore, error) {
+	if path == "" {
+		return nil, errors.New("sqlite session store requires a database path")
+	}
+	db, err := openSQLite(path, `CREATE TABLE IF NOT EXISTS sessions (
+  id TEXT PRIMARY KEY,
+  transcript BLOB NOT NULL,
+  updated_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS session_meta (
+  id TEXT PRIMARY KEY,
+  user TEXT NOT NULL,
+  tenant TEXT NOT NULL,
+  title TEXT NOT NULL DEFAULT '',
+  created_at INTEGER NOT NULL,
+  updated_at INTEGER NOT NULL,
+  num_turns INTEGER NOT NULL DEFAULT 0,
+  total_cost_usd REAL NOT NULL DEFAULT 0,
+  forked_from TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS session_meta_owner ON session_meta (tenant, user);`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sessions table: %w", err)
+	}
+	return &sqliteSessionStore{db: db}, nil
+}
+
+func (s *sqliteSessionStore) Load(ctx context.Context, id string) ([]byte, error) {
+	var transcript []byte
+	err := s.db.QueryRowContext(ctx, "SELECT transcript FROM sessions WHERE id = ?", id).Scan(&transcript)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errSessionNotFound
+	}
+	return transcript, err
+}
+
+func (s *sqliteSessionStore) Save(ctx context.Context, id string, transcript []byte) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO sessions (id, transcript, updated_at) VALUES (?, ?, ?)
+  ON CONFLICT(id) DO UPDATE SET transcript = excluded.transcript, updated_at = excluded.updated_at`,
+		id, transcript, time.Now().Unix())
+	return err
+}
+
+// sessionMetaColumns are the session_meta columns read by scanSessionMeta, in
+// order.
+const sessionMetaColumns = "id, user, tenant, title, created_at, updated_at, num_turns, total_cost_usd, forked_from"
+
+// scanSessionMeta reads one session_meta row selected with sessionMetaColumns.
+func scanSessionMeta(row interface{ Scan(...any) error }) (SessionMeta, error) {
+	var meta SessionMeta
+	var createdAt, updatedAt int64
+	err := row.Scan(&meta.ID, &meta.User, &meta.Tenant, &meta.Title, &createdAt, &updatedAt,
+		&meta.NumTurns, &meta.TotalCostUSD, &meta.ForkedFrom)
+	meta.CreatedAt, meta.UpdatedAt = time.Unix(createdAt, 0).UTC(), time.Unix(updatedAt, 0).UTC()
+	return meta, err
+}
+
+// sessionMetaValues are meta's values for sessionMetaColumns.
+func sessionMetaValues(meta SessionMeta) []any {
+	return []any{meta.ID, meta.User, meta.Tenant, meta.Title, meta.CreatedAt.Unix(), meta.UpdatedAt.Unix(),
+		meta.NumTurns, meta.TotalCostUSD, meta.ForkedFrom}
+}
+
+func (s *sqliteSessionStore) LoadMeta(ctx context.Context, id string) (*SessionMeta, error) {
+	meta, err := scanSessionMeta(s.db.QueryRowContext(ctx, "SELECT "+sessionMetaColumns+" FROM session_meta WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errSessionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+func (s *sqliteSessionStore) CreateMeta(ctx context.Context, meta SessionMeta) (bool, error) {
+	res, err := s.db.ExecContext(ctx, "INSERT INTO session_meta ("+sessionMetaColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?) "+
+		"ON CONFLICT(id) DO NOTHING", sessionMetaValues(meta)...)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqliteSessionStore) SaveMeta(ctx context.Context, meta SessionMeta) error {
+	_, err := s.db.ExecContext(ctx, "INSERT OR REPLACE INTO session_meta ("+sessionMetaColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		sessionMetaValues(meta)...)
+	return err
+}
+
+func (s *sqliteSessionStore) ListMeta(ctx context.Context, owner *Identity) ([]SessionMeta, error) {
+	query, args := "SELECT "+sessionMetaColumns+" FROM session_meta", []any{}
+	if owner != nil {
+		query += " WHERE user = ? AND user != '' AND tenant = ?"
+		args = append(args, owner.User, owner.Tenant)
+	}
+	rows, err := s.db.QueryContext(ctx, query+" ORDER BY updated_at DESC", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sessions := []SessionMeta{}
+	for rows.Next() {
+		meta, err := scanSessionMeta(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, meta)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *sqliteSessionStore) Delete(ctx context.Context, id string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, "DELETE FROM sessions WHERE id = ?", id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM session_meta WHERE id = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
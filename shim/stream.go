@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// maxEventBytes caps a single stream-json line; tool results can be large.
+const maxEventBytes = 10 << 20
+
+// streamClaude runs the CLI in stream-json mode and calls emit with the type
+// and raw JSON of every event as soon as the CLI prints it. If emit fails (the
+// caller went away) the agent is killed rather than left running unobserved.
+// With a session store configured, the resumed session is hydrated before the
+// run and the resulting session persisted after it.
+func streamClaude(ctx context.Context, r Request, emit func(eventType string, data []byte) error) error {
+	if err := hydrateSession(ctx, r); err != nil {
+		return err
+	}
+	var run sessionRun
+	defer func() {
+		persistSession(r, run)
+		recordUsage(r, run)
+	}()
+
+	cmd, err := claudeCommand(ctx, r)
+	if err != nil {
+		return err
+	}
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to open stdout pipe: %w", err)
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start claude: %w", err)
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxEventBytes)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var ev struct {
+			Type         string  `json:"type"`
+			SessionID    string  `json:"session_id"`
+			NumTurns     int     `json:"num_turns"`
+			TotalCostUSD float64 `json:"total_cost_usd"`
+			Usage        struct {
+				InputTokens              int64 `json:"input_tokens"`
+				OutputTokens             int64 `json:"output_tokens"`
+				CacheCreationInputTokens int64 `json:"cache_creation_input_tokens"`
+				CacheReadInputTokens     int64 `json:"cache_read_input_tokens"`
+			} `json:"usage"`
+		}
+		if err := json.Unmarshal(line, &ev); err != nil || ev.Type == "" {
+			ev.Type = "message"
+		}
+		if ev.SessionID != "" {
+			run.id = ev.SessionID
+		}
+		if ev.Type == "result" {
+			run.numTurns, run.costUSD = ev.NumTurns, ev.TotalCostUSD
+			run.inputTokens = ev.Usage.InputTokens + ev.Usage.CacheCreationInputTokens + ev.Usage.CacheReadInputTokens
+			run.outputTokens = ev.Usage.OutputTokens
+		}
+		if err := emit(ev.Type, line); err != nil {
+			killProcessGroup(cmd)
+			_ = cmd.Wait()
+			return fmt.Errorf("failed to relay event: %w", err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		killProcessGroup(cmd)
+		_ = cmd.Wait()
+		return fmt.Errorf("failed to read stream: %w", err)
+	}
+
+	if err := cmd.Wait(); err != nil {
+		if stderr.Len() > 0 {
+			return fmt.Errorf("%w: %s", err, stderr.String())
+		}
+		return err
+	}
+	return nil
+}
+
+// streamSSE relays the agent's events for a prepared request to w as
+// Server-Sent Events, one SSE event per CLI event named after its type. Tools
+// removed by the tool policy are announced first in a "denied_tools" event,
+// and a failed run ends with an "error" event carrying the same Response
+// envelope as non-streaming requests. flush, if non-nil, is called after
+// every event.
+func streamSSE(ctx context.Context, r Request, w io.Writer, flush func()) {
+	writeEvent := func(name string, data []byte) error {
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data); err != nil {
+			return err
+		}
+		if flush != nil {
+			flush()
+		}
+		return nil
+	}
+
+	if len(r.deniedTools) > 0 {
+		data, _ := json.Marshal(map[string][]string{"denied_tools": r.deniedTools})
+		_ = writeEvent("denied_tools", data)
+	}
+
+	ctx, cancel := withRunTimeout(ctx, r)
+	defer cancel()
+
+	var run runState
+	err := streamClaude(ctx, r, func(eventType string, data []byte) error {
+		_ = run.observe(eventType, data)
+		return writeEvent(eventType, data)
+	})
+	if err != nil {
+		log.Printf("stream: %v", err)
+		resp := run.response(ctx, err)
+		resp.DeniedTools = r.deniedTools
+		data, _ := json.Marshal(resp)
+		_ = writeEvent("error", data)
+	}
+}
+
+// handleStream serves a streaming request over HTTP as text/event-stream.
+func handleStream(ctx context.Context, w http.ResponseWriter, req Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeProxyResponse(w, errorResponse(ErrBadRequest, "streaming is not supported by this connection").ProxyResponse())
+		return
+	}
+	// reject the request with a proper status before committing to a stream
+	if err := prepare(&req); err != nil {
+		writeProxyResponse(w, prepareError(req, err))
+		return
+	}
+	release, err := runPool.acquire(ctx)
+	if err != nil {
+		writeProxyResponse(w, withHeaders(runPool.rejection(err), rateLimitHeaders(req)))
+		return
+	}
+	defer release()
+
+	for k, v := range rateLimitHeaders(req) {
+		w.Header().Set(k, v)
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	streamSSE(ctx, req, w, flusher.Flush)
+}
+
+// lambdaStream returns a Lambda response stream fed by the agent's events. It
+// requires a Function URL configured with InvokeMode RESPONSE_STREAM.
+func lambdaStream(ctx context.Context, r Request) *events.LambdaFunctionURLStreamingResponse {
+	if err := prepare(&r); err != nil {
+		resp := prepareError(r, err)
+		return &events.LambdaFunctionURLStreamingResponse{
+			StatusCode: resp.StatusCode,
+			Headers:    resp.Headers,
+			Body:       strings.NewReader(resp.Body),
+		}
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		streamSSE(ctx, r, pw, nil)
+		pw.Close()
+	}()
+	headers := map[string]string{
+		"Content-Type":  "text/event-stream",
+		"Cache-Control": "no-cache",
+	}
+	for k, v := range rateLimitHeaders(r) {
+		headers[k] = v
+	}
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: http.StatusOK,
+		Headers:    headers,
+		Body:       pr,
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// streamingClaude prints stream-json events, but only when asked for them.
+const streamingClaude = `case "$*" in *--output-format=stream-json*) ;; *) echo "not streaming: $*" >&2; exit 2 ;; esac
+echo '{"type":"system","subtype":"init"}'
+echo
+echo 'not json'
+echo '{"type":"result","result":"done"}'`
+
+func TestHandleRunStream(t *testing.T) {
+	fakeClaude(t, streamingClaude)
+	rec := httptest.NewRecorder()
+	handleRun(rec, httptest.NewRequest(http.MethodPost, "/v1/run", strings.NewReader(`{"prompt":"hi","stream":true}`)))
+
+	if got := rec.Header().Get("Content-Type"); got != "text/event-stream" {
+		t.Errorf("Content-Type = %q, want text/event-stream", got)
+	}
+	want := "event: system\ndata: {\"type\":\"system\",\"subtype\":\"init\"}\n\n" +
+		"event: message\ndata: not json\n\n" +
+		"event: result\ndata: {\"type\":\"result\",\"result\":\"done\"}\n\n"
+	if rec.Body.String() != want {
+		t.Errorf("stream = %q, want %q", rec.Body.String(), want)
+	}
+}
+
+func TestStreamSSEFailure(t *testing.T) {
+	fakeClaude(t, `echo '{"type":"system"}'; echo 'out of credit' >&2; exit 1`)
+	var out strings.Builder
+	flushes := 0
+	streamSSE(context.Background(), Request{Prompt: []byte(`"hi"`), Stream: true}, &out, func() { flushes++ })
+
+	events := strings.Split(strings.TrimSuffix(out.String(), "\n\n"), "\n\n")
+	if len(events) != 2 || !strings.HasPrefix(events[1], "event: error\n") || !strings.Contains(events[1], "out of credit") {
+		t.Errorf("stream = %q, want the event and then an error carrying stderr", out.String())
+	}
+	if flushes != 2 {
+		t.Errorf("flushed %d times, want once per event", flushes)
+	}
+}
+
+func TestLambdaStream(t *testing.T) {
+	fakeClaude(t, streamingClaude)
+	resp := lambdaStream(context.Background(), Request{Prompt: []byte(`"hi"`), Stream: true})
+	if resp.StatusCode != http.StatusOK || resp.Headers["Content-Type"] != "text/event-stream" {
+		t.Errorf("response %d %v, want a 200 event stream", resp.StatusCode, resp.Headers)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(body), "event: "); n != 3 {
+		t.Errorf("body has %d events, want 3:\n%s", n, body)
+	}
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Transcript is a session's conversation in a stable shape, independent of
+// the CLI's own JSONL format.
+type Transcript struct {
+	SessionMeta
+	Messages []TranscriptMessage `json:"messages"`
+}
+
+// TranscriptMessage is one user or assistant message. Tool results are sent
+// by the user role, as in the Messages API.
+type TranscriptMessage struct {
+	Role      string            `json:"role"`
+	Timestamp *time.Time        `json:"timestamp,omitempty"`
+	Content   []TranscriptBlock `json:"content"`
+}
+
+// TranscriptBlock is a text, tool_use, tool_result or image block. Image data
+// is omitted.
+type TranscriptBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text,omitempty"`
+	ID        string          `json:"id,omitempty"`
+	Name      string          `json:"name,omitempty"`
+	Input     json.RawMessage `json:"input,omitempty"`
+	ToolUseID string          `json:"tool_use_id,omitempty"`
+	IsError   bool            `json:"is_error,omitempty"`
+	MediaType string          `json:"media_type,omitempty"`
+}
+
+// transcriptLine is the part of a CLI transcript line the shim reads.
+type transcriptLine struct {
+	Type        string    `json:"type"`
+	IsSidechain bool      `json:"isSidechain"`
+	IsMeta      bool      `json:"isMeta"`
+	Timestamp   time.Time `json:"timestamp"`
+	Message     struct {
+		Role    string          `json:"role"`
+		Content json.RawMessage `json:"content"`
+	} `json:"message"`
+}
+
+// rawBlock is a content block as the CLI records it.
+type rawBlock struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text"`
+	ID        string          `json:"id"`
+	Name      string          `json:"name"`
+	Input     json.RawMessage `json:"input"`
+	ToolUseID string          `json:"tool_use_id"`
+	Content   json.RawMessage `json:"content"`
+	IsError   bool            `json:"is_error"`
+	Source    struct {
+		MediaType string `json:"media_type"`
+	} `json:"source"`
+}
+
+// parseTranscript normalizes the main thread of a CLI transcript. Subagent
+// side chains, CLI bookkeeping lines and thinking blocks are left out.
+func parseTranscript(data []byte) ([]TranscriptMessage, error) {
+	var messages []TranscriptMessage
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), maxEventBytes)
+	for scanner.Scan() {
+		var line transcriptLine
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			continue
+		}
+		if (line.Type != "user" && line.Type != "assistant") || line.IsSidechain || line.IsMeta {
+			continue
+		}
+		content := normalizeContent(line.Message.Content)
+		if len(content) == 0 {
+			continue
+		}
+		m := TranscriptMessage{Role: line.Type, Content: content}
+		if !line.Timestamp.IsZero() {
+			m.Timestamp = &line.Timestamp
+		}
+		messages = append(messages, m)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read transcript: %w", err)
+	}
+	return messages, nil
+}
+
+// normalizeContent converts message content, a string or a list of blocks.
+func normalizeContent(raw json.RawMessage) []TranscriptBlock {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		if text == "" {
+			return nil
+		}
+		return []TranscriptBlock{{Type: "text", Text: text}}
+	}
+
+	var blocks []rawBlock
+	if err := json.Unmarshal(raw, &blocks); err != nil {
+		return nil
+	}
+	var out []TranscriptBlock
+	for _, b := range blocks {
+		switch b.Type {
+		case "text":
+			out = append(out, TranscriptBlock{Type: b.Type, Text: b.Text})
+		case "tool_use":
+			out = append(out, TranscriptBlock{Type: b.Type, ID: b.ID, Name: b.Name, Input: b.Input})
+		case "tool_result":
+			out = append(out, TranscriptBlock{Type: b.Type, ToolUseID: b.ToolUseID, Text: toolResultText(b.Content), IsError: b.IsError})
+		case "image":
+			out = append(out, TranscriptBlock{Type: b.Type, MediaType: b.Source.MediaType})
+		}
+	}
+	return out
+}
+
+// toolResultText flattens a tool result's content, a string or text blocks.
+func toolResultText(raw json.RawMessage) string {
+	var text string
+	if err := json.Unmarshal(raw, &text); err == nil {
+		return text
+	}
+	var blocks []rawBlock
+	_ = json.Unmarshal(raw, &blocks)
+	var parts []string
+	for _, b := range blocks {
+		if b.Type == "text" {
+			parts = append(parts, b.Text)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// Markdown renders the transcript for reading or sharing.
+func (t Transcript) Markdown() string {
+	var b strings.Builder
+	title := t.Title
+	if title == "" {
+		title = "Session " + t.ID
+	}
+	fmt.Fprintf(&b, "# %s\n\n", title)
+	fmt.Fprintf(&b, "_Session `%s`, started %s, %d turns, $%.4f_\n", t.ID, t.CreatedAt.Format(time.RFC3339), t.NumTurns, t.TotalCostUSD)
+
+	for _, m := range t.Messages {
+		heading := "User"
+		if m.Role == "assistant" {
+			heading = "Assistant"
+		}
+		fmt.Fprintf(&b, "\n## %s\n", heading)
+		for _, c := range m.Content {
+			b.WriteString("\n")
+			switch c.Type {
+			case "text":
+				b.WriteString(c.Text + "\n")
+			case "tool_use":
+				fmt.Fprintf(&b, "**Tool call:** `%s`\n\n%s", c.Name, codeBlock("json", string(c.Input)))
+			case "tool_result":
+				label := "Tool result"
+				if c.IsError {
+					label = "Tool error"
+				}
+				fmt.Fprintf(&b, "**%s:**\n\n%s", label, codeBlock("", c.Text))
+			case "image":
+				fmt.Fprintf(&b, "_[image: %s]_\n", c.MediaType)
+			}
+		}
+	}
+	return b.String()
+}
+
+// codeBlock fences s with more backticks than it contains in a row.
+func codeBlock(lang, s string) string {
+	longest, run := 0, 0
+	for _, r := range s {
+		if r == '`' {
+			run++
+			longest = max(longest, run)
+		} else {
+			run = 0
+		}
+	}
+	fence := strings.Repeat("`", max(3, longest+1))
+	return fence + lang + "\n" + strings.TrimRight(s, "\n") + "\n" + fence + "\n"
+}
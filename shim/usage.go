@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// usagePath serves the usage report:
+//
+//	GET /v1/usage?from=2025-01-01&to=2025-01-31   daily usage and budget status
+const usagePath = "/v1/usage"
+
+// dayFormat is how ledger days are written; days are UTC.
+const dayFormat = "2006-01-02"
+
+// maxReportDays caps the range of a usage report.
+const maxReportDays = 366
+
+// UsageTotals is what runs cost and consumed. Input tokens include cache
+// reads and writes.
+type UsageTotals struct {
+	CostUSD      float64 `json:"cost_usd"`
+	InputTokens  int64   `json:"input_tokens"`
+	OutputTokens int64   `json:"output_tokens"`
+	Turns        int     `json:"turns"`
+	Runs         int     `json:"runs"`
+}
+
+func (t *UsageTotals) add(o UsageTotals) {
+	t.CostUSD += o.CostUSD
+	t.InputTokens += o.InputTokens
+	t.OutputTokens += o.OutputTokens
+	t.Turns += o.Turns
+	t.Runs += o.Runs
+}
+
+// UsageRow is the usage of one user, tenant and agent on one day. User and
+// Tenant are empty for unauthenticated requests.
+type UsageRow struct {
+	Day    string `json:"day"`
+	User   string `json:"user"`
+	Tenant string `json:"tenant"`
+	Agent  string `json:"agent"`
+	UsageTotals
+}
+
+// usageFilter selects ledger rows; a nil field matches anything.
+type usageFilter struct {
+	User   *string
+	Tenant *string
+	Agent  *string
+}
+
+func (f usageFilter) match(row UsageRow) bool {
+	return (f.User == nil || *f.User == row.User) &&
+		(f.Tenant == nil || *f.Tenant == row.Tenant) &&
+		(f.Agent == nil || *f.Agent == row.Agent)
+}
+
+// UsageLedger records the cost of every run for budgets and reports.
+type UsageLedger interface {
+	// Record adds row to the usage of its day, user, tenant and agent.
+	Record(ctx context.Context, row UsageRow) error
+	// Query returns the rows matching filter from day from to day to,
+	// inclusive, one per day, user, tenant and agent, ordered by day.
+	Query(ctx context.Context, filter usageFilter, from, to string) ([]UsageRow, error)
+}
+
+// usageLedger is the ledger configured by USAGE_LEDGER, or nil if usage is
+// not recorded.
+var usageLedger UsageLedger
+
+// loadUsageLedger opens the ledger named by USAGE_LEDGER, either file:<dir>
+// or sqlite:<file>.
+func loadUsageLedger() (UsageLedger, error) {
+	spec := os.Getenv("USAGE_LEDGER")
+	switch {
+	case spec == "":
+		return nil, nil
+	case strings.HasPrefix(spec, "file:"):
+		return newFileUsageLedger(strings.TrimPrefix(spec, "file:"))
+	case strings.HasPrefix(spec, "sqlite:"):
+		return newSQLiteUsageLedger(strings.TrimPrefix(spec, "sqlite:"))
+	default:
+		return nil, fmt.Errorf("unknown USAGE_LEDGER %q", spec)
+	}
+}
+
+// recordUsage adds a finished run to the ledger. Runs that never reported a
+// result cost nothing the shim knows of.
+func recordUsage(r Request, run sessionRun) {
+	if usageLedger == nil || (run.costUSD == 0 && run.numTurns == 0) {
+		return
+	}
+	row := UsageRow{
+		Day:   time.Now().UTC().Format(dayFormat),
+		Agent: r.agentName(),
+		UsageTotals: UsageTotals{
+			CostUSD:      run.costUSD,
+			InputTokens:  run.inputTokens,
+			OutputTokens: run.outputTokens,
+			Turns:        run.numTurns,
+			Runs:         1,
+		},
+	}
+	if r.identity != nil {
+		row.User, row.Tenant = r.identity.User, r.identity.Tenant
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	if err := usageLedger.Record(ctx, row); err != nil {
+		log.Printf("usage ledger: failed to record run of %s: %v", row.Agent, err)
+	}
+}
+
+// usageReport is the body of a usage report.
+type usageReport struct {
+	From    string         `json:"from"`
+	To      string         `json:"to"`
+	Total   UsageTotals    `json:"total"`
+	Usage   []UsageRow     `json:"usage"`
+	Budgets []budgetStatus `json:"budgets,omitempty"`
+}
+
+// usageAPI reports usage between the from and to days in query, by default
+// the current month so far. Callers see their own usage and budgets; a nil
+// caller, which only the CLI passes, sees everyone's.
+func usageAPI(ctx context.Context, caller *Identity, method string, query url.Values) events.APIGatewayProxyResponse {
+	if method != http.MethodGet {
+		return methodNotAllowed(method, usagePath)
+	}
+	if usageLedger == nil {
+		return errorResponse(ErrNotFound, "usage is not recorded on this deployment").ProxyResponse()
+	}
+
+	now := time.Now().UTC()
+	from, to := query.Get("from"), query.Get("to")
+	if from == "" {
+		from = now.Format("2006-01") + "-01"
+	}
+	if to == "" {
+		to = now.Format(dayFormat)
+	}
+	start, err1 := time.Parse(dayFormat, from)
+	end, err2 := time.Parse(dayFormat, to)
+	if err1 != nil || err2 != nil || end.Before(start) {
+		return errorResponse(ErrBadRequest, "from and to must be days in YYYY-MM-DD form, from not after to").ProxyResponse()
+	}
+	if end.Sub(start) >= maxReportDays*24*time.Hour {
+		return errorResponse(ErrBadRequest, fmt.Sprintf("a usage report covers at most %d days", maxReportDays)).ProxyResponse()
+	}
+
+	var filter usageFilter
+	if caller != nil {
+		filter.User, filter.Tenant = &caller.User, &caller.Tenant
+	}
+	if agent := query.Get("agent"); agent != "" {
+		filter.Agent = &agent
+	}
+	rows, err := usageLedger.Query(ctx, filter, from, to)
+	if err != nil {
+		return errorResponseFrom(fmt.Errorf("failed to read usage: %w", err)).ProxyResponse()
+	}
+
+	report := usageReport{From: from, To: to, Usage: rows}
+	if report.Usage == nil {
+		report.Usage = []UsageRow{}
+	}
+	for _, row := range rows {
+		report.Total.add(row.UsageTotals)
+	}
+	if caller != nil {
+		r := Request{identity: caller}
+		if selectAgent(&r) == nil {
+			if report.Budgets, _, err = budgetStatuses(ctx, r); err != nil {
+				return errorResponseFrom(err).ProxyResponse()
+			}
+		}
+	}
+	return jsonResponse(http.StatusOK, report)
+}
+
+// handleUsage serves the usage report over HTTP.
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	caller, err := authenticateCaller(newAuthRequest(r, nil))
+	if err != nil {
+		writeProxyResponse(w, errorResponseFrom(err).ProxyResponse())
+		return
+	}
+	writeProxyResponse(w, usageAPI(r.Context(), caller, r.Method, r.URL.Query()))
+}
+
+// runUsageCommand implements "shim usage [from [to]]", printing everyone's
+// usage for operators with access to the container.
+func runUsageCommand(args []string) error {
+	if len(args) > 2 {
+		return errors.New("usage: shim usage [from [to]]")
+	}
+	query := url.Values{}
+	if len(args) > 0 {
+		query.Set("from", args[0])
+	}
+	if len(args) > 1 {
+		query.Set("to", args[1])
+	}
+	resp := usageAPI(context.Background(), nil, http.MethodGet, query)
+	fmt.Println(resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("usage report failed with status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// fileUsageLedger appends each run to a <day>.jsonl file in a directory.
+// Appends of a single line are atomic, so several processes can share it.
+type fileUsageLedger struct {
+	dir string
+}
+
+func newFileUsageLedger(dir string) (*fileUsageLedger, error) {
+	if dir == "" {
+		return nil, errors.New("file usage ledger requires a directory")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create usage dir: %w", err)
+	}
+	return &fileUsageLedger{dir: dir}, nil
+}
+
+func (l *fileUsageLedger) Record(ctx context.Context, row UsageRow) error {
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(l.dir, row.Day+".jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (l *fileUsageLedger) Query(ctx context.Context, filter usageFilter, from, to string) ([]UsageRow, error) {
+	start, err := time.Parse(dayFormat, from)
+	if err != nil {
+		return nil, err
+	}
+	var rows []UsageRow
+	for day := start; day.Format(dayFormat) <= to; day = day.AddDate(0, 0, 1) {
+		dayRows, err := l.readDay(day.Format(dayFormat), filter)
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, dayRows...)
+	}
+	return rows, nil
+}
+
+// readDay sums one day's runs per user, tenant and agent.
+func (l *fileUsageLedger) readDay(day string, filter usageFilter) ([]UsageRow, error) {
+	f, err := os.Open(filepath.Join(l.dir, day+".jsonl"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rows []UsageRow
+	index := map[[3]string]int{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var run UsageRow
+		if err := json.Unmarshal(scanner.Bytes(), &run); err != nil || !filter.match(run) {
+			continue
+		}
+		key := [3]string{run.User, run.Tenant, run.Agent}
+		if i, ok := index[key]; ok {
+			rows[i].add(run.UsageTotals)
+			continue
+		}
+		index[key] = len(rows)
+		rows = append(rows, run)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read usage of %s: %w", day, err)
+	}
+	slices.SortFunc(rows, func(a, b UsageRow) int {
+		return strings.Compare(a.User+"\x00"+a.Tenant+"\x00"+a.Agent, b.User+"\x00"+b.Tenant+"\x00"+b.Agent)
+	})
+	return rows, nil
+}
+
+// sqliteUsageLedger keeps one row per day, user, tenant and agent in a
+// SQLite table, which several instances can share on one volume.
+type sqliteUsageLedger struct {
+	db *sql.DB
+}
+
+func newSQLiteUsageLedger(path string) (*sqliteUsageLedger, error) {
+	if path == "" {
+		return nil, errors.New("sqlite usage ledger requires a database path")
+	}
+	db, err := openSQLite(path, `CREATE TABLE IF NOT EXISTS usage (
+  day TEXT NOT NULL,
+  user TEXT NOT NULL,
+  tenant TEXT NOT NULL,
+  agent TEXT NOT NULL,
+  cost_usd REAL NOT NULL,
+  input_tokens INTEGER NOT NULL,
+  output_tokens INTEGER NOT NULL,
+  turns INTEGER NOT NULL,
+  runs INTEGER NOT NULL,
+  PRIMARY KEY (day, user, tenant, agent)
+);`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create usage table: %w", err)
+	}
+	return &sqliteUsageLedger{db: db}, nil
+}
+
+func (l *sqliteUsageLedger) Record(ctx context.Context, row UsageRow) error {
+	_, err := l.db.ExecContext(ctx, `INSERT INTO usage (day, user, tenant, agent, cost_usd, input_tokens, output_tokens, turns, runs)
+  VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+  ON CONFLICT(day, user, tenant, agent) DO UPDATE SET
+    cost_usd = cost_usd + excluded.cost_usd,
+    input_tokens = input_tokens + excluded.input_tokens,
+    output_tokens = output_tokens + excluded.output_tokens,
+    turns = turns + excluded.turns,
+    runs = runs + excluded.runs`,
+		row.Day, row.User, row.Tenant, row.Agent,
+		row.CostUSD, row.InputTokens, row.OutputTokens, row.Turns, row.Runs)
+	return err
+}
+
+func (l *sqliteUsageLedger) Query(ctx context.Context, filter usageFilter, from, to string) ([]UsageRow, error) {
+	where, args := []string{"day >= ?", "day <= ?"}, []any{from, to}
+	for _, c := range []struct {
+		column string
+		value  *string
+	}{{"user", filter.User}, {"tenant", filter.Tenant}, {"agent", filter.Agent}} {
+		if c.value != nil {
+			where = append(where, c.column+" = ?")
+			args = append(args, *c.value)
+		}
+	}
+	result, err := l.db.QueryContext(ctx, `SELECT day, user, tenant, agent, cost_usd, input_tokens, output_tokens, turns, runs
+FROM usage WHERE `+strings.Join(where, " AND ")+`
+ORDER BY day, user, tenant, agent`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer result.Close()
+	var rows []UsageRow
+	for result.Next() {
+		var row UsageRow
+		if err := result.Scan(&row.Day, &row.User, &row.Tenant, &row.Agent,
+			&row.CostUSD, &row.InputTokens, &row.OutputTokens, &row.Turns, &row.Runs); err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+	return rows, result.Err()
+}
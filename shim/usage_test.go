@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestUsageLedgers(t *testing.T) {
+	tests := []struct {
+		name string
+		open func(dir string) (UsageLedger, error)
+	}{
+		{"file", func(dir string) (UsageLedger, error) { return newFileUsageLedger(dir) }},
+		{"sqlite", func(dir string) (UsageLedger, error) { return newSQLiteUsageLedger(filepath.Join(dir, "usage.db")) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ledger, err := tt.open(t.TempDir())
+			if err != nil {
+				t.Fatalf("failed to open ledger: %v", err)
+			}
+			ctx := context.Background()
+			run := UsageTotals{CostUSD: 0.5, InputTokens: 100, OutputTokens: 10, Turns: 2, Runs: 1}
+			for _, row := range []UsageRow{
+				{Day: "2025-01-01", User: "alice", Tenant: "acme", Agent: "default", UsageTotals: run},
+				{Day: "2025-01-01", User: "alice", Tenant: "acme", Agent: "default", UsageTotals: run},
+				{Day: "2025-01-02", User: "bob", Tenant: "acme", Agent: "default", UsageTotals: run},
+				// quotes in names are data, not SQL
+				{Day: "2025-01-02", User: "o'brien", Tenant: "acme", Agent: "x' OR '1'='1", UsageTotals: run},
+				{Day: "2025-02-01", User: "alice", Tenant: "acme", Agent: "default", UsageTotals: run},
+			} {
+				if err := ledger.Record(ctx, row); err != nil {
+					t.Fatalf("Record() error = %v", err)
+				}
+			}
+
+			alice, acme := "alice", "acme"
+			rows, err := ledger.Query(ctx, usageFilter{User: &alice, Tenant: &acme}, "2025-01-01", "2025-01-31")
+			if err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+			if len(rows) != 1 || rows[0].Runs != 2 || rows[0].Turns != 4 || rows[0].CostUSD != 1 || rows[0].InputTokens != 200 {
+				t.Errorf("Query() for alice in January = %+v, want one row summing both runs", rows)
+			}
+
+			rows, err = ledger.Query(ctx, usageFilter{Tenant: &acme}, "2025-01-01", "2025-01-02")
+			if err != nil {
+				t.Fatalf("Query() error = %v", err)
+			}
+			if len(rows) != 3 || rows[0].Day != "2025-01-01" || rows[1].User != "bob" || rows[2].Agent != "x' OR '1'='1" {
+				t.Errorf("Query() for the tenant = %+v, want three rows by day and user", rows)
+			}
+
+			injected := "x' OR '1'='1"
+			if rows, err := ledger.Query(ctx, usageFilter{User: &injected}, "2025-01-01", "2025-12-31"); err != nil || len(rows) != 0 {
+				t.Errorf("Query() for a quoted user = %+v, %v, want no rows", rows, err)
+			}
+		})
+	}
+}
+
+func TestUsageAPI(t *testing.T) {
+	ledger, err := newFileUsageLedger(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	usageLedger = ledger
+	t.Cleanup(func() { usageLedger = nil })
+	ctx := context.Background()
+	for _, user := range []string{"alice", "bob"} {
+		row := UsageRow{Day: "2025-01-01", User: user, Agent: "default", UsageTotals: UsageTotals{CostUSD: 1, Turns: 1, Runs: 1}}
+		if err := ledger.Record(ctx, row); err != nil {
+			t.Fatal(err)
+		}
+	}
+	january := url.Values{"from": {"2025-01-01"}, "to": {"2025-01-31"}}
+
+	report := func(resp events.APIGatewayProxyResponse) usageReport {
+		t.Helper()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("usageAPI() status %d: %s", resp.StatusCode, resp.Body)
+		}
+		var r usageReport
+		if err := json.Unmarshal([]byte(resp.Body), &r); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+	if r := report(usageAPI(ctx, &Identity{User: "alice"}, http.MethodGet, january)); len(r.Usage) != 1 || r.Total.CostUSD != 1 {
+		t.Errorf("alice's report = %+v, want only her usage", r)
+	}
+	if r := report(usageAPI(ctx, nil, http.MethodGet, january)); len(r.Usage) != 2 || r.Total.CostUSD != 2 {
+		t.Errorf("operator report = %+v, want everyone's usage", r)
+	}
+
+	for _, q := range []url.Values{
+		{"from": {"2025-02-01"}, "to": {"2025-01-01"}},
+		{"from": {"January"}},
+		{"from": {"2024-01-01"}, "to": {"2025-12-31"}},
+	} {
+		if resp := usageAPI(ctx, nil, http.MethodGet, q); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("usageAPI(%v) status = %d, want 400", q, resp.StatusCode)
+		}
+	}
+}
+
+// Without authentication the usage API would show everyone's spending to
+// anyone, so Lambda does not serve it; only the CLI reports on everyone.
+func TestLambdaUsageRequiresAuthentication(t *testing.T) {
+	usageLedger, _ = newFileUsageLedger(t.TempDir())
+	t.Cleanup(func() { usageLedger = nil })
+	ev, _ := json.Marshal(map[string]any{
+		"rawPath":        "/v1/usage",
+		"requestContext": map[string]any{"http": map[string]string{"method": "GET"}},
+	})
+	resp, err := lambdaHandler(context.Background(), ev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := resp.(events.APIGatewayProxyResponse); got.StatusCode != http.StatusNotFound {
+		t.Errorf("unauthenticated usage call status = %d, want 404: %s", got.StatusCode, got.Body)
+	}
+}
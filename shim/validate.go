@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	maxPromptBytes       = 10 << 20
+	maxSystemPromptBytes = 64 << 10
+	maxTools             = 128
+	maxEnvVars           = 64
+	maxEnvValueBytes     = 32 << 10
+)
+
+var (
+	// toolNamePattern matches CLI tool names with an optional rule specifier,
+	// e.g. Read, mcp__assistant-mcp__list_todos or Bash(git log:*).
+	toolNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+(\([^(),]*\))?$`)
+	// sessionIDPattern matches the UUIDs the CLI uses for session ids.
+	sessionIDPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	// idempotencyKeyPattern matches client-chosen keys such as UUIDs or
+	// "slack:C024BE91L:1712345678.000100".
+	idempotencyKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,255}$`)
+	// envKeyPattern matches portable environment variable names.
+	envKeyPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// Validate checks the request before any subprocess is started. It reports
+// every problem it finds rather than stopping at the first one.
+func (r Request) Validate() error {
+	var problems []string
+
+	if len(r.Prompt) > maxPromptBytes {
+		problems = append(problems, fmt.Sprintf("prompt exceeds %d bytes", maxPromptBytes))
+	} else if _, _, err := parsePrompt(r.Prompt); err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	if r.AppendSystemPrompt != nil && len(*r.AppendSystemPrompt) > maxSystemPromptBytes {
+		problems = append(problems, fmt.Sprintf("append_system_prompt exceeds %d bytes", maxSystemPromptBytes))
+	}
+
+	problems = append(problems, validateTools("allowed_tools", r.AllowedTools)...)
+	problems = append(problems, validateTools("disallowed_tools", r.DisallowedTools)...)
+
+	if r.ResumeSessionID != nil && !sessionIDPattern.MatchString(*r.ResumeSessionID) {
+		problems = append(problems, fmt.Sprintf("resume_session_id %q is not a valid session id", *r.ResumeSessionID))
+	}
+
+	if r.TimeoutSeconds != nil && (*r.TimeoutSeconds <= 0 || *r.TimeoutSeconds > maxTimeoutSeconds) {
+		problems = append(problems, fmt.Sprintf("timeout_seconds must be between 1 and %d", maxTimeoutSeconds))
+	}
+
+	if r.MaxTurns != nil && *r.MaxTurns <= 0 {
+		problems = append(problems, "max_turns must be positive")
+	}
+	if r.Model != nil && *r.Model == "" {
+		problems = append(problems, "model must not be empty")
+	}
+	if r.SystemPromptID != nil && !promptIDPattern.MatchString(*r.SystemPromptID) {
+		problems = append(problems, fmt.Sprintf("system_prompt_id %q may only contain letters, digits, '-' and '_'", *r.SystemPromptID))
+	}
+	if r.Agent != nil && !promptIDPattern.MatchString(*r.Agent) {
+		problems = append(problems, fmt.Sprintf("agent %q may only contain letters, digits, '-' and '_'", *r.Agent))
+	}
+
+	if r.IdempotencyKey != nil {
+		if !idempotencyKeyPattern.MatchString(*r.IdempotencyKey) {
+			problems = append(problems, "idempotency_key must be 1-255 letters, digits or '-', '_', '.', ':'")
+		}
+		if r.Stream {
+			problems = append(problems, "idempotency_key cannot be used with stream")
+		}
+	}
+
+	if r.CallbackURL != nil && r.Stream {
+		problems = append(problems, "callback_url cannot be used with stream")
+	}
+
+	if len(r.Env) > maxEnvVars {
+		problems = append(problems, fmt.Sprintf("env has more than %d entries", maxEnvVars))
+	}
+	for k, v := range r.Env {
+		if !envKeyPattern.MatchString(k) {
+			problems = append(problems, fmt.Sprintf("env key %q is not a valid variable name", k))
+		}
+		if len(v) > maxEnvValueBytes {
+			problems = append(problems, fmt.Sprintf("env value for %q exceeds %d bytes", k, maxEnvValueBytes))
+		}
+		if strings.ContainsRune(v, 0) {
+			problems = append(problems, fmt.Sprintf("env value for %q contains a NUL byte", k))
+		}
+	}
+	if keys := requestEnvPolicy.disallowed(r.Env); len(keys) > 0 {
+		problems = append(problems, "env keys not allowed: "+strings.Join(keys, ", "))
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid request: " + strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+func validateTools(field string, tools []string) []string {
+	var problems []string
+	if len(tools) > maxTools {
+		problems = append(problems, fmt.Sprintf("%s has more than %d entries", field, maxTools))
+	}
+	for _, tool := range tools {
+		if !toolNamePattern.MatchString(tool) {
+			problems = append(problems, fmt.Sprintf("%s entry %q is not a valid tool name", field, tool))
+		}
+	}
+	return problems
+}
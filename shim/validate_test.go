@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	str := func(s string) *string { return &s }
+	zero := 0
+	tools := make([]string, maxTools+1)
+	for i := range tools {
+		tools[i] = "Read"
+	}
+
+	tests := []struct {
+		name string
+		r    Request
+		want []string // substrings of the error, none for a valid request
+	}{
+		{"valid", Request{
+			Prompt:          json.RawMessage(`"fix the build"`),
+			AllowedTools:    []string{"Read", "mcp__assistant-mcp__list_todos", "Bash(git log:*)"},
+			ResumeSessionID: str("0b5c9ab4-1f3e-4c55-9a2e-6f1d2a3b4c5d"),
+			Env:             map[string]string{"DEBUG": "1"},
+		}, nil},
+		{"missing prompt", Request{}, []string{"prompt is required"}},
+		{"empty prompt", Request{Prompt: json.RawMessage(`""`)}, []string{"prompt is required"}},
+		{"invalid prompt", Request{Prompt: json.RawMessage(`{"text":`)}, []string{"invalid prompt block"}},
+		{"oversized prompt", Request{Prompt: json.RawMessage(`"` + strings.Repeat("a", maxPromptBytes) + `"`)}, []string{"prompt exceeds"}},
+		{"every problem", Request{
+			Prompt:             json.RawMessage(`"hi"`),
+			AppendSystemPrompt: str(strings.Repeat("a", maxSystemPromptBytes+1)),
+			AllowedTools:       []string{"Bash(rm -rf /), Read"},
+			DisallowedTools:    tools,
+			ResumeSessionID:    str("../../etc/passwd"),
+			TimeoutSeconds:     &zero,
+			Env:                map[string]string{"1BAD": "x", "NUL": "a\x00b"},
+		}, []string{
+			"append_system_prompt exceeds",
+			`allowed_tools entry "Bash(rm -rf /), Read"`,
+			"disallowed_tools has more than",
+			"is not a valid session id",
+			"timeout_seconds must be between",
+			`env key "1BAD"`,
+			`env value for "NUL" contains a NUL byte`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.r.Validate()
+			if len(tt.want) == 0 {
+				if err != nil {
+					t.Errorf("Validate() error = %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("Validate() accepted the request")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Validate() error = %v, want it to mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+// An invalid request is answered without starting the agent.
+func TestHandleRunRejectsInvalid(t *testing.T) {
+	marker := filepath.Join(t.TempDir(), "ran")
+	fakeClaude(t, "touch "+marker)
+	rec := httptest.NewRecorder()
+	handleRun(rec, httptest.NewRequest(http.MethodPost, "/v1/run", strings.NewReader(`{"allowed_tools":["Read"]}`)))
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "prompt is required") {
+		t.Errorf("response %d %s, want a 400 naming the missing prompt", rec.Code, rec.Body.String())
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("the agent ran for an invalid request")
+	}
+}
+
+func TestEnsureSymlink(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(dir, "link")
+	for range 2 {
+		if err := ensureSymlink("/mnt/state/projects", link); err != nil {
+			t.Fatalf("ensureSymlink() error = %v", err)
+		}
+	}
+	if err := ensureSymlink("/elsewhere", link); err == nil {
+		t.Error("ensureSymlink() replaced a link to another target")
+	}
+}
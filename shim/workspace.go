@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// anonymousWorkspace is the workspace of unauthenticated requests. Like
+// noTenant, it cannot collide with a tenant's directory.
+const anonymousWorkspace = "_anonymous"
+
+// noTenant stands in for the tenant of callers that have none. It cannot
+// collide with a real tenant name, which must start with a letter or digit.
+const noTenant = "_"
+
+// safeName matches user and tenant names usable as a directory name as-is.
+var safeName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._@-]{0,63}$`)
+
+// checkWorkspaceMode refuses WORKSPACES_DIR under PERMISSION_MODE=skip. A
+// workspace is only the agent's working directory; without permission checks
+// nothing keeps the agent from reaching other callers' workspaces with Bash.
+func checkWorkspaceMode(mode string) error {
+	if os.Getenv("WORKSPACES_DIR") != "" && mode == permissionSkip {
+		return fmt.Errorf("WORKSPACES_DIR requires PERMISSION_MODE=%s or %s", permissionAllowlist, permissionDelegate)
+	}
+	return nil
+}
+
+// runDir is the working directory the CLI runs in for r. With WORKSPACES_DIR
+// set, every caller gets their own directory beneath it, <tenant>/<user>, so
+// agents working for different users do not start out sharing files.
+func runDir(r Request) string {
+	if root := os.Getenv("WORKSPACES_DIR"); root != "" {
+		if r.identity == nil {
+			return filepath.Join(root, anonymousWorkspace)
+		}
+		tenant := noTenant
+		if r.identity.Tenant != "" {
+			tenant = workspaceName(r.identity.Tenant)
+		}
+		return filepath.Join(root, tenant, workspaceName(r.identity.User))
+	}
+	dir, err := os.Getwd()
+	if err != nil {
+		return "/"
+	}
+	return dir
+}
+
+// workspaceName maps a user or tenant name to a directory name. Names that are
+// not safe to use directly, such as "../x" or "a/b", are replaced by a hash.
+func workspaceName(name string) string {
+	if safeName.MatchString(name) {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	return "h-" + hex.EncodeToString(sum[:16])
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRunDir(t *testing.T) {
+	root := t.TempDir()
+	t.Setenv("WORKSPACES_DIR", root)
+	tests := []struct {
+		name     string
+		identity *Identity
+		want     string
+	}{
+		{"anonymous", nil, "_anonymous"},
+		{"user without tenant", &Identity{User: "alice"}, "_/alice"},
+		{"user in tenant", &Identity{User: "alice", Tenant: "acme"}, "acme/alice"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := runDir(Request{identity: tt.identity}); got != filepath.Join(root, tt.want) {
+				t.Errorf("runDir() = %q, want %q", got, filepath.Join(root, tt.want))
+			}
+		})
+	}
+
+	// names that could escape the root are hashed
+	got := runDir(Request{identity: &Identity{User: "../../etc", Tenant: "a/b"}})
+	if dir, err := filepath.Rel(root, got); err != nil || strings.HasPrefix(dir, "..") || strings.Count(dir, "/") != 1 {
+		t.Errorf("runDir() = %q escapes or flattens %q", got, root)
+	}
+}
+
+func TestCheckWorkspaceMode(t *testing.T) {
+	t.Setenv("WORKSPACES_DIR", "/workspace/users")
+	if err := checkWorkspaceMode(permissionSkip); err == nil {
+		t.Error("checkWorkspaceMode() allowed WORKSPACES_DIR under PERMISSION_MODE=skip")
+	}
+	if err := checkWorkspaceMode(permissionAllowlist); err != nil {
+		t.Errorf("checkWorkspaceMode() error = %v", err)
+	}
+	t.Setenv("WORKSPACES_DIR", "")
+	if err := checkWorkspaceMode(permissionSkip); err != nil {
+		t.Errorf("checkWorkspaceMode() without WORKSPACES_DIR error = %v", err)
+	}
+}